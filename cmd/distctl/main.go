@@ -0,0 +1,88 @@
+// distctl 用来在本地管理整个系统
+//
+//	distctl up [-f distributed.json]
+//
+// 按 manifest 启动所有服务: 先启动注册中心, 再按依赖关系启动其他服务,
+// 进程崩溃后自动重启, 所有输出汇总到终端, 按 Ctrl+C 后按相反的顺序停止
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "up" {
+		fmt.Fprintln(os.Stderr, "usage: distctl up [-f manifest]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	manifestPath := fs.String("f", "distributed.json", "manifest describing the services to start")
+	fs.Parse(os.Args[2:])
+
+	if err := up(*manifestPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func up(manifestPath string) error {
+	m, err := loadManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	order, err := m.startOrder()
+	if err != nil {
+		return err
+	}
+
+	out := &output{w: os.Stdout, width: len("distctl")}
+	for _, spec := range order {
+		if len(spec.Name) > out.width {
+			out.width = len(spec.Name)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	var running []*process
+	// 按启动顺序的相反顺序停止, 注册中心最后停止, 其他服务退出时还可以注销
+	shutdown := func() {
+		for i := len(running) - 1; i >= 0; i-- {
+			out.printf("distctl", "stopping %s", running[i].spec.Name)
+			running[i].stop()
+		}
+	}
+
+	for _, spec := range order {
+		select {
+		case <-sigs:
+			shutdown()
+			return nil
+		default:
+		}
+
+		out.printf("distctl", "starting %s", spec.Name)
+		p := newProcess(spec, out)
+		if err := p.supervise(); err != nil {
+			shutdown()
+			return fmt.Errorf("failed to start %s: %v", spec.Name, err)
+		}
+		running = append(running, p)
+		// 依赖它的服务要等它开始监听之后再启动
+		if err := p.waitReady(); err != nil {
+			shutdown()
+			return err
+		}
+	}
+	out.printf("distctl", "all services started, press Ctrl+C to stop")
+
+	<-sigs
+	shutdown()
+	return nil
+}
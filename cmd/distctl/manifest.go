@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 描述要启动的所有服务
+type Manifest struct {
+	// 注册中心的名称, 其他服务都隐式依赖它, 默认为 registryservice
+	Registry string
+	Services []ServiceSpec
+}
+
+type ServiceSpec struct {
+	Name string
+	// 可执行文件, 相对路径相对于 manifest 所在的目录
+	Command string
+	Args    []string
+	Env     map[string]string
+	// 服务监听的端口, 端口可以连接之后才启动依赖它的服务, 为 0 时不等待
+	Port int
+	// 需要先启动的服务
+	DependsOn []string
+	// 停止时等待服务退出的时间, 格式为 30s, 1m, 超时后强制结束
+	// 为空时按 Args 中的 -drain-timeout 计算, 见 defaultStopTimeout
+	StopTimeout string `json:",omitempty"`
+
+	stopTimeout time.Duration
+}
+
+const (
+	// 和 service 包中的默认值相同
+	defaultDrainTimeout = time.Second * 10
+	drainPropagation    = time.Second
+	// cmd 中的服务最多有一个 shutdown hook, 多留一个的余量
+	shutdownHooks = 2
+)
+
+// 服务停止时依次: 标记 draining 后等待 drainPropagation, 最多等待 drain timeout 让请求完成,
+// 每个 shutdown hook 最多再等待一个 drain timeout
+func defaultStopTimeout(args []string) (time.Duration, error) {
+	drainTimeout := defaultDrainTimeout
+	for i, arg := range args {
+		name, value := arg, ""
+		if j := strings.Index(arg, "="); j >= 0 {
+			name, value = arg[:j], arg[j+1:]
+		} else if i+1 < len(args) {
+			value = args[i+1]
+		}
+		if name != "-drain-timeout" && name != "--drain-timeout" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid -drain-timeout %q", value)
+		}
+		drainTimeout = d
+	}
+	return drainPropagation + drainTimeout*(1+shutdownHooks), nil
+}
+
+func loadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", path, err)
+	}
+	if m.Registry == "" {
+		m.Registry = "registryservice"
+	}
+
+	dir := filepath.Dir(path)
+	names := make(map[string]bool)
+	for i := range m.Services {
+		spec := &m.Services[i]
+		if spec.Name == "" || spec.Command == "" {
+			return nil, fmt.Errorf("service %d in manifest needs a name and a command", i)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("service %s is defined twice", spec.Name)
+		}
+		names[spec.Name] = true
+		if !filepath.IsAbs(spec.Command) && filepath.Base(spec.Command) != spec.Command {
+			spec.Command = filepath.Join(dir, spec.Command)
+		}
+		if spec.StopTimeout != "" {
+			if spec.stopTimeout, err = time.ParseDuration(spec.StopTimeout); err != nil || spec.stopTimeout <= 0 {
+				return nil, fmt.Errorf("service %s has an invalid stop timeout %q", spec.Name, spec.StopTimeout)
+			}
+		} else if spec.stopTimeout, err = defaultStopTimeout(spec.Args); err != nil {
+			return nil, fmt.Errorf("service %s: %v", spec.Name, err)
+		}
+	}
+	for _, spec := range m.Services {
+		for _, dep := range spec.DependsOn {
+			if !names[dep] {
+				return nil, fmt.Errorf("service %s depends on unknown service %s", spec.Name, dep)
+			}
+		}
+	}
+	return &m, nil
+}
+
+// 按依赖关系排序, 注册中心总是第一个, 其余没有依赖关系的服务保持 manifest 中的顺序
+func (m *Manifest) startOrder() ([]ServiceSpec, error) {
+	withRegistry := hasService(m.Services, m.Registry)
+	deps := make(map[string][]string, len(m.Services))
+	for _, spec := range m.Services {
+		deps[spec.Name] = spec.DependsOn
+		if withRegistry && spec.Name != m.Registry {
+			deps[spec.Name] = append([]string{m.Registry}, spec.DependsOn...)
+		}
+	}
+
+	var order []ServiceSpec
+	started := make(map[string]bool)
+	for len(order) < len(m.Services) {
+		progress := false
+		for _, spec := range m.Services {
+			if started[spec.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range deps[spec.Name] {
+				if !started[dep] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+			order = append(order, spec)
+			started[spec.Name] = true
+			progress = true
+			// 每次只取一个, 保证依赖满足的服务中总是先启动 manifest 中靠前的
+			break
+		}
+		if !progress {
+			var cycle []string
+			for _, spec := range m.Services {
+				if !started[spec.Name] {
+					cycle = append(cycle, spec.Name)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between %v", cycle)
+		}
+	}
+	return order, nil
+}
+
+func hasService(specs []ServiceSpec, name string) bool {
+	for _, spec := range specs {
+		if spec.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStopTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		spec ServiceSpec
+		want time.Duration
+		err  string
+	}{
+		{"default drain timeout", ServiceSpec{}, 31 * time.Second, ""},
+		{"drain timeout flag", ServiceSpec{Args: []string{"-data", "./data", "-drain-timeout", "5s"}}, 16 * time.Second, ""},
+		{"drain timeout with equals", ServiceSpec{Args: []string{"--drain-timeout=20s"}}, 61 * time.Second, ""},
+		{"configured", ServiceSpec{Args: []string{"-drain-timeout", "5s"}, StopTimeout: "2m"}, 2 * time.Minute, ""},
+		{"invalid drain timeout", ServiceSpec{Args: []string{"-drain-timeout", "soon"}}, 0, "invalid -drain-timeout"},
+		{"missing drain timeout", ServiceSpec{Args: []string{"-drain-timeout"}}, 0, "invalid -drain-timeout"},
+		{"invalid stop timeout", ServiceSpec{StopTimeout: "forever"}, 0, "invalid stop timeout"},
+		{"negative stop timeout", ServiceSpec{StopTimeout: "-1s"}, 0, "invalid stop timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.spec.Name, tt.spec.Command = "testservice", "testservice"
+			data, err := json.Marshal(Manifest{Services: []ServiceSpec{tt.spec}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "distributed.json")
+			if err := ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := loadManifest(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("loadManifest error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Services[0].stopTimeout; got != tt.want {
+				t.Errorf("stop timeout = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// 崩溃后重启的等待时间, 每次翻倍, 稳定运行 restartResetAfter 之后恢复
+	restartDelay      = time.Second
+	maxRestartDelay   = time.Second * 30
+	restartResetAfter = time.Minute
+	// 等待端口可以连接的时间
+	readyTimeout = time.Second * 30
+)
+
+// 汇总所有服务的输出, 每行加上服务名称
+type output struct {
+	lock  sync.Mutex
+	w     io.Writer
+	width int
+}
+
+func (o *output) printf(name, format string, args ...interface{}) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	fmt.Fprintf(o.w, "%-*s | %s\n", o.width, name, strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+}
+
+// 逐行读取 r 并输出, 直到 r 被关闭
+// 遇到超过 1MB 的行时不再输出, 但继续读完, 否则服务写满管道后会阻塞
+func (o *output) copy(name string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		o.printf(name, "%s", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		o.printf(name, "output discarded: %v", err)
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+// 一个被监管的服务进程
+type process struct {
+	spec ServiceSpec
+	out  *output
+
+	lock     sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+	// 调用 stop 时关闭, 用来打断重启前的等待
+	stopCh chan struct{}
+	// 当前进程退出时关闭
+	exited chan struct{}
+	// 不再重启之后关闭
+	done chan struct{}
+}
+
+func newProcess(spec ServiceSpec, out *output) *process {
+	return &process{
+		spec:   spec,
+		out:    out,
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+var errStopping = errors.New("process is stopping")
+
+// 持有锁启动进程, 保证 stop 之后不会再启动新的进程
+func (p *process) start() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopping {
+		return errStopping
+	}
+	cmd := exec.Command(p.spec.Command, p.spec.Args...)
+	detach(cmd)
+	cmd.Env = os.Environ()
+	for k, v := range p.spec.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	r, w := io.Pipe()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go p.out.copy(p.spec.Name, r)
+
+	exited := make(chan struct{})
+	p.cmd, p.exited = cmd, exited
+	go func() {
+		err := cmd.Wait()
+		w.Close()
+		if err != nil {
+			p.out.printf(p.spec.Name, "exited: %v", err)
+		} else {
+			p.out.printf(p.spec.Name, "exited")
+		}
+		close(exited)
+	}()
+	return nil
+}
+
+// 启动进程, 退出后按退避时间重启, 直到 stop 被调用
+func (p *process) supervise() error {
+	if err := p.start(); err != nil {
+		close(p.done)
+		return err
+	}
+
+	go func() {
+		defer close(p.done)
+
+		delay := restartDelay
+		for {
+			started := time.Now()
+			p.lock.Lock()
+			exited := p.exited
+			p.lock.Unlock()
+			<-exited
+
+			if p.isStopping() {
+				return
+			}
+			if time.Since(started) > restartResetAfter {
+				delay = restartDelay
+			}
+			p.out.printf(p.spec.Name, "restarting in %v", delay)
+			select {
+			case <-time.After(delay):
+			case <-p.stopCh:
+				return
+			}
+			if delay *= 2; delay > maxRestartDelay {
+				delay = maxRestartDelay
+			}
+
+			if err := p.start(); err == errStopping {
+				return
+			} else if err != nil {
+				p.out.printf(p.spec.Name, "failed to restart: %v", err)
+				// 启动失败时没有进程, 用一个已关闭的 channel 直接进入下一次重试
+				p.lock.Lock()
+				p.exited = make(chan struct{})
+				close(p.exited)
+				p.lock.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *process) isStopping() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.stopping
+}
+
+// 等待端口可以连接, 进程退出或者超时时返回错误
+func (p *process) waitReady() error {
+	if p.spec.Port == 0 {
+		return nil
+	}
+	addr := fmt.Sprintf("localhost:%d", p.spec.Port)
+	deadline := time.Now().Add(readyTimeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		p.lock.Lock()
+		exited := p.exited
+		p.lock.Unlock()
+		select {
+		case <-exited:
+			return fmt.Errorf("%s exited before listening on %s", p.spec.Name, addr)
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+	return fmt.Errorf("%s did not listen on %s within %v", p.spec.Name, addr, readyTimeout)
+}
+
+// 发送 SIGTERM 让服务处理完请求, 注销并退出, 超过 spec 中的停止时间后强制结束
+func (p *process) stop() {
+	p.lock.Lock()
+	if !p.stopping {
+		p.stopping = true
+		close(p.stopCh)
+	}
+	cmd, exited := p.cmd, p.exited
+	p.lock.Unlock()
+
+	if cmd == nil {
+		<-p.done
+		return
+	}
+	select {
+	case <-exited:
+	default:
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(p.spec.stopTimeout):
+			p.out.printf(p.spec.Name, "did not stop within %v, killing", p.spec.stopTimeout)
+			cmd.Process.Kill()
+			<-exited
+		}
+	}
+	<-p.done
+}
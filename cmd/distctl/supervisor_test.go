@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputCopy(t *testing.T) {
+	long := strings.Repeat("x", 2*1024*1024)
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"lines", "first\nsecond\n", []string{"svc | first", "svc | second"}},
+		{"no trailing newline", "first\nsecond", []string{"svc | first", "svc | second"}},
+		// 超长的行之后的输出被丢弃, 但会读完, 服务不会阻塞在管道上
+		{"line too long", "first\n" + long + "\nlast\n", []string{"svc | first", "svc | output discarded"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			o := &output{w: &buf, width: 3}
+			r, w := io.Pipe()
+			done := make(chan struct{})
+			go func() {
+				o.copy("svc", r)
+				close(done)
+			}()
+
+			// 管道没有缓冲, 写入返回说明全部被读走了
+			written := make(chan error, 1)
+			go func() {
+				_, err := io.WriteString(w, tt.input)
+				w.Close()
+				written <- err
+			}()
+			select {
+			case err := <-written:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("writer blocked")
+			}
+			<-done
+
+			lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("output %q, want %d lines", lines, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("line %d = %q, want prefix %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
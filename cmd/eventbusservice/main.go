@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"distributed/eventbus"
+	"distributed/registry"
+	"distributed/service"
+	"flag"
+	"fmt"
+	stlog "log"
+	"strings"
+	"time"
+)
+
+func main() {
+	gossip := flag.Bool("gossip", false, "discover services through a gossip cluster instead of the registry")
+	seeds := flag.String("seeds", "", "comma separated service URLs used to join the gossip cluster")
+	region := flag.String("region", "", "region this instance runs in")
+	zone := flag.String("zone", "", "zone this instance runs in, providers in the same zone are preferred")
+	version := flag.String("version", "1.0.0", "semantic version of this instance")
+	interactive := flag.Bool("interactive", false, "also stop the service when Enter is pressed")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "how long in-flight requests may take to finish when stopping")
+	dataDir := flag.String("data", "./eventbus-data", "directory topics and subscriptions are stored in")
+	maxAge := flag.Duration("retention", eventbus.DefaultRetention.MaxAge, "how long events are kept")
+	maxEvents := flag.Int("max-events", eventbus.DefaultRetention.MaxEvents, "maximum number of events kept per topic, 0 for no limit")
+	flag.Parse()
+
+	var (
+		host        = "localhost"
+		port        = "8000"
+		serviceAddr = fmt.Sprintf("http://%s:%s", host, port)
+	)
+
+	r := registry.Registration{
+		ServiceName:      registry.EventBusService,
+		ServiceURL:       serviceAddr,
+		RequiredServices: make([]registry.ServiceName, 0),
+		ServiceUpdateURL: serviceAddr + "/services",
+		HeartbeatURL:     serviceAddr + "/heartbeat",
+		Version:          *version,
+		Region:           *region,
+		Zone:             *zone,
+	}
+
+	var opts []service.Option
+	if *gossip {
+		opts = append(opts, service.WithGossipSeeds(strings.Split(*seeds, ",")...))
+	}
+	opts = append(opts, service.WithDrainTimeout(*drainTimeout))
+	if *interactive {
+		opts = append(opts, service.Interactive())
+	}
+	// 注销之后再停止后台任务
+	stop := make(chan struct{})
+	opts = append(opts, service.OnShutdown(func(ctx context.Context) error {
+		close(stop)
+		return nil
+	}))
+
+	retention := eventbus.Retention{MaxAge: *maxAge, MaxEvents: *maxEvents}
+	if err := eventbus.Run(*dataDir, retention, stop); err != nil {
+		stlog.Fatalln(err)
+	}
+
+	ctx, err := service.Start(
+		context.Background(),
+		host,
+		port,
+		r,
+		eventbus.RegisterHandlers,
+		opts...,
+	)
+	if err != nil {
+		stlog.Fatalln(err)
+	}
+
+	// 等待停止
+	<-ctx.Done()
+
+	fmt.Println("Shutting down event bus service")
+}
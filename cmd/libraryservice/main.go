@@ -6,11 +6,34 @@ import (
 	"distributed/log"
 	"distributed/registry"
 	"distributed/service"
+	"flag"
 	"fmt"
 	stlog "log"
+	"strings"
+	"time"
 )
 
 func main() {
+	gossip := flag.Bool("gossip", false, "discover services through a gossip cluster instead of the registry")
+	seeds := flag.String("seeds", "", "comma separated service URLs used to join the gossip cluster")
+	region := flag.String("region", "", "region this instance runs in")
+	zone := flag.String("zone", "", "zone this instance runs in, providers in the same zone are preferred")
+	version := flag.String("version", "1.0.0", "semantic version of this instance")
+	interactive := flag.Bool("interactive", false, "also stop the service when Enter is pressed")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "how long in-flight requests may take to finish when stopping")
+	logLevel := flag.String("log-level", "info", "minimum log level, overridden by levels set in the log service")
+	logSpool := flag.String("log-spool", "", "file log records are kept in while the log service is unreachable, defaults to one in the temp directory")
+	flag.Parse()
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		stlog.Fatalln(err)
+	}
+	log.SetLevel(level)
+	if *logSpool != "" {
+		log.SetSpoolFile(*logSpool)
+	}
+
 	host, port := "localhost", "6000"
 	serviceAddr := fmt.Sprintf("http://%s:%s", host, port)
 
@@ -19,28 +42,50 @@ func main() {
 		ServiceURL:  serviceAddr,
 		RequiredServices: []registry.ServiceName{
 			registry.LogService,
+			registry.TraceService,
+			registry.EventBusService,
+		},
+		// 没有日志服务时日志写到本地, 没有追踪服务时不上报 span, 没有事件总线时不发布借还书事件, 都可以降级运行
+		OptionalServices: []registry.ServiceName{
+			registry.LogService,
+			registry.TraceService,
+			registry.EventBusService,
+		},
+		RequiredVersions: map[registry.ServiceName]string{
+			registry.LogService: "^1.0.0",
 		},
 		ServiceUpdateURL: serviceAddr + "/services",
 		HeartbeatURL:     serviceAddr + "/heartbeat",
+		Version:          *version,
+		Region:           *region,
+		Zone:             *zone,
+	}
+	log.SetInstance(registry.InstanceID(r.ServiceURL))
+	// 日志服务是可选依赖, 每批日志都通过注册中心找一个可用的实例, 一个都没有时写到本地
+	log.SetRegistryLogger(r.ServiceName)
+	var opts []service.Option
+	if *gossip {
+		opts = append(opts, service.WithGossipSeeds(strings.Split(*seeds, ",")...))
+	}
+	opts = append(opts, service.WithDrainTimeout(*drainTimeout))
+	// 停止前把缓存的日志发出去, 发不出去的留在 spool 文件中下次启动时补发
+	opts = append(opts, service.OnShutdown(log.Flush))
+	if *interactive {
+		opts = append(opts, service.Interactive())
 	}
+
 	ctx, err := service.Start(
 		context.Background(),
 		host,
 		port,
 		r,
 		library.RegisterHandlers,
+		opts...,
 	)
 	if err != nil {
 		stlog.Fatalln(err)
 	}
 
-	if logProvider, err := registry.GetProvider(registry.LogService); err == nil {
-		fmt.Printf("Logging service found at: %s\n", logProvider)
-		log.SetClientLogger(logProvider, r.ServiceName)
-	} else {
-		fmt.Println(err)
-	}
-
 	// 等待停止
 	<-ctx.Done()
 
@@ -5,35 +5,91 @@ import (
 	"distributed/log"
 	"distributed/registry"
 	"distributed/service"
+	"flag"
 	"fmt"
 	stlog "log"
+	"strings"
+	"time"
 )
 
 func main() {
-	log.Run("./distributed.log")
+	gossip := flag.Bool("gossip", false, "discover services through a gossip cluster instead of the registry")
+	seeds := flag.String("seeds", "", "comma separated service URLs used to join the gossip cluster")
+	region := flag.String("region", "", "region this instance runs in")
+	zone := flag.String("zone", "", "zone this instance runs in, providers in the same zone are preferred")
+	version := flag.String("version", "1.0.0", "semantic version of this instance")
+	interactive := flag.Bool("interactive", false, "also stop the service when Enter is pressed")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "how long in-flight requests may take to finish when stopping")
+	dst := flag.String("file", "./distributed.log", "file log records are written to")
+	maxSize := flag.Int64("max-size", log.DefaultRotation.MaxSize, "rotate the log file when it grows beyond this many bytes, 0 to disable")
+	rotateInterval := flag.Duration("rotate-interval", log.DefaultRotation.Interval, "rotate the log file after this long, 0 to disable")
+	compress := flag.Bool("compress", log.DefaultRotation.Compress, "gzip rotated log files")
+	maxFiles := flag.Int("max-files", log.DefaultRetention.MaxFiles, "maximum number of rotated files kept, 0 for no limit")
+	maxAge := flag.Duration("retention", log.DefaultRetention.MaxAge, "how long rotated files are kept, 0 for no limit")
+	maxTotalSize := flag.Int64("max-total-size", log.DefaultRetention.MaxTotalSize, "maximum bytes kept across all log files, 0 for no limit")
+	syncPolicy := flag.String("sync", log.DefaultSync.Policy.String(), "when records are synced to disk: always, interval or never")
+	sinks := flag.String("sinks", "", "JSON file listing extra sinks records are copied to, such as an errors-only file, stdout, syslog or another log service")
+	syncInterval := flag.Duration("sync-interval", log.DefaultSync.Interval, "how often records are synced to disk with -sync interval")
+	port := flag.String("port", "4000", "port to listen on, so several log service instances can run on one host")
+	flag.Parse()
+
+	policy, err := log.ParseSyncPolicy(*syncPolicy)
+	if err != nil {
+		stlog.Fatalln(err)
+	}
 
 	var (
 		host        = "localhost"
-		port        = "4000"
-		serviceAddr = fmt.Sprintf("http://%s:%s", host, port)
+		serviceAddr = fmt.Sprintf("http://%s:%s", host, *port)
 		serviceName = registry.LogService
 	)
 
 	r := registry.Registration{
 		ServiceName: registry.ServiceName(serviceName),
 		ServiceURL:  serviceAddr,
-		// 依赖一个空服务
-		RequiredServices: make([]registry.ServiceName, 0),
+		// 只依赖可选的追踪服务
+		RequiredServices: []registry.ServiceName{registry.TraceService},
+		OptionalServices: []registry.ServiceName{registry.TraceService},
 		ServiceUpdateURL: serviceAddr + "/services",
 		HeartbeatURL:     serviceAddr + "/heartbeat",
+		Version:          *version,
+		Region:           *region,
+		Zone:             *zone,
+	}
+
+	var opts []service.Option
+	if *gossip {
+		opts = append(opts, service.WithGossipSeeds(strings.Split(*seeds, ",")...))
+	}
+	opts = append(opts, service.WithDrainTimeout(*drainTimeout))
+	if *interactive {
+		opts = append(opts, service.Interactive())
+	}
+	// 开始等待正在处理的请求时结束实时日志的连接
+	opts = append(opts, service.OnDrain(log.CloseStreams))
+
+	rotation := log.Rotation{MaxSize: *maxSize, Interval: *rotateInterval, Compress: *compress}
+	retention := log.Retention{MaxFiles: *maxFiles, MaxAge: *maxAge, MaxTotalSize: *maxTotalSize}
+	if *sinks != "" {
+		if err := log.LoadSinks(*sinks); err != nil {
+			stlog.Fatalln(err)
+		}
+	}
+	sync := log.Sync{Policy: policy, Interval: *syncInterval}
+	closeLog, err := log.Run(*dst, rotation, retention, sync)
+	if err != nil {
+		stlog.Fatalln(err)
 	}
+	// 注销之后再停止写入, 等待最后的记录落盘, sink 写完之后才退出
+	opts = append(opts, service.OnShutdown(closeLog))
 
 	ctx, err := service.Start(
 		context.Background(),
 		host,
-		port,
+		*port,
 		r,
 		log.RegisterHandlers,
+		opts...,
 	)
 
 	if err != nil {
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"distributed/metrics"
+	"distributed/registry"
+	"distributed/service"
+	"flag"
+	"fmt"
+	stlog "log"
+	"strings"
+	"time"
+)
+
+func main() {
+	gossip := flag.Bool("gossip", false, "discover services through a gossip cluster instead of the registry")
+	seeds := flag.String("seeds", "", "comma separated service URLs used to join the gossip cluster")
+	region := flag.String("region", "", "region this instance runs in")
+	zone := flag.String("zone", "", "zone this instance runs in, providers in the same zone are preferred")
+	version := flag.String("version", "1.0.0", "semantic version of this instance")
+	interactive := flag.Bool("interactive", false, "also stop the service when Enter is pressed")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "how long in-flight requests may take to finish when stopping")
+	dataDir := flag.String("data", "./metrics-data", "directory the time series are stored in")
+	interval := flag.Duration("interval", 5*time.Second, "how often every instance is scraped")
+	capacity := flag.Uint64("capacity", metrics.DefaultCapacity, "number of points kept per series")
+	flag.Parse()
+
+	var (
+		host        = "localhost"
+		port        = "7000"
+		serviceAddr = fmt.Sprintf("http://%s:%s", host, port)
+	)
+
+	r := registry.Registration{
+		ServiceName:      registry.MetricsService,
+		ServiceURL:       serviceAddr,
+		RequiredServices: make([]registry.ServiceName, 0),
+		ServiceUpdateURL: serviceAddr + "/services",
+		HeartbeatURL:     serviceAddr + "/heartbeat",
+		Version:          *version,
+		Region:           *region,
+		Zone:             *zone,
+	}
+
+	var opts []service.Option
+	if *gossip {
+		opts = append(opts, service.WithGossipSeeds(strings.Split(*seeds, ",")...))
+	}
+	opts = append(opts, service.WithDrainTimeout(*drainTimeout))
+	if *interactive {
+		opts = append(opts, service.Interactive())
+	}
+	// 注销之后再停止后台任务
+	stop := make(chan struct{})
+	opts = append(opts, service.OnShutdown(func(ctx context.Context) error {
+		close(stop)
+		return nil
+	}))
+
+	if err := metrics.Run(*dataDir, *interval, *capacity, stop); err != nil {
+		stlog.Fatalln(err)
+	}
+
+	ctx, err := service.Start(
+		context.Background(),
+		host,
+		port,
+		r,
+		metrics.RegisterHandlers,
+		opts...,
+	)
+	if err != nil {
+		stlog.Fatalln(err)
+	}
+
+	// 等待停止
+	<-ctx.Done()
+
+	fmt.Println("Shutting down metrics service")
+}
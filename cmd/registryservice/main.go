@@ -3,21 +3,47 @@ package main
 import (
 	"context"
 	"distributed/registry"
+	"distributed/trace"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 )
 
 func main() {
+	limits := registry.DefaultLimits
+	flag.Float64Var(&limits.SourceRate, "source-rate", limits.SourceRate, "registrations per second allowed from one source IP, 0 disables")
+	flag.IntVar(&limits.SourceBurst, "source-burst", limits.SourceBurst, "registration burst allowed from one source IP")
+	flag.Float64Var(&limits.InstanceRate, "instance-rate", limits.InstanceRate, "registrations per second allowed for one instance (service URL), 0 disables")
+	flag.IntVar(&limits.InstanceBurst, "instance-burst", limits.InstanceBurst, "registration burst allowed for one instance")
+	flag.Float64Var(&limits.ServiceRate, "service-rate", limits.ServiceRate, "registrations per second allowed for one service name, 0 disables")
+	flag.IntVar(&limits.ServiceBurst, "service-burst", limits.ServiceBurst, "registration burst allowed for one service name")
+	flag.IntVar(&limits.MaxInstancesPerService, "max-instances", limits.MaxInstancesPerService, "maximum instances per service name, 0 disables")
+	interactive := flag.Bool("interactive", false, "also stop the registry when Enter is pressed")
+	flag.Parse()
+	registry.SetLimits(limits)
+
 	registry.SetupRegistryService()
 	http.Handle("/services", &registry.RegistryService{})
+	http.Handle("/services/traffic", &registry.TrafficService{})
+	http.Handle("/services/status", &registry.StatusService{})
+	http.Handle("/services/drain", &registry.DrainService{})
+	http.Handle("/services/webhooks", &registry.WebhookService{})
+	http.Handle("/services/webhooks/deliveries", &registry.WebhookService{})
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// 追踪服务注册后, 注册中心会把自己的 span 上报过去
+	trace.SetServiceName("RegistryService")
+
 	var srv http.Server
 	srv.Addr = ":" + registry.ServerPort
+	srv.Handler = trace.Middleware(http.DefaultServeMux)
 
 	var wg sync.WaitGroup
 
@@ -33,10 +59,28 @@ func main() {
 	go func() {
 		defer wg.Done()
 
-		fmt.Println("Registry service started, Press any key to stop.")
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+
+		var enter chan struct{}
+		if *interactive {
+			fmt.Println("Registry service started, Press any key to stop.")
+			enter = make(chan struct{})
+			go func() {
+				var s string
+				fmt.Scanln(&s)
+				close(enter)
+			}()
+		} else {
+			fmt.Println("Registry service started, Press Ctrl+C to stop.")
+		}
 
-		var s string
-		fmt.Scanln(&s)
+		select {
+		case <-sigs:
+		case <-enter:
+		case <-ctx.Done():
+		}
 
 		srv.Shutdown(ctx)
 		cancel()
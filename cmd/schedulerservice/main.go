@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"distributed/registry"
+	"distributed/scheduler"
+	"distributed/service"
+	"flag"
+	"fmt"
+	stlog "log"
+	"strings"
+	"time"
+)
+
+func main() {
+	gossip := flag.Bool("gossip", false, "discover services through a gossip cluster instead of the registry")
+	seeds := flag.String("seeds", "", "comma separated service URLs used to join the gossip cluster")
+	region := flag.String("region", "", "region this instance runs in")
+	zone := flag.String("zone", "", "zone this instance runs in, providers in the same zone are preferred")
+	version := flag.String("version", "1.0.0", "semantic version of this instance")
+	interactive := flag.Bool("interactive", false, "also stop the service when Enter is pressed")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "how long in-flight requests may take to finish when stopping")
+	dataDir := flag.String("data", "./scheduler-data", "directory jobs and run history are stored in")
+	flag.Parse()
+
+	var (
+		host        = "localhost"
+		port        = "9000"
+		serviceAddr = fmt.Sprintf("http://%s:%s", host, port)
+	)
+
+	r := registry.Registration{
+		ServiceName:      registry.SchedulerService,
+		ServiceURL:       serviceAddr,
+		ServiceUpdateURL: serviceAddr + "/services",
+		HeartbeatURL:     serviceAddr + "/heartbeat",
+		Version:          *version,
+		Region:           *region,
+		Zone:             *zone,
+	}
+
+	var opts []service.Option
+	if *gossip {
+		opts = append(opts, service.WithGossipSeeds(strings.Split(*seeds, ",")...))
+	}
+	opts = append(opts, service.WithDrainTimeout(*drainTimeout))
+	if *interactive {
+		opts = append(opts, service.Interactive())
+	}
+	// 注销之后再停止后台任务
+	stop := make(chan struct{})
+	opts = append(opts, service.OnShutdown(func(ctx context.Context) error {
+		close(stop)
+		return nil
+	}))
+
+	// 同一个数据目录只能由一个调度服务使用, 第二个实例会启动失败, 任务不会被执行两次
+	if err := scheduler.Run(*dataDir, stop); err != nil {
+		stlog.Fatalln(err)
+	}
+	// 已有任务调用的服务声明为可选依赖, 新任务调用的服务在第一次执行时加入
+	r.RequiredServices = scheduler.Targets()
+	r.OptionalServices = r.RequiredServices
+
+	ctx, err := service.Start(
+		context.Background(),
+		host,
+		port,
+		r,
+		scheduler.RegisterHandlers,
+		opts...,
+	)
+	if err != nil {
+		stlog.Fatalln(err)
+	}
+
+	// 等待停止
+	<-ctx.Done()
+
+	fmt.Println("Shutting down scheduler service")
+}
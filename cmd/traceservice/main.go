@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"distributed/registry"
+	"distributed/service"
+	"distributed/trace"
+	"flag"
+	"fmt"
+	stlog "log"
+	"strings"
+	"time"
+)
+
+func main() {
+	gossip := flag.Bool("gossip", false, "discover services through a gossip cluster instead of the registry")
+	seeds := flag.String("seeds", "", "comma separated service URLs used to join the gossip cluster")
+	region := flag.String("region", "", "region this instance runs in")
+	zone := flag.String("zone", "", "zone this instance runs in, providers in the same zone are preferred")
+	version := flag.String("version", "1.0.0", "semantic version of this instance")
+	interactive := flag.Bool("interactive", false, "also stop the service when Enter is pressed")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "how long in-flight requests may take to finish when stopping")
+	flag.Parse()
+
+	var (
+		host        = "localhost"
+		port        = "5000"
+		serviceAddr = fmt.Sprintf("http://%s:%s", host, port)
+	)
+
+	r := registry.Registration{
+		ServiceName:      registry.TraceService,
+		ServiceURL:       serviceAddr,
+		RequiredServices: make([]registry.ServiceName, 0),
+		ServiceUpdateURL: serviceAddr + "/services",
+		HeartbeatURL:     serviceAddr + "/heartbeat",
+		Version:          *version,
+		Region:           *region,
+		Zone:             *zone,
+	}
+
+	var opts []service.Option
+	if *gossip {
+		opts = append(opts, service.WithGossipSeeds(strings.Split(*seeds, ",")...))
+	}
+	opts = append(opts, service.WithDrainTimeout(*drainTimeout))
+	if *interactive {
+		opts = append(opts, service.Interactive())
+	}
+
+	ctx, err := service.Start(
+		context.Background(),
+		host,
+		port,
+		r,
+		trace.RegisterHandlers,
+		opts...,
+	)
+	if err != nil {
+		stlog.Fatalln(err)
+	}
+
+	// 追踪服务自己的 span 直接写到本地
+	trace.SetReporter(serviceAddr)
+
+	// 等待停止
+	<-ctx.Done()
+
+	fmt.Println("Shutting down trace service")
+}
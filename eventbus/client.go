@@ -0,0 +1,107 @@
+package eventbus
+
+import (
+	"bytes"
+	"context"
+	"distributed/registry"
+	"distributed/trace"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 发布, 订阅和确认都应该很快返回, 事件总线卡住时调用方不能一直等下去
+// 拉取会在事件总线上等待新的事件, 由调用方通过 ctx 控制
+const requestTimeout = time.Second * 5
+
+var client = &http.Client{Timeout: requestTimeout}
+
+// 通过注册中心找到事件总线, 需要在 RequiredServices 中加上 registry.EventBusService
+func busURL() (string, error) {
+	return registry.GetProvider(registry.EventBusService)
+}
+
+func send(ctx context.Context, c *http.Client, method, path string, body interface{}) (*http.Response, error) {
+	serviceURL, err := busURL()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if body != nil {
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, serviceURL+path, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := trace.Do(ctx, c, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("event bus responded with code %v: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+	return res, nil
+}
+
+// 把 data 序列化成 JSON 发布到 topic
+func Publish(ctx context.Context, topic string, data interface{}) (Event, error) {
+	var e Event
+	res, err := send(ctx, client, http.MethodPost, "/events/topics/"+url.PathEscape(topic), data)
+	if err != nil {
+		return e, err
+	}
+	defer res.Body.Close()
+
+	err = json.NewDecoder(res.Body).Decode(&e)
+	return e, err
+}
+
+// 创建订阅, 同名的订阅已经存在时直接返回, 服务重启后可以重复调用
+func Subscribe(ctx context.Context, s Subscription, fromBeginning bool) (Subscription, error) {
+	res, err := send(ctx, client, http.MethodPost, "/events/subscriptions", subscribeRequest{
+		Subscription:  s,
+		FromBeginning: fromBeginning,
+	})
+	if err != nil {
+		return s, err
+	}
+	defer res.Body.Close()
+
+	err = json.NewDecoder(res.Body).Decode(&s)
+	return s, err
+}
+
+// 拉取最多 max 条事件, 没有事件时最多等待 wait
+// 处理完之后需要调用 Ack, 否则超时后会再次收到
+func Pull(ctx context.Context, subscription string, max int, wait time.Duration) ([]Event, error) {
+	query := url.Values{}
+	query.Set("max", strconv.Itoa(max))
+	query.Set("wait", wait.String())
+	res, err := send(ctx, http.DefaultClient, http.MethodGet, "/events/subscriptions/"+url.PathEscape(subscription)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var events []Event
+	err = json.NewDecoder(res.Body).Decode(&events)
+	return events, err
+}
+
+func Ack(ctx context.Context, subscription string, offsets ...uint64) error {
+	res, err := send(ctx, client, http.MethodPost, "/events/subscriptions/"+url.PathEscape(subscription)+"/ack", offsets)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
@@ -0,0 +1,661 @@
+// 事件总线服务, 服务之间通过主题发布和订阅事件
+// 订阅是持久的, 消费者确认之前事件会一直重新投递 (至少一次)
+// 消费者可以主动拉取, 也可以提供一个地址由事件总线推送
+
+package eventbus
+
+import (
+	"bytes"
+	"context"
+	"distributed/trace"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 投递之后多久没有确认就重新投递
+	ackTimeout = time.Second * 30
+	// 推送失败后的重试间隔, 每次翻倍
+	pushRetryDelay    = time.Second
+	pushMaxRetryDelay = time.Minute
+	pushTimeout       = time.Second * 5
+	// 一次拉取最多返回的事件数量, 以及最长等待时间
+	maxPullBatch = 100
+	maxPullWait  = time.Second * 30
+	// 多久清理一次过期的事件
+	pruneInterval = time.Minute
+)
+
+// 事件保留的时间和每个主题最多保留的数量
+type Retention struct {
+	MaxAge    time.Duration
+	MaxEvents int
+}
+
+var DefaultRetention = Retention{
+	MaxAge:    time.Hour * 24 * 7,
+	MaxEvents: 100000,
+}
+
+// 持久订阅
+type Subscription struct {
+	Name  string
+	Topic string
+	// 不为空时事件总线把事件 POST 到这个地址, 返回 2xx 即为确认
+	// 为空时由消费者通过 GET /events/subscriptions/{name} 拉取
+	PushURL string `json:",omitempty"`
+	// Offset 小于 Committed 的事件都已经确认
+	Committed uint64
+}
+
+type subscription struct {
+	Subscription
+	// 下一条还没有投递过的事件
+	next uint64
+	// 已投递还没有确认的事件, 值是重新投递的时间
+	pending map[uint64]time.Time
+	// 大于 Committed 的已确认的事件
+	acked map[uint64]bool
+	// 关闭时停止推送
+	done chan struct{}
+}
+
+type bus struct {
+	dir       string
+	retention Retention
+
+	lock          sync.Mutex
+	topics        map[string]*topic
+	subscriptions map[string]*subscription
+	// 每次发布后关闭并重新创建, 用来唤醒等待的拉取和推送
+	changed chan struct{}
+
+	client *http.Client
+}
+
+var b *bus
+
+// 重启后需要恢复的状态, 保存在 <dir>/state.json
+type state struct {
+	// 主题的下一个 Offset, 事件全部过期之后也不能从 0 重新开始
+	Topics        map[string]uint64
+	Subscriptions []Subscription
+}
+
+// 从 dir 中恢复主题和订阅, 开始推送和清理过期事件, 直到 stop 被关闭
+func Run(dir string, retention Retention, stop <-chan struct{}) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	b = &bus{
+		dir:           dir,
+		retention:     retention,
+		topics:        make(map[string]*topic),
+		subscriptions: make(map[string]*subscription),
+		changed:       make(chan struct{}),
+		client:        &http.Client{Timeout: pushTimeout},
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".log")
+		t, err := openTopic(dir, name)
+		if err != nil {
+			return err
+		}
+		b.topics[name] = t
+	}
+
+	var st state
+	data, err := ioutil.ReadFile(filepath.Join(dir, "state.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, &st); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for name, next := range st.Topics {
+		t, err := b.topic(name)
+		if err != nil {
+			return err
+		}
+		if t.next < next {
+			t.next = next
+		}
+	}
+	for _, s := range st.Subscriptions {
+		b.addSubscription(s)
+	}
+
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.prune()
+			case <-stop:
+				b.close()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// 返回主题, 不存在时创建, 调用方需要持有锁
+func (b *bus) topic(name string) (*topic, error) {
+	if t, ok := b.topics[name]; ok {
+		return t, nil
+	}
+	if err := validateTopic(name); err != nil {
+		return nil, err
+	}
+	t, err := openTopic(b.dir, name)
+	if err != nil {
+		return nil, err
+	}
+	b.topics[name] = t
+	return t, nil
+}
+
+func (b *bus) publish(name string, data json.RawMessage) (Event, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	t, err := b.topic(name)
+	if err != nil {
+		return Event{}, err
+	}
+	e, err := t.append(data)
+	if err != nil {
+		return e, err
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+	return e, nil
+}
+
+// 调用方需要持有锁, 已经存在的订阅不会被修改
+func (b *bus) addSubscription(s Subscription) *subscription {
+	if sub, ok := b.subscriptions[s.Name]; ok {
+		return sub
+	}
+	t, err := b.topic(s.Topic)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	// 保存的位置不能超出主题的范围
+	if s.Committed > t.next {
+		s.Committed = t.next
+	}
+	if s.Committed < t.first() {
+		s.Committed = t.first()
+	}
+	sub := &subscription{
+		Subscription: s,
+		next:         s.Committed,
+		pending:      make(map[uint64]time.Time),
+		acked:        make(map[uint64]bool),
+		done:         make(chan struct{}),
+	}
+	b.subscriptions[s.Name] = sub
+	if s.PushURL != "" {
+		go b.push(sub)
+	}
+	return sub
+}
+
+// FromBeginning 为 true 时从主题中最早的事件开始, 否则只接收之后发布的事件
+func (b *bus) subscribe(s Subscription, fromBeginning bool) (Subscription, error) {
+	if s.Name == "" {
+		return s, fmt.Errorf("subscription name is required")
+	}
+	if s.PushURL != "" && !strings.HasPrefix(s.PushURL, "http://") && !strings.HasPrefix(s.PushURL, "https://") {
+		return s, fmt.Errorf("invalid push URL %q", s.PushURL)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if existing, ok := b.subscriptions[s.Name]; ok {
+		if existing.Topic != s.Topic || existing.PushURL != s.PushURL {
+			return s, fmt.Errorf("subscription %s already exists with different settings", s.Name)
+		}
+		return existing.Subscription, nil
+	}
+	t, err := b.topic(s.Topic)
+	if err != nil {
+		return s, err
+	}
+	s.Committed = t.next
+	if fromBeginning {
+		s.Committed = t.first()
+	}
+	sub := b.addSubscription(s)
+	return sub.Subscription, b.save()
+}
+
+func (b *bus) unsubscribe(name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sub, ok := b.subscriptions[name]
+	if !ok {
+		return fmt.Errorf("subscription %s not found", name)
+	}
+	close(sub.done)
+	delete(b.subscriptions, name)
+	return b.save()
+}
+
+func (b *bus) listSubscriptions() []Subscription {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	subs := make([]Subscription, 0, len(b.subscriptions))
+	for _, sub := range b.subscriptions {
+		subs = append(subs, sub.Subscription)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Name < subs[j].Name
+	})
+	return subs
+}
+
+// 主题的概况
+type TopicInfo struct {
+	Name string
+	// 保留的事件的范围 [First, Next)
+	First uint64
+	Next  uint64
+}
+
+func (b *bus) listTopics() []TopicInfo {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	topics := make([]TopicInfo, 0, len(b.topics))
+	for _, t := range b.topics {
+		topics = append(topics, TopicInfo{Name: t.name, First: t.first(), Next: t.next})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+// 取出最多 max 条需要投递的事件: 先是确认超时的, 然后是没有投递过的
+// 取出的事件在 ackTimeout 之后没有确认会被再次取出
+// 没有事件时最多等待 wait, 订阅不存在时返回 false
+func (b *bus) pull(ctx context.Context, name string, max int, wait time.Duration) ([]Event, bool) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		b.lock.Lock()
+		sub, ok := b.subscriptions[name]
+		if !ok {
+			b.lock.Unlock()
+			return nil, false
+		}
+		events := b.take(sub, max)
+		changed := b.changed
+		b.lock.Unlock()
+
+		if len(events) > 0 {
+			return events, true
+		}
+		select {
+		case <-changed:
+		case <-sub.done:
+			return nil, false
+		case <-deadline.C:
+			return events, true
+		case <-ctx.Done():
+			return events, true
+		}
+	}
+}
+
+// 调用方需要持有锁
+func (b *bus) take(sub *subscription, max int) []Event {
+	t := b.topics[sub.Topic]
+	now := time.Now()
+	events := make([]Event, 0)
+
+	var expired []uint64
+	for offset, redeliverAt := range sub.pending {
+		if !now.Before(redeliverAt) {
+			expired = append(expired, offset)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i] < expired[j]
+	})
+	for _, offset := range expired {
+		if len(events) >= max {
+			return events
+		}
+		e, ok := t.get(offset)
+		if !ok {
+			// 已经过期被删除了, 没有办法再投递
+			delete(sub.pending, offset)
+			continue
+		}
+		sub.pending[offset] = now.Add(ackTimeout)
+		events = append(events, e)
+	}
+
+	if sub.next < t.first() {
+		sub.next = t.first()
+	}
+	for len(events) < max && sub.next < t.next {
+		e, _ := t.get(sub.next)
+		sub.pending[sub.next] = now.Add(ackTimeout)
+		events = append(events, e)
+		sub.next++
+	}
+	return events
+}
+
+// 确认事件, 连续确认的部分会推进 Committed 并保存
+func (b *bus) ack(name string, offsets []uint64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sub, ok := b.subscriptions[name]
+	if !ok {
+		return fmt.Errorf("subscription %s not found", name)
+	}
+	for _, offset := range offsets {
+		if _, ok := sub.pending[offset]; !ok {
+			continue
+		}
+		delete(sub.pending, offset)
+		sub.acked[offset] = true
+	}
+
+	committed := sub.Committed
+	for committed < sub.next {
+		if _, ok := sub.pending[committed]; ok {
+			break
+		}
+		// 没有投递过的或者已经被删除的事件不需要确认
+		if !sub.acked[committed] && committed >= b.topics[sub.Topic].first() {
+			break
+		}
+		delete(sub.acked, committed)
+		committed++
+	}
+	if committed == sub.Committed {
+		return nil
+	}
+	sub.Committed = committed
+	return b.save()
+}
+
+// 推送订阅: 逐条 POST 到 PushURL, 返回 2xx 时确认, 失败后退避重试
+func (b *bus) push(sub *subscription) {
+	delay := pushRetryDelay
+	for {
+		b.lock.Lock()
+		// 取消订阅或者关闭之后不再投递积压的事件
+		if b.subscriptions[sub.Name] != sub {
+			b.lock.Unlock()
+			return
+		}
+		events := b.take(sub, 1)
+		changed := b.changed
+		b.lock.Unlock()
+
+		if len(events) == 0 {
+			// 等待新的事件, 或者等待未确认的事件超时
+			select {
+			case <-changed:
+			case <-time.After(ackTimeout):
+			case <-sub.done:
+				return
+			}
+			continue
+		}
+
+		e := events[0]
+		select {
+		case <-sub.done:
+			return
+		default:
+		}
+		if err := b.deliver(sub.PushURL, e); err != nil {
+			log.Printf("Failed to push event %s/%d to %s: %v\n", e.Topic, e.Offset, sub.PushURL, err)
+			// 让这条事件可以立即被重新取出
+			b.lock.Lock()
+			if _, ok := sub.pending[e.Offset]; ok {
+				sub.pending[e.Offset] = time.Now()
+			}
+			b.lock.Unlock()
+
+			select {
+			case <-time.After(delay):
+			case <-sub.done:
+				return
+			}
+			if delay *= 2; delay > pushMaxRetryDelay {
+				delay = pushMaxRetryDelay
+			}
+			continue
+		}
+		delay = pushRetryDelay
+		select {
+		case <-sub.done:
+			return
+		default:
+		}
+		if err := b.ack(sub.Name, []uint64{e.Offset}); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (b *bus) deliver(url string, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := trace.Do(context.Background(), b.client, req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("responded with code %v", res.StatusCode)
+	}
+	return nil
+}
+
+func (b *bus) prune() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	before := time.Now().Add(-b.retention.MaxAge)
+	if b.retention.MaxAge <= 0 {
+		before = time.Time{}
+	}
+	for _, t := range b.topics {
+		if err := t.prune(before, b.retention.MaxEvents); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := b.save(); err != nil {
+		log.Println(err)
+	}
+}
+
+// 保存主题的 Offset 和订阅的位置, 调用方需要持有锁
+func (b *bus) save() error {
+	st := state{Topics: make(map[string]uint64, len(b.topics))}
+	for name, t := range b.topics {
+		st.Topics[name] = t.next
+	}
+	for _, sub := range b.subscriptions {
+		st.Subscriptions = append(st.Subscriptions, sub.Subscription)
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.dir, "state.json")
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (b *bus) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, sub := range b.subscriptions {
+		close(sub.done)
+	}
+	b.subscriptions = make(map[string]*subscription)
+	for _, t := range b.topics {
+		t.close()
+	}
+}
+
+type subscribeRequest struct {
+	Subscription
+	FromBeginning bool
+}
+
+// GET /events/topics 列出主题
+// POST /events/topics/{topic} 发布事件, 请求体是事件的 JSON 数据
+// GET /events/subscriptions 列出订阅
+// POST /events/subscriptions 创建订阅 {"Name": "...", "Topic": "...", "PushURL": "...", "FromBeginning": false}
+// DELETE /events/subscriptions/{name} 删除订阅
+// GET /events/subscriptions/{name}?max=10&wait=10s 拉取事件
+// POST /events/subscriptions/{name}/ack 确认事件, 请求体是 Offset 的数组
+func RegisterHandlers() {
+	http.HandleFunc("/events/topics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, b.listTopics())
+	})
+	http.HandleFunc("/events/topics/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !json.Valid(data) {
+			http.Error(w, "event data must be JSON", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/events/topics/")
+		if err := validateTopic(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e, err := b.publish(name, data)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, e)
+	})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(pathSegments) == 2 && r.Method == http.MethodGet:
+			writeJSON(w, b.listSubscriptions())
+		case len(pathSegments) == 2 && r.Method == http.MethodPost:
+			var req subscribeRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			s, err := b.subscribe(req.Subscription, req.FromBeginning)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, s)
+		case len(pathSegments) == 3 && r.Method == http.MethodDelete:
+			if err := b.unsubscribe(pathSegments[2]); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		case len(pathSegments) == 3 && r.Method == http.MethodGet:
+			max, err := strconv.Atoi(r.URL.Query().Get("max"))
+			if err != nil || max <= 0 || max > maxPullBatch {
+				max = maxPullBatch
+			}
+			wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+			if err != nil || wait < 0 {
+				wait = 0
+			}
+			if wait > maxPullWait {
+				wait = maxPullWait
+			}
+			events, ok := b.pull(r.Context(), pathSegments[2], max, wait)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeJSON(w, events)
+		case len(pathSegments) == 4 && pathSegments[3] == "ack" && r.Method == http.MethodPost:
+			var offsets []uint64
+			if err := json.NewDecoder(r.Body).Decode(&offsets); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := b.ack(pathSegments[2], offsets); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+	http.HandleFunc("/events/subscriptions", handler)
+	http.HandleFunc("/events/subscriptions/", handler)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
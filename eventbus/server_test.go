@@ -0,0 +1,210 @@
+package eventbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 不启动推送和清理协程的事件总线
+func newTestBus(t *testing.T, dir string) *bus {
+	t.Helper()
+	return &bus{
+		dir:           dir,
+		topics:        make(map[string]*topic),
+		subscriptions: make(map[string]*subscription),
+		changed:       make(chan struct{}),
+		client:        http.DefaultClient,
+	}
+}
+
+func publishN(t *testing.T, b *bus, topic string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := b.publish(topic, json.RawMessage(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func offsets(events []Event) []uint64 {
+	result := make([]uint64, 0, len(events))
+	for _, e := range events {
+		result = append(result, e.Offset)
+	}
+	return result
+}
+
+func TestBusTakeAndAck(t *testing.T) {
+	tests := []struct {
+		name string
+		// 依次执行的操作: 取出最多 n 条, 确认, 或者让未确认的事件超时
+		steps []func(t *testing.T, b *bus, sub *subscription) string
+		// 每一步之后的结果
+		want []string
+		// 最后的 Committed
+		committed uint64
+	}{
+		{
+			name: "in order",
+			steps: []func(*testing.T, *bus, *subscription) string{
+				take(2), ack(0, 1), take(10), ack(2, 3, 4),
+			},
+			want:      []string{"[0 1]", "committed 2", "[2 3 4]", "committed 5"},
+			committed: 5,
+		},
+		{
+			name: "out of order ack",
+			steps: []func(*testing.T, *bus, *subscription) string{
+				take(3), ack(1, 2), ack(0),
+			},
+			want:      []string{"[0 1 2]", "committed 0", "committed 3"},
+			committed: 3,
+		},
+		{
+			name: "unknown and duplicate acks are ignored",
+			steps: []func(*testing.T, *bus, *subscription) string{
+				take(1), ack(3, 4), ack(0, 0), ack(0),
+			},
+			want:      []string{"[0]", "committed 0", "committed 1", "committed 1"},
+			committed: 1,
+		},
+		{
+			name: "redeliver expired first",
+			steps: []func(*testing.T, *bus, *subscription) string{
+				take(2), expire, take(3), ack(0, 1, 2),
+			},
+			want:      []string{"[0 1]", "expired", "[0 1 2]", "committed 3"},
+			committed: 3,
+		},
+		{
+			name: "nothing left",
+			steps: []func(*testing.T, *bus, *subscription) string{
+				take(10), take(10), ack(0, 1, 2, 3, 4),
+			},
+			want:      []string{"[0 1 2 3 4]", "[]", "committed 5"},
+			committed: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBus(t, t.TempDir())
+			publishN(t, b, "test", 5)
+			if _, err := b.subscribe(Subscription{Name: "sub", Topic: "test"}, true); err != nil {
+				t.Fatal(err)
+			}
+			sub := b.subscriptions["sub"]
+			for i, step := range tt.steps {
+				if got := step(t, b, sub); got != tt.want[i] {
+					t.Fatalf("step %d = %s, want %s", i, got, tt.want[i])
+				}
+			}
+			if sub.Committed != tt.committed {
+				t.Errorf("Committed = %d, want %d", sub.Committed, tt.committed)
+			}
+		})
+	}
+}
+
+func take(max int) func(*testing.T, *bus, *subscription) string {
+	return func(t *testing.T, b *bus, sub *subscription) string {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		return fmt.Sprint(offsets(b.take(sub, max)))
+	}
+}
+
+func ack(offsets ...uint64) func(*testing.T, *bus, *subscription) string {
+	return func(t *testing.T, b *bus, sub *subscription) string {
+		if err := b.ack(sub.Name, offsets); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("committed %d", sub.Committed)
+	}
+}
+
+func expire(t *testing.T, b *bus, sub *subscription) string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for offset := range sub.pending {
+		sub.pending[offset] = time.Now().Add(-time.Second)
+	}
+	return "expired"
+}
+
+// 清理之后已经删除的事件不再投递, 也不需要确认
+func TestBusPrune(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxEvents int
+		// 清理前取出的数量
+		taken int
+		// 清理后取出的事件
+		want      string
+		committed uint64
+	}{
+		{"nothing pruned", 10, 0, "[0 1 2 3 4]", 5},
+		{"undelivered pruned", 2, 0, "[3 4]", 5},
+		{"pending pruned", 2, 2, "[3 4]", 5},
+		{"pending partly pruned", 4, 2, "[1 2 3 4]", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			b := newTestBus(t, dir)
+			b.retention = Retention{MaxEvents: tt.maxEvents}
+			publishN(t, b, "test", 5)
+			if _, err := b.subscribe(Subscription{Name: "sub", Topic: "test"}, true); err != nil {
+				t.Fatal(err)
+			}
+			sub := b.subscriptions["sub"]
+			take(tt.taken)(t, b, sub)
+
+			b.prune()
+			if got := b.topics["test"].first(); got != uint64(5-min(5, tt.maxEvents)) {
+				t.Fatalf("first = %d after pruning to %d events", got, tt.maxEvents)
+			}
+			// 清理前取出的事件在超时后才会被发现已经删除
+			expire(t, b, sub)
+			events := take(10)(t, b, sub)
+			if events != tt.want {
+				t.Fatalf("events after prune = %s, want %s", events, tt.want)
+			}
+
+			for i := uint64(0); i < 5; i++ {
+				if err := b.ack("sub", []uint64{i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if sub.Committed != tt.committed {
+				t.Errorf("Committed = %d, want %d", sub.Committed, tt.committed)
+			}
+
+			// 重启后从文件和 state.json 恢复同样的位置
+			b.close()
+			restarted := newTestBus(t, dir)
+			name := "test"
+			tp, err := openTopic(dir, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restarted.topics[name] = tp
+			restarted.lock.Lock()
+			restarted.addSubscription(Subscription{Name: "sub", Topic: name, Committed: sub.Committed})
+			restarted.lock.Unlock()
+			if got := take(10)(t, restarted, restarted.subscriptions["sub"]); got != "[]" {
+				t.Errorf("events after restart = %s, want []", got)
+			}
+			restarted.close()
+		})
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,164 @@
+package eventbus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// 主题中的一条事件, Offset 在主题内从 0 开始递增
+type Event struct {
+	Topic  string
+	Offset uint64
+	Time   time.Time
+	Data   json.RawMessage
+}
+
+var topicName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func validateTopic(name string) error {
+	if !topicName.MatchString(name) {
+		return fmt.Errorf("invalid topic name %q", name)
+	}
+	return nil
+}
+
+// 一个主题的事件, 保存在内存中, 同时追加写到 <dir>/<topic>.log, 每行一个 JSON
+type topic struct {
+	name   string
+	path   string
+	events []Event
+	// 下一条事件的 Offset
+	next uint64
+	file *os.File
+}
+
+func openTopic(dir, name string) (*topic, error) {
+	t := &topic{
+		name: name,
+		path: filepath.Join(dir, name+".log"),
+	}
+
+	if f, err := os.Open(t.path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var e Event
+			// 崩溃时最后一行可能不完整, 跳过
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			t.events = append(t.events, e)
+			t.next = e.Offset + 1
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t.file = f
+	return t, nil
+}
+
+func (t *topic) append(data json.RawMessage) (Event, error) {
+	e := Event{
+		Topic:  t.name,
+		Offset: t.next,
+		Time:   time.Now(),
+		Data:   data,
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		return e, err
+	}
+	// 确认写到磁盘之后才算发布成功
+	if err := t.file.Sync(); err != nil {
+		return e, err
+	}
+	t.events = append(t.events, e)
+	t.next++
+	return e, nil
+}
+
+// 最早还保留着的事件的 Offset
+func (t *topic) first() uint64 {
+	if len(t.events) == 0 {
+		return t.next
+	}
+	return t.events[0].Offset
+}
+
+func (t *topic) get(offset uint64) (Event, bool) {
+	first := t.first()
+	if offset < first || offset >= t.next {
+		return Event{}, false
+	}
+	return t.events[offset-first], true
+}
+
+// 删除早于 before 的事件, 以及超过 maxEvents 的最旧的事件, 删除后重写文件
+func (t *topic) prune(before time.Time, maxEvents int) error {
+	n := 0
+	for n < len(t.events) && t.events[n].Time.Before(before) {
+		n++
+	}
+	if maxEvents > 0 && len(t.events)-n > maxEvents {
+		n = len(t.events) - maxEvents
+	}
+	if n == 0 {
+		return nil
+	}
+	events := t.events[n:]
+
+	// 先写到临时文件再替换, 重写过程中崩溃不会丢失数据
+	tmp := t.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+
+	t.file.Close()
+	if t.file, err = os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	t.events = append([]Event(nil), events...)
+	return nil
+}
+
+func (t *topic) close() error {
+	return t.file.Close()
+}
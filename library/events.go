@@ -0,0 +1,70 @@
+package library
+
+import (
+	"context"
+	"distributed/eventbus"
+	"distributed/log"
+	"distributed/trace"
+	"sync"
+)
+
+// 借书和还书时发布到事件总线的主题
+const (
+	TopicBorrowed = "library.borrowed"
+	TopicReturned = "library.returned"
+)
+
+// 等待发布的事件数量上限, 事件总线长时间不可用时丢弃新的事件
+const publishQueue = 100
+
+// 借书和还书事件的数据
+type BookEvent struct {
+	TakeoutID int
+	Name      string
+	BookID    uint64
+	Title     string
+}
+
+type pendingEvent struct {
+	ctx   context.Context
+	topic string
+	event BookEvent
+}
+
+var (
+	events    = make(chan pendingEvent, publishQueue)
+	publisher sync.Once
+)
+
+// 事件总线是可选依赖, 发布失败只记录日志, 不影响借书和还书
+// 事件在后台由一个协程按顺序发布, 事件总线很慢或者卡住时借书和还书的请求不用等待
+func publish(ctx context.Context, topic string, takeout *Takeout, book *Book) {
+	publisher.Do(func() {
+		go runPublisher()
+	})
+
+	e := pendingEvent{
+		// 请求结束后事件可能还没有发布, 只保留追踪信息
+		ctx:   trace.Detach(ctx),
+		topic: topic,
+		event: BookEvent{
+			TakeoutID: takeout.id,
+			Name:      takeout.name,
+			BookID:    book.ID,
+			Title:     book.Title,
+		},
+	}
+	select {
+	case events <- e:
+	default:
+		log.Ctx(ctx).Warn("event queue is full, dropping event", "topic", topic, "takeout", takeout.id)
+	}
+}
+
+func runPublisher() {
+	for e := range events {
+		if _, err := eventbus.Publish(e.ctx, e.topic, e.event); err != nil {
+			log.Ctx(e.ctx).Warn("failed to publish event", "topic", e.topic, "takeout", e.event.TakeoutID, "error", err)
+		}
+	}
+}
@@ -64,11 +64,11 @@ func (l *Library) Resign(name string) *Takeout {
 	return takeout
 }
 
-func (l *Library) Borrow(title string, takeout *Takeout) error {
+func (l *Library) Borrow(title string, takeout *Takeout) (*Book, error) {
 	takeout.lock.Lock()
 	defer takeout.lock.Unlock()
 	if len(takeout.books) > 3 {
-		return fmt.Errorf("borrow too many books")
+		return nil, fmt.Errorf("borrow too many books")
 	}
 
 	l.lock.Lock()
@@ -76,10 +76,10 @@ func (l *Library) Borrow(title string, takeout *Takeout) error {
 	for i := range l.books {
 		if title == l.books[i].Title {
 			takeout.books = append(takeout.books, l.books[i])
-			return nil
+			return l.books[i], nil
 		}
 	}
-	return fmt.Errorf("book %v not exist", title)
+	return nil, fmt.Errorf("book %v not exist", title)
 }
 
 func (l *Library) Return(book *Book, takeout *Takeout) error {
@@ -95,6 +95,18 @@ func (l *Library) Return(book *Book, takeout *Takeout) error {
 	return fmt.Errorf("not borrow this book")
 }
 
+func (l *Library) GetTakeoutByID(id int) *Takeout {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	for i := range l.takeouts {
+		if l.takeouts[i].id == id {
+			return l.takeouts[i]
+		}
+	}
+	return nil
+}
+
 func (l *Library) GetBookByID(id uint64) *Book {
 	l.lock.Lock()
 	defer l.lock.Unlock()
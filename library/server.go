@@ -2,9 +2,9 @@ package library
 
 import (
 	"bytes"
+	"distributed/log"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -25,8 +25,15 @@ type libraryHandler struct{}
 // /library/book/{id} 获取书籍信息
 // /library/takeout 获取全部借书证信息
 // /library/takeout/{id} 获取借书证信息
+// POST /library/takeout 办理借书证 {"Name": "..."}
+// POST /library/takeout/{id}/borrow 借书 {"Title": "..."}
+// POST /library/takeout/{id}/return 还书 {"BookID": 1}
 func (lh libraryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	pathSegments := strings.Split(r.URL.Path, "/")
+	if r.Method == http.MethodPost {
+		lh.handleTakeout(w, r, pathSegments)
+		return
+	}
 	// 暂时不支持 takeout 查询
 	switch len(pathSegments) {
 	case 2:
@@ -49,7 +56,7 @@ func (lh *libraryHandler) getLibraryStatus(w http.ResponseWriter, r *http.Reques
 	data, err := lh.toJSON(library)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
+		log.Ctx(r.Context()).Error("failed to serialize library", "error", err)
 		return
 	}
 
@@ -70,7 +77,7 @@ func (lh *libraryHandler) getBooksStatus(w http.ResponseWriter, r *http.Request)
 	data, err := lh.toJSON(library.books)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
+		log.Ctx(r.Context()).Error("failed to serialize books", "error", err)
 		return
 	}
 
@@ -84,10 +91,99 @@ func (lh *libraryHandler) getBook(w http.ResponseWriter, r *http.Request, id int
 		data, err := lh.toJSON(book)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			log.Println(err)
+			log.Ctx(r.Context()).Error("failed to serialize book", "book", id, "error", err)
 			return
 		}
 		w.Header().Add("Content-Type", "application/json")
 		w.Write(data)
 	}
 }
+
+type takeoutRequest struct {
+	Name   string
+	Title  string
+	BookID uint64
+}
+
+type takeoutResponse struct {
+	ID    int
+	Name  string
+	Books []*Book
+}
+
+func (lh *libraryHandler) handleTakeout(w http.ResponseWriter, r *http.Request, pathSegments []string) {
+	if len(pathSegments) < 3 || pathSegments[2] != "takeout" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req takeoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Ctx(r.Context()).Warn("invalid takeout request", "error", err)
+		return
+	}
+
+	var takeout *Takeout
+	switch len(pathSegments) {
+	case 3:
+		if req.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		takeout = library.Resign(req.Name)
+	case 5:
+		id, err := strconv.Atoi(pathSegments[3])
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if takeout = library.GetTakeoutByID(id); takeout == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch pathSegments[4] {
+		case "borrow":
+			book, err := library.Borrow(req.Title, takeout)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Ctx(r.Context()).Debug("book borrowed", "takeout", takeout.id, "book", book.ID, "title", book.Title)
+			publish(r.Context(), TopicBorrowed, takeout, book)
+		case "return":
+			book := library.GetBookByID(req.BookID)
+			if book == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err := library.Return(book, takeout); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Ctx(r.Context()).Debug("book returned", "takeout", takeout.id, "book", book.ID, "title", book.Title)
+			publish(r.Context(), TopicReturned, takeout, book)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	takeout.lock.Lock()
+	data, err := lh.toJSON(takeoutResponse{
+		ID:    takeout.id,
+		Name:  takeout.name,
+		Books: takeout.books,
+	})
+	takeout.lock.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Ctx(r.Context()).Error("failed to serialize takeout", "takeout", takeout.id, "error", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,361 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// 内存中最多缓存的记录数, 满了之后新的记录写到 stderr
+	queueSize = 10000
+	// 每批最多发送的记录数
+	maxBatch = 500
+	// 没有攒满一批时发送的间隔
+	flushInterval = time.Second
+	// 发送失败后重新发送 spool 文件的间隔
+	replayInterval = time.Second * 5
+	// spool 文件的大小上限, 超过后新的记录写到 stderr
+	maxSpoolSize = 64 << 20
+	shipTimeout  = time.Second * 5
+)
+
+// 在后台批量发送日志, 每批都重新查找日志服务, 一个实例失败时换下一个
+// 所有实例都无法访问, 或者注册中心中暂时没有日志服务时写到本地的 spool 文件, 恢复后按顺序补发
+// 日志服务拒绝的记录不会重试, 写到 stderr
+type shipper struct {
+	queue chan Record
+	flush chan chan struct{}
+
+	// 只在 run 中访问
+	spoolPath  string
+	spoolSize  int64
+	lastFailed time.Time
+
+	client *http.Client
+}
+
+var (
+	ship     *shipper
+	shipOnce sync.Once
+	// 为空时使用临时目录中以服务名称和实例命名的文件
+	spoolPath string
+)
+
+// 设置 spool 文件的位置, 需要在 SetClientLogger 之前调用
+func SetSpoolFile(path string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	spoolPath = path
+}
+
+func defaultSpoolPath(service, instance string) string {
+	name := "distributed-" + service
+	if instance != "" {
+		name += "-" + instance
+	}
+	return filepath.Join(os.TempDir(), name+".spool")
+}
+
+// 第一次设置日志服务时启动发送和获取日志级别, 上次退出前没有发出去的记录会先补发
+func startShipper() {
+	shipOnce.Do(func() {
+		cl.lock.RLock()
+		path := spoolPath
+		if path == "" {
+			path = defaultSpoolPath(cl.service, cl.instance)
+		}
+		cl.lock.RUnlock()
+
+		s := &shipper{
+			queue:     make(chan Record, queueSize),
+			flush:     make(chan chan struct{}),
+			spoolPath: path,
+			client:    &http.Client{Timeout: shipTimeout},
+		}
+		if info, err := os.Stat(path); err == nil {
+			s.spoolSize = info.Size()
+		}
+		cl.lock.Lock()
+		ship = s
+		cl.lock.Unlock()
+		go s.run()
+		go pollLevel()
+	})
+}
+
+// 不阻塞调用方, 缓存满了时写到 stderr
+func (s *shipper) enqueue(r Record) {
+	select {
+	case s.queue <- r:
+	default:
+		fmt.Fprintln(os.Stderr, r.text())
+	}
+}
+
+func (s *shipper) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []Record
+	for {
+		select {
+		case r := <-s.queue:
+			batch = append(batch, r)
+			if len(batch) >= maxBatch {
+				s.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.send(batch)
+				batch = nil
+			} else if s.spoolSize > 0 {
+				if urls := logServices(); len(urls) > 0 {
+					s.replay(urls)
+				}
+			}
+		case done := <-s.flush:
+			for len(s.queue) > 0 {
+				batch = append(batch, <-s.queue)
+			}
+			for len(batch) > 0 {
+				n := len(batch)
+				if n > maxBatch {
+					n = maxBatch
+				}
+				s.send(batch[:n])
+				batch = batch[n:]
+			}
+			batch = nil
+			close(done)
+		}
+	}
+}
+
+// spool 文件中还有记录时先补发, 补发不完就追加到 spool 文件后面, 保证顺序
+// 通过注册中心查找日志服务但暂时没有实例时写到 spool 文件, 同时写到 stderr, 实例上线后补发
+// 没有设置日志服务时直接写到 stderr, 不会进入 spool 文件
+func (s *shipper) send(batch []Record) {
+	urls := logServices()
+	if len(urls) == 0 {
+		cl.lock.RLock()
+		fromRegistry := cl.fromRegistry
+		cl.lock.RUnlock()
+		// 写不进 spool 文件时已经写到了 stderr
+		if fromRegistry && !s.spool(batch) {
+			return
+		}
+		writeStderr(batch)
+		return
+	}
+	if s.spoolSize > 0 {
+		s.replay(urls)
+	}
+	if s.spoolSize == 0 {
+		err := s.post(urls, batch)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errRejected) {
+			fmt.Fprintln(os.Stderr, err)
+			writeStderr(batch)
+			return
+		}
+		s.lastFailed = time.Now()
+	}
+	s.spool(batch)
+}
+
+func writeStderr(batch []Record) {
+	for _, r := range batch {
+		fmt.Fprintln(os.Stderr, r.text())
+	}
+}
+
+// 日志服务返回 408 和 429 以外的 4xx, 这批记录重试也不会被接收, 不再发送
+var errRejected = errors.New("log records rejected")
+
+// 依次尝试每个日志服务, 直到有一个接收了这批记录
+// 被拒绝时不再尝试其他实例, 它们会以同样的原因拒绝
+func (s *shipper) post(urls []string, batch []Record) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(batch); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	var err error
+	for _, url := range urls {
+		if err = s.postTo(url, data); err == nil || errors.Is(err, errRejected) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *shipper) postTo(url string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url+"/log", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return nil
+	case res.StatusCode >= 400 && res.StatusCode < 500 &&
+		res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w by %s. Service responded %d", errRejected, url, res.StatusCode)
+	default:
+		return fmt.Errorf("failed to send log records to %s. Service responded %d", url, res.StatusCode)
+	}
+}
+
+// 追加到 spool 文件, 每行一条记录, 超过大小上限或者写入失败时写到 stderr 并返回 false
+func (s *shipper) spool(batch []Record) bool {
+	var buf []byte
+	for _, r := range batch {
+		data, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	if s.spoolSize+int64(len(buf)) > maxSpoolSize {
+		writeStderr(batch)
+		return false
+	}
+
+	f, err := os.OpenFile(s.spoolPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = f.Write(buf)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		writeStderr(batch)
+		return false
+	}
+	s.spoolSize += int64(len(buf))
+	return true
+}
+
+// 按顺序补发 spool 文件中的记录, 失败时把没发出去的记录写回 spool 文件
+// 被拒绝的一批写到 stderr, 继续补发后面的记录
+func (s *shipper) replay(urls []string) {
+	if time.Since(s.lastFailed) < replayInterval {
+		return
+	}
+	data, err := ioutil.ReadFile(s.spoolPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.spoolSize = 0
+		}
+		return
+	}
+
+	var batch []Record
+	var sent int
+	offset := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxSpoolSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		offset += len(line) + 1
+		var r Record
+		if json.Unmarshal(line, &r) != nil {
+			continue
+		}
+		batch = append(batch, r)
+		if len(batch) < maxBatch {
+			continue
+		}
+		if !s.replayBatch(urls, batch) {
+			s.rewrite(data[sent:])
+			return
+		}
+		batch, sent = nil, offset
+	}
+	if len(batch) > 0 && !s.replayBatch(urls, batch) {
+		s.rewrite(data[sent:])
+		return
+	}
+	os.Remove(s.spoolPath)
+	s.spoolSize = 0
+}
+
+// 发送 spool 文件中的一批记录, 返回 false 时需要稍后重试
+func (s *shipper) replayBatch(urls []string, batch []Record) bool {
+	err := s.post(urls, batch)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, errRejected) {
+		fmt.Fprintln(os.Stderr, err)
+		writeStderr(batch)
+		return true
+	}
+	s.lastFailed = time.Now()
+	return false
+}
+
+// 先写临时文件再替换
+func (s *shipper) rewrite(rest []byte) {
+	if err := ioutil.WriteFile(s.spoolPath+".tmp", rest, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if err := os.Rename(s.spoolPath+".tmp", s.spoolPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	s.spoolSize = int64(len(rest))
+}
+
+// 把内存中的记录发送出去或者写到 spool 文件, 在服务停止前调用
+func Flush(ctx context.Context) error {
+	cl.lock.RLock()
+	s := ship
+	cl.lock.RUnlock()
+	if s == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	select {
+	case s.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,248 @@
+package log
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 记录收到的日志, status 决定每一批的响应
+type testLogService struct {
+	lock     sync.Mutex
+	status   func(batch []Record) int
+	received []string
+}
+
+func (ls *testLogService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var batch []Record
+	if err := json.NewDecoder(gz).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	status := ls.status(batch)
+	if status == http.StatusOK {
+		for _, r := range batch {
+			ls.received = append(ls.received, r.Message)
+		}
+	}
+	w.WriteHeader(status)
+}
+
+func (ls *testLogService) messages() []string {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return append([]string(nil), ls.received...)
+}
+
+func respond(status int) func([]Record) int {
+	return func([]Record) int { return status }
+}
+
+// 使用固定地址的日志服务, url 为空时通过注册中心查找, 这时没有任何实例
+func useLogService(t *testing.T, url string) {
+	cl.lock.Lock()
+	oldURL, oldFromRegistry := cl.url, cl.fromRegistry
+	cl.url, cl.fromRegistry = url, url == ""
+	cl.lock.Unlock()
+	t.Cleanup(func() {
+		cl.lock.Lock()
+		cl.url, cl.fromRegistry = oldURL, oldFromRegistry
+		cl.lock.Unlock()
+	})
+}
+
+// 把 stderr 换成临时文件, 返回读取其中内容的函数
+func captureStderr(t *testing.T) func() string {
+	f, err := ioutil.TempFile(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = f
+	t.Cleanup(func() {
+		os.Stderr = stderr
+		f.Close()
+	})
+	return func() string {
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+}
+
+func newTestShipper(t *testing.T) *shipper {
+	return &shipper{
+		spoolPath: filepath.Join(t.TempDir(), "test.spool"),
+		client:    &http.Client{Timeout: shipTimeout},
+	}
+}
+
+// spool 文件中记录的消息, 从旧到新
+func (s *shipper) spooled(t *testing.T) []string {
+	f, err := os.Open(s.spoolPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var messages []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, r.Message)
+	}
+	return messages
+}
+
+func testBatch(messages ...string) []Record {
+	batch := make([]Record, len(messages))
+	for i, m := range messages {
+		batch[i] = Record{Level: LevelInfo, Service: "Test", Message: m}
+	}
+	return batch
+}
+
+func TestShipperSend(t *testing.T) {
+	tests := []struct {
+		name string
+		// 为 0 时注册中心中没有日志服务
+		status   int
+		received []string
+		spooled  []string
+		stderr   bool
+	}{
+		{"accepted", http.StatusOK, []string{"alpha", "beta"}, nil, false},
+		{"unavailable", http.StatusServiceUnavailable, nil, []string{"alpha", "beta"}, false},
+		{"request timeout", http.StatusRequestTimeout, nil, []string{"alpha", "beta"}, false},
+		{"too many requests", http.StatusTooManyRequests, nil, []string{"alpha", "beta"}, false},
+		{"bad request", http.StatusBadRequest, nil, nil, true},
+		{"too large", http.StatusRequestEntityTooLarge, nil, nil, true},
+		{"no log service", 0, nil, []string{"alpha", "beta"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := &testLogService{status: respond(tt.status)}
+			srv := httptest.NewServer(ls)
+			defer srv.Close()
+			if tt.status == 0 {
+				useLogService(t, "")
+			} else {
+				useLogService(t, srv.URL)
+			}
+			stderr := captureStderr(t)
+
+			s := newTestShipper(t)
+			s.send(testBatch("alpha", "beta"))
+
+			if got := ls.messages(); fmt.Sprint(got) != fmt.Sprint(tt.received) {
+				t.Errorf("received %v, want %v", got, tt.received)
+			}
+			if got := s.spooled(t); fmt.Sprint(got) != fmt.Sprint(tt.spooled) {
+				t.Errorf("spooled %v, want %v", got, tt.spooled)
+			}
+			if got := strings.Contains(stderr(), "alpha"); got != tt.stderr {
+				t.Errorf("written to stderr = %v, want %v", got, tt.stderr)
+			}
+		})
+	}
+}
+
+// 注册中心中没有日志服务时写到 spool 文件, 有了之后先补发再发送新的记录
+func TestShipperNoLogService(t *testing.T) {
+	ls := &testLogService{status: respond(http.StatusOK)}
+	srv := httptest.NewServer(ls)
+	defer srv.Close()
+	captureStderr(t)
+
+	s := newTestShipper(t)
+	useLogService(t, "")
+	s.send(testBatch("a", "b"))
+	s.send(testBatch("c"))
+	if got := ls.messages(); len(got) != 0 {
+		t.Fatalf("received %v without a log service", got)
+	}
+
+	useLogService(t, srv.URL)
+	s.send(testBatch("d"))
+	if got := ls.messages(); fmt.Sprint(got) != "[a b c d]" {
+		t.Errorf("received %v, want [a b c d]", got)
+	}
+	if s.spoolSize != 0 || s.spooled(t) != nil {
+		t.Errorf("spool not empty after replay: %d bytes", s.spoolSize)
+	}
+}
+
+// spool 文件中有三批记录, 第二批的响应是 status
+func TestShipperReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		received []int
+		spooled  []int
+	}{
+		{"all accepted", http.StatusOK, []int{0, 1, 2}, nil},
+		{"rejected batch is skipped", http.StatusBadRequest, []int{0, 2}, nil},
+		{"unavailable", http.StatusServiceUnavailable, []int{0}, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := &testLogService{status: func(batch []Record) int {
+				if batch[0].Message == "1-0" {
+					return tt.status
+				}
+				return http.StatusOK
+			}}
+			srv := httptest.NewServer(ls)
+			defer srv.Close()
+			useLogService(t, srv.URL)
+			captureStderr(t)
+
+			s := newTestShipper(t)
+			batches := make([][]string, 3)
+			for i := range batches {
+				for j := 0; j < maxBatch; j++ {
+					batches[i] = append(batches[i], fmt.Sprintf("%d-%d", i, j))
+				}
+				s.spool(testBatch(batches[i]...))
+			}
+			s.replay([]string{srv.URL})
+
+			var received, spooled []string
+			for _, i := range tt.received {
+				received = append(received, batches[i]...)
+			}
+			for _, i := range tt.spooled {
+				spooled = append(spooled, batches[i]...)
+			}
+			if got := ls.messages(); fmt.Sprint(got) != fmt.Sprint(received) {
+				t.Errorf("received %d records, want batches %v", len(got), tt.received)
+			}
+			if got := s.spooled(t); fmt.Sprint(got) != fmt.Sprint(spooled) {
+				t.Errorf("spooled %d records, want batches %v", len(got), tt.spooled)
+			}
+		})
+	}
+}
@@ -1,40 +1,311 @@
 package log
 
 import (
-	"bytes"
+	"context"
 	"distributed/registry"
+	"distributed/trace"
+	"encoding/json"
 	"fmt"
 	stlog "log"
 	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
+// 从日志服务获取日志级别的间隔
+const levelPollInterval = time.Second * 5
+
+// 日志发往哪里, 没有可用的日志服务时写到本地的 stderr
+type client struct {
+	lock sync.RWMutex
+	// 固定的日志服务地址, fromRegistry 为 true 时不使用
+	url string
+	// 每次发送时通过注册中心查找日志服务
+	fromRegistry bool
+	service      string
+	instance     string
+	// 本地设置的级别
+	level Level
+	// 日志服务设置的级别, 不为 nil 时优先于本地的级别
+	remote *Level
+}
+
+var cl = &client{level: LevelInfo}
+
+// 把日志发送到固定地址的日志服务
 func SetClientLogger(serviceURL string, clientService registry.ServiceName) {
-	// 先写日志
-	stlog.SetPrefix(fmt.Sprintf("[%v] - ", clientService))
-	// 服务端设置了时间戳, 客户端这边不用带了
+	cl.lock.Lock()
+	cl.url = serviceURL
+	cl.fromRegistry = false
+	cl.service = string(clientService)
+	cl.lock.Unlock()
+	startClient()
+}
+
+// 每批日志都通过注册中心查找 LogService, 一个实例失败时换另一个
+// 都不可用或者还没有实例时写到本地的 spool 文件, 之后按顺序补发
+// 日志服务的实例上线下线不需要再调用, 需要在 RequiredServices 中加上 registry.LogService
+func SetRegistryLogger(clientService registry.ServiceName) {
+	cl.lock.Lock()
+	cl.url = ""
+	cl.fromRegistry = true
+	cl.service = string(clientService)
+	cl.lock.Unlock()
+	startClient()
+}
+
+func startClient() {
+	startShipper()
+
+	// 标准库 logger 的输出也转换成 info 级别的记录发送到服务端
+	// 服务名称和时间戳都在记录里, 不需要前缀
+	stlog.SetPrefix("")
 	stlog.SetFlags(0)
-	// 把日志发送到服务端
-	stlog.SetOutput(&clientLogger{
-		url: serviceURL,
-	})
+	stlog.SetOutput(&clientLogger{})
 }
 
-// 需要实现 io.Write 接口
-type clientLogger struct {
-	url string
+// 不再发送到日志服务, 之后的记录写到本地的 stderr
+// spool 文件中没有发出去的记录在再次设置日志服务后按顺序补发
+func UnsetClientLogger(clientService registry.ServiceName) {
+	cl.lock.Lock()
+	cl.url = ""
+	cl.fromRegistry = false
+	cl.service = string(clientService)
+	cl.remote = nil
+	cl.lock.Unlock()
+}
+
+// 返回当前可用的日志服务, 第一个是首选的, 其余的用于失败时切换
+func logServices() []string {
+	cl.lock.RLock()
+	url, fromRegistry := cl.url, cl.fromRegistry
+	cl.lock.RUnlock()
+
+	if fromRegistry {
+		urls, err := registry.GetProviders(registry.LogService)
+		if err != nil {
+			return nil
+		}
+		return urls
+	}
+	if url == "" {
+		return nil
+	}
+	return []string{url}
+}
+
+// 设置实例 ID, 日志服务可以单独调整这个实例的日志级别
+// 一般为 registry.InstanceID(serviceURL)
+func SetInstance(id string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.instance = id
+}
+
+// 低于 level 的日志不会被记录, 默认为 info
+// 日志服务中设置了这个服务或实例的级别时, 以日志服务的为准
+func SetLevel(level Level) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.level = level
+}
+
+func enabled(level Level) bool {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	if cl.remote != nil {
+		return level >= *cl.remote
+	}
+	return level >= cl.level
 }
 
-func (cl clientLogger) Write(data []byte) (int, error) {
-	b := bytes.NewBuffer([]byte(data))
-	// 通过 post 请求将日志发送给服务端
-	res, err := http.Post(cl.url+"/log", "text/plain", b)
+// 定期从日志服务获取对这个实例生效的级别, 低于级别的日志在本地就被丢弃
+// 获取失败时换下一个实例, 都失败时保留上一次的级别, 没有日志服务时使用本地的级别
+func pollLevel() {
+	ticker := time.NewTicker(levelPollInterval)
+	defer ticker.Stop()
+
+	for {
+		cl.lock.RLock()
+		service, instance := cl.service, cl.instance
+		cl.lock.RUnlock()
+
+		urls := logServices()
+		if len(urls) == 0 {
+			cl.lock.Lock()
+			cl.remote = nil
+			cl.lock.Unlock()
+		}
+		for _, url := range urls {
+			level, err := fetchLevel(url, service, instance)
+			if err == nil {
+				cl.lock.Lock()
+				cl.remote = level
+				cl.lock.Unlock()
+				break
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+// 日志服务卡住时不会一直等待, 超时后换下一个实例
+var levelClient = &http.Client{Timeout: shipTimeout}
+
+// 没有设置时返回 nil
+func fetchLevel(url, service, instance string) (*Level, error) {
+	query := neturl.Values{}
+	query.Set("service", service)
+	query.Set("instance", instance)
+	res, err := levelClient.Get(url + "/log/levels?" + query.Encode())
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		var setting LevelSetting
+		if err := json.NewDecoder(res.Body).Decode(&setting); err != nil {
+			return nil, err
+		}
+		return &setting.Level, nil
+	default:
+		return nil, fmt.Errorf("failed to get log level. Service responded %d", res.StatusCode)
 	}
+}
+
+// 结构化的 logger, 附带的字段会加到每条记录里
+//
+//	log.Info("book borrowed", "title", title, "takeout", id)
+//	log.Ctx(r.Context()).With("takeout", id).Error("borrow failed", "error", err)
+type Logger struct {
+	ctx    context.Context
+	fields map[string]interface{}
+}
+
+var std = &Logger{}
+
+// 返回带有追踪上下文的 logger, 记录中会带上 trace id
+func Ctx(ctx context.Context) *Logger {
+	return std.Ctx(ctx)
+}
+
+// 返回附带了 key-value 字段的 logger
+func With(kv ...interface{}) *Logger {
+	return std.With(kv...)
+}
+
+func (l *Logger) Ctx(ctx context.Context) *Logger {
+	return &Logger{ctx: ctx, fields: l.fields}
+}
+
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.fields)+len(kv)/2)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	return &Logger{ctx: l.ctx, fields: makeFields(fields, kv)}
+}
+
+func Debug(msg string, kv ...interface{}) { std.log(LevelDebug, msg, kv) }
+func Info(msg string, kv ...interface{})  { std.log(LevelInfo, msg, kv) }
+func Warn(msg string, kv ...interface{})  { std.log(LevelWarn, msg, kv) }
+func Error(msg string, kv ...interface{}) { std.log(LevelError, msg, kv) }
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// 被 Debug 等函数调用, 调用方在 runtime.Caller 中的深度是 3
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !enabled(level) {
+		return
+	}
+	r := Record{
+		Time:    time.Now(),
+		Level:   level,
+		Message: msg,
+		Caller:  caller(3),
+	}
+	if len(l.fields) > 0 || len(kv) > 0 {
+		r.Fields = make(map[string]interface{}, len(l.fields)+len(kv)/2)
+		for k, v := range l.fields {
+			r.Fields[k] = v
+		}
+		r.Fields = makeFields(r.Fields, kv)
+	}
+	send(l.ctx, r)
+}
+
+// 返回 包名/文件名:行号
+func caller(skip int) string {
+	_, file, line, ok := runtime.Caller(skip)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s:%d", filepath.Base(filepath.Dir(file)), filepath.Base(file), line)
+}
+
+// 带上 ctx 中的追踪上下文, 交给后台批量发送到日志服务, 从来没有设置过日志服务时写到本地
+func send(ctx context.Context, r Record) {
+	cl.lock.RLock()
+	s, service, instance := ship, cl.service, cl.instance
+	cl.lock.RUnlock()
+	r.Service, r.Instance = service, instance
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		r.TraceID, r.SpanID = span.TraceID, span.SpanID
+	}
+
+	if s == nil {
+		fmt.Fprintln(os.Stderr, r.text())
+		return
+	}
+	s.enqueue(r)
+}
+
+// 返回带有追踪上下文的标准库 logger, 记录中会带上 trace id
+// 在 HTTP 处理函数中使用 log.WithContext(r.Context()).Println(...)
+// 新的代码应该使用 log.Ctx(ctx) 记录结构化的日志
+func WithContext(ctx context.Context) *stlog.Logger {
+	out := stlog.Writer()
+	if _, ok := out.(*clientLogger); ok {
+		out = &clientLogger{ctx: ctx}
+	}
+	return stlog.New(out, stlog.Prefix(), stlog.Flags())
+}
 
-	if res.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("failed to send log message. Service responded %d", res.StatusCode)
+// 需要实现 io.Write 接口, 把标准库 logger 的每一行转换成一条 info 记录
+type clientLogger struct {
+	// 为 nil 时记录不带追踪上下文
+	ctx context.Context
+}
+
+func (c clientLogger) Write(data []byte) (int, error) {
+	if !enabled(LevelInfo) {
+		return len(data), nil
+	}
+	r := Record{
+		Time:    time.Now(),
+		Level:   LevelInfo,
+		Message: strings.TrimRight(string(data), "\n"),
 	}
+	send(c.ctx, r)
 
 	// 如果没有问题返回发送的数据长度
 	return len(data), nil
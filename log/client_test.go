@@ -0,0 +1,61 @@
+package log
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+		err     bool
+	}{
+		{"not set", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}, "<nil>", false},
+		{"set", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"Service":"Test","Level":"debug"}`)
+		}, "debug", false},
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}, "", true},
+		// 卡住的日志服务在超时后返回错误
+		{"hung", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}, "", true},
+	}
+	old := levelClient
+	levelClient = &http.Client{Timeout: 100 * time.Millisecond}
+	defer func() { levelClient = old }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			start := time.Now()
+			level, err := fetchLevel(srv.URL, "Test", "")
+			if time.Since(start) > time.Second {
+				t.Errorf("fetchLevel took %v", time.Since(start))
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("fetchLevel error = %v, want error = %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			got := "<nil>"
+			if level != nil {
+				got = level.String()
+			}
+			if got != tt.want {
+				t.Errorf("level = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
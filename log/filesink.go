@@ -0,0 +1,192 @@
+package log
+
+import (
+	"bufio"
+	"encoding/json"
+	stlog "log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 写到另一个会轮转的文件, 格式和主日志文件相同, 但不建立索引, 不能查询
+// 按时间轮转在下一次写入时检查
+type FileSink struct {
+	path      string
+	rotation  Rotation
+	retention Retention
+
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	created time.Time
+	// 上一个轮转文件, 没有压缩时的名字
+	last string
+
+	// 轮转后在后台压缩和清理, Close 时等待完成
+	background sync.WaitGroup
+	// 多次轮转的清理依次进行, 不会同时删除同一个文件
+	expireLock sync.Mutex
+}
+
+func NewFileSink(path string, rot Rotation, ret Retention) (*FileSink, error) {
+	s := &FileSink{path: path, rotation: rot, retention: ret}
+	if paths, err := listArchives(path); err == nil && len(paths) > 0 {
+		s.last = strings.TrimSuffix(paths[len(paths)-1], ".gz")
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// 和主日志文件一样, 已有的文件用最后写入的时间作为按时间轮转的起点
+	s.f, s.size, s.created = f, info.Size(), info.ModTime()
+	if s.w == nil {
+		s.w = bufio.NewWriterSize(f, writeBufferSize)
+	} else {
+		s.w.Reset(f)
+	}
+	return nil
+}
+
+func (s *FileSink) Write(records []Record) error {
+	var buf []byte
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+
+	now := time.Now()
+	if s.size > 0 &&
+		((s.rotation.MaxSize > 0 && s.size+int64(len(buf)) > s.rotation.MaxSize) ||
+			(s.rotation.Interval > 0 && now.Sub(s.created) >= s.rotation.Interval)) {
+		if err := s.rotate(now); err != nil {
+			return err
+		}
+	}
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.w.Write(buf); err != nil {
+		s.w.Reset(s.f)
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		s.w.Reset(s.f)
+		return err
+	}
+	s.size += int64(len(buf))
+	return nil
+}
+
+func (s *FileSink) rotate(now time.Time) error {
+	if err := s.closeFile(); err != nil {
+		stlog.Println(err)
+	}
+	archive := uniqueArchiveName(s.path, now, s.last)
+	if err := os.Rename(s.path, archive); err != nil {
+		return err
+	}
+	s.last = archive
+	if err := s.open(); err != nil {
+		return err
+	}
+	size := s.size
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		if s.rotation.Compress {
+			if _, _, err := compressFile(archive, now); err != nil {
+				if !os.IsNotExist(err) {
+					stlog.Println(err)
+				}
+			} else {
+				os.Remove(archive)
+			}
+		}
+		s.expire(now, size)
+	}()
+	return nil
+}
+
+// 按保留策略删除最旧的轮转文件, activeSize 是正在写入的文件的大小
+func (s *FileSink) expire(now time.Time, activeSize int64) {
+	s.expireLock.Lock()
+	defer s.expireLock.Unlock()
+
+	paths, err := listArchives(s.path)
+	if err != nil {
+		stlog.Println(err)
+		return
+	}
+	type archived struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []archived
+	total := activeSize
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, archived{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	for len(files) > 0 {
+		f := files[0]
+		if !(s.retention.MaxFiles > 0 && len(files) > s.retention.MaxFiles) &&
+			!(s.retention.MaxAge > 0 && now.Sub(f.modTime) > s.retention.MaxAge) &&
+			!(s.retention.MaxTotalSize > 0 && total > s.retention.MaxTotalSize) {
+			return
+		}
+		if err := os.Remove(f.path); err != nil {
+			stlog.Println(err)
+		}
+		total -= f.size
+		files = files[1:]
+	}
+}
+
+// 关闭文件, 并等待后台的压缩和清理完成
+func (s *FileSink) Close() error {
+	err := s.closeFile()
+	s.background.Wait()
+	return err
+}
+
+// 写入缓冲的数据并同步, 然后关闭文件
+func (s *FileSink) closeFile() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if syncErr := s.f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	s.f = nil
+	return err
+}
@@ -0,0 +1,507 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 一个日志文件, 最后一个是正在写入的文件, 其余是轮转出来的文件
+type segment struct {
+	path       string
+	compressed bool
+	// 文件在磁盘上的大小, 压缩后是压缩文件的大小
+	size int64
+	// 最后写入的时间, 用于按时间清理
+	modTime time.Time
+	// 正在写入的文件创建的时间, 用于按时间轮转
+	created time.Time
+	// 第一条记录的序号
+	first int
+}
+
+// 一条记录所在的文件和位置, 以及查询时用来过滤的字段
+// 压缩文件中的 offset 是解压后的位置
+type indexEntry struct {
+	seg     *segment
+	offset  int64
+	length  int
+	time    int64
+	level   Level
+	service string
+}
+
+// 写入时建立的索引, 序号只增不减, 清理旧文件后 entries[0] 的序号是 base
+type logIndex struct {
+	lock     sync.RWMutex
+	base     int
+	entries  []indexEntry
+	segments []*segment
+	// 每个服务的记录序号, 从小到大
+	byService map[string][]int
+	// 保存 base 的文件, 重启后序号和清理前一样, 查询游标和 Last-Event-ID 仍然有效
+	// 为空时不保存
+	basePath string
+}
+
+var index = newLogIndex()
+
+func newLogIndex() *logIndex {
+	return &logIndex{byService: make(map[string][]int)}
+}
+
+// 返回下一条记录的序号, 调用方需要持有锁
+func (idx *logIndex) next() int {
+	return idx.base + len(idx.entries)
+}
+
+func (idx *logIndex) active() *segment {
+	return idx.segments[len(idx.segments)-1]
+}
+
+// 扫描一个已有的文件并加入索引, 无法解析的行不进入索引
+func (idx *logIndex) load(path string, compressed bool) (*segment, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	seg := &segment{
+		path:       path,
+		compressed: compressed,
+		size:       info.Size(),
+		modTime:    info.ModTime(),
+		// 不知道文件真正创建的时间, 用最后写入的时间, 重启不会让按时间轮转重新计时
+		created: info.ModTime(),
+		first:   idx.next(),
+	}
+	reader := bufio.NewReader(r)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var r Record
+			if json.Unmarshal(line, &r) == nil {
+				idx.add(seg, offset, len(line), r)
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	idx.segments = append(idx.segments, seg)
+	return seg, nil
+}
+
+// 调用方需要持有锁
+func (idx *logIndex) add(seg *segment, offset int64, length int, r Record) {
+	seq := idx.next()
+	idx.entries = append(idx.entries, indexEntry{
+		seg:     seg,
+		offset:  offset,
+		length:  length,
+		time:    r.Time.UnixNano(),
+		level:   r.Level,
+		service: r.Service,
+	})
+	idx.byService[r.Service] = append(idx.byService[r.Service], seq)
+}
+
+// 记录已经写到正在写入的文件末尾, lengths 是每条记录的行长度, 返回第一条记录的序号
+func (idx *logIndex) append(records []Record, lengths []int) int {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	first := idx.next()
+	seg := idx.active()
+	for i, r := range records {
+		idx.add(seg, seg.size, lengths[i], r)
+		seg.size += int64(lengths[i])
+	}
+	seg.modTime = time.Now()
+	return first
+}
+
+// 写入失败时无法知道写了多少, 以文件的实际大小为准
+func (idx *logIndex) resize() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	seg := idx.active()
+	if info, err := os.Stat(seg.path); err == nil {
+		seg.size = info.Size()
+	}
+}
+
+// 把正在写入的文件改名为 archive, 之后的记录写到新的 path 中
+// 持有写锁改名, 查询不会读到改名中的文件
+func (idx *logIndex) rotate(archive string) (*segment, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	seg := idx.active()
+	if err := os.Rename(seg.path, archive); err != nil {
+		return nil, err
+	}
+	path := seg.path
+	seg.path = archive
+	idx.segments = append(idx.segments, &segment{
+		path:    path,
+		modTime: time.Now(),
+		created: time.Now(),
+		first:   idx.next(),
+	})
+	return seg, nil
+}
+
+// 压缩完成后换成压缩文件, 返回 false 表示文件已经被清理
+func (idx *logIndex) compressed(seg *segment, path string, size int64) bool {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	for _, s := range idx.segments {
+		if s == seg {
+			seg.path, seg.compressed, seg.size = path, true, size
+			return true
+		}
+	}
+	return false
+}
+
+// 按保留策略删除最旧的轮转文件和它们的索引, 返回要删除的文件
+func (idx *logIndex) expire(retention Retention, now time.Time) []string {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	var total int64
+	for _, seg := range idx.segments {
+		total += seg.size
+	}
+	var removed []string
+	// 正在写入的文件不会被删除
+	for len(idx.segments) > 1 {
+		seg := idx.segments[0]
+		archived := len(idx.segments) - 1
+		if !(retention.MaxFiles > 0 && archived > retention.MaxFiles) &&
+			!(retention.MaxAge > 0 && now.Sub(seg.modTime) > retention.MaxAge) &&
+			!(retention.MaxTotalSize > 0 && total > retention.MaxTotalSize) {
+			break
+		}
+		total -= seg.size
+		removed = append(removed, seg.path)
+		idx.segments = idx.segments[1:]
+		idx.trim(idx.segments[0].first)
+	}
+	return removed
+}
+
+// 启动时在加载文件之前读取上次保存的 base, 文件不存在时从 0 开始
+func (idx *logIndex) loadBase(path string) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	idx.basePath = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	base, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || base < 0 {
+		return fmt.Errorf("invalid log base sequence in %s: %q", path, data)
+	}
+	idx.base = base
+	return nil
+}
+
+// 保存现在的 base, 在删除清理的文件之前调用
+// 先写临时文件再改名, 不会留下写了一半的文件
+func (idx *logIndex) saveBase() error {
+	idx.lock.RLock()
+	path, base := idx.basePath, idx.base
+	idx.lock.RUnlock()
+	if path == "" {
+		return nil
+	}
+	if err := ioutil.WriteFile(path+".tmp", []byte(strconv.Itoa(base)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// 删除序号小于 base 的记录, 调用方需要持有锁
+func (idx *logIndex) trim(base int) {
+	n := base - idx.base
+	// 复制一份, 释放被删除的记录占用的内存
+	idx.entries = append([]indexEntry(nil), idx.entries[n:]...)
+	idx.base = base
+	for service, seqs := range idx.byService {
+		i := sort.SearchInts(seqs, base)
+		if i == len(seqs) {
+			delete(idx.byService, service)
+		} else if i > 0 {
+			idx.byService[service] = append([]int(nil), seqs[i:]...)
+		}
+	}
+}
+
+type logQuery struct {
+	service string
+	level   Level
+	since   time.Time
+	until   time.Time
+	// 匹配消息和字段, 为 nil 时不过滤
+	match func(r Record) bool
+	// 只查询序号小于 before 的记录, 为 -1 时从最新的记录开始
+	before int
+	limit  int
+}
+
+// 只用索引中的字段过滤
+func (q logQuery) matchEntry(e indexEntry) bool {
+	return (q.service == "" || e.service == q.service) &&
+		e.level >= q.level &&
+		(q.since.IsZero() || e.time >= q.since.UnixNano()) &&
+		(q.until.IsZero() || e.time < q.until.UnixNano())
+}
+
+func (q logQuery) matches(r Record) bool {
+	return (q.service == "" || r.Service == q.service) &&
+		r.Level >= q.level &&
+		(q.since.IsZero() || !r.Time.Before(q.since)) &&
+		(q.until.IsZero() || r.Time.Before(q.until)) &&
+		(q.match == nil || q.match(r))
+}
+
+// 文件中的内容无法解析, 跳过这条记录
+var errBadRecord = errors.New("bad log record")
+
+// 读取之前文件已经按保留策略被清理, 跳过这条记录
+var errSegmentRemoved = errors.New("log segment removed")
+
+// 查询时每次在锁内取出的索引项数, 读取文件时不持有锁, 不会阻塞写入
+const scanPage = 500
+
+// 在锁内复制出来的索引项
+type candidate struct {
+	seq   int
+	entry indexEntry
+}
+
+// 一次查询中打开的文件, 每个文件在第一次读取时打开, 压缩文件整个解压到内存中
+// 已经被清理的文件是 nil
+type segmentReaders map[*segment]io.ReaderAt
+
+func (readers segmentReaders) read(idx *logIndex, e indexEntry) (Record, error) {
+	r, ok := readers[e.seg]
+	if !ok {
+		var err error
+		r, err = openSegment(idx, e.seg)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return Record{}, err
+			}
+			r = nil
+		}
+		readers[e.seg] = r
+	}
+	if r == nil {
+		return Record{}, errSegmentRemoved
+	}
+
+	line := make([]byte, e.length)
+	if _, err := r.ReadAt(line, e.offset); err != nil {
+		return Record{}, err
+	}
+	var record Record
+	if err := json.Unmarshal(line, &record); err != nil {
+		return Record{}, errBadRecord
+	}
+	return record, nil
+}
+
+// 持有读锁打开文件, 这时的路径一定是这个文件现在的位置, 打开之后改名, 压缩或者删除都不影响读取
+func openSegment(idx *logIndex, seg *segment) (io.ReaderAt, error) {
+	idx.lock.RLock()
+	compressed := seg.compressed
+	f, err := os.Open(seg.path)
+	idx.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return f, nil
+	}
+
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (readers segmentReaders) close() {
+	for _, r := range readers {
+		if f, ok := r.(*os.File); ok {
+			f.Close()
+		}
+	}
+}
+
+// 从新到旧返回序号小于 before 的最多 n 个只用索引字段匹配的项, before 为 -1 时从最新的记录开始
+func (idx *logIndex) newest(q logQuery, before, n int) []candidate {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	// 指定了服务时只遍历这个服务的记录, 否则遍历所有记录, 下标都是相对于 base 的
+	seqs := idx.byService[q.service]
+	end := len(idx.entries)
+	if q.service != "" {
+		end = len(seqs)
+	}
+	if before >= 0 {
+		if q.service != "" {
+			end = sort.SearchInts(seqs, before)
+		} else if before-idx.base < end {
+			end = before - idx.base
+		}
+	}
+
+	var found []candidate
+	for i := end - 1; i >= 0 && len(found) < n; i-- {
+		seq := idx.base + i
+		if q.service != "" {
+			seq = seqs[i]
+		}
+		e := idx.entries[seq-idx.base]
+		if q.matchEntry(e) {
+			found = append(found, candidate{seq, e})
+		}
+	}
+	return found
+}
+
+// 从旧到新返回序号不小于 from 的最多 n 个只用索引字段匹配的项, 同时返回下一次开始的序号
+func (idx *logIndex) oldest(q logQuery, from, n int) ([]candidate, int) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	if from < idx.base {
+		from = idx.base
+	}
+	var found []candidate
+	seq := from
+	for ; seq < idx.next() && len(found) < n; seq++ {
+		e := idx.entries[seq-idx.base]
+		if q.matchEntry(e) {
+			found = append(found, candidate{seq, e})
+		}
+	}
+	return found, seq
+}
+
+// 从新到旧返回符合条件的记录, 还有更多记录时返回下一页的游标
+func (idx *logIndex) query(q logQuery) ([]Record, int, error) {
+	readers := make(segmentReaders)
+	defer readers.close()
+
+	records := []Record{}
+	before := q.before
+	for {
+		page := idx.newest(q, before, scanPage)
+		for _, c := range page {
+			record, err := readers.read(idx, c.entry)
+			if err != nil {
+				if err == errBadRecord || err == errSegmentRemoved {
+					continue
+				}
+				return nil, -1, err
+			}
+			if q.match != nil && !q.match(record) {
+				continue
+			}
+			if len(records) == q.limit {
+				return records, c.seq + 1, nil
+			}
+			records = append(records, record)
+		}
+		if len(page) < scanPage {
+			return records, -1, nil
+		}
+		before = page[len(page)-1].seq
+	}
+}
+
+// 从旧到新返回序号不小于 from 的符合条件的记录, 最多 limit 条, 同时返回下一次开始的序号
+// 已经被清理的记录跳过
+func (idx *logIndex) after(q logQuery, from, limit int) ([]Record, []int, int, error) {
+	readers := make(segmentReaders)
+	defer readers.close()
+
+	var records []Record
+	var seqs []int
+	for {
+		page, next := idx.oldest(q, from, scanPage)
+		for _, c := range page {
+			record, err := readers.read(idx, c.entry)
+			if err != nil {
+				if err == errBadRecord || err == errSegmentRemoved {
+					continue
+				}
+				return nil, nil, c.seq, err
+			}
+			if q.match != nil && !q.match(record) {
+				continue
+			}
+			records = append(records, record)
+			seqs = append(seqs, c.seq)
+			if len(records) == limit {
+				return records, seqs, c.seq + 1, nil
+			}
+		}
+		from = next
+		if len(page) < scanPage {
+			return records, seqs, from, nil
+		}
+	}
+}
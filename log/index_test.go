@@ -0,0 +1,94 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 启动一个写到 dst 的日志服务, 每条记录都会轮转, 只保留 files 个轮转文件
+func runTestLog(t *testing.T, dst string, files int) func() {
+	index = newLogIndex()
+	stop, err := Run(dst, Rotation{MaxSize: 1}, Retention{MaxFiles: files}, Sync{Policy: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if err := stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 每条记录的序号, 从旧到新
+func sequences(t *testing.T) map[string]int {
+	records, seqs, _, err := index.after(logQuery{}, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]int)
+	for i, r := range records {
+		found[r.Message] = seqs[i]
+	}
+	return found
+}
+
+// 清理旧文件并重启之后, 记录的序号不变, 之前的游标和 Last-Event-ID 仍然指向同一条记录
+func TestIndexBaseAfterRestart(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    int
+		written  int
+		restarts int
+		// 重启后第一条记录的序号
+		base int
+	}{
+		{"nothing expired", 10, 5, 1, 0},
+		{"expired", 2, 6, 1, 3},
+		{"expired twice", 2, 6, 2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "distributed.log")
+			stop := runTestLog(t, dst, tt.files)
+			for i := 0; i < tt.written; i++ {
+				r := Record{Time: time.Now(), Level: LevelInfo, Service: "Test", Message: fmt.Sprint(i)}
+				if err := write([]Record{r}, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := sequences(t)
+			stop()
+
+			for i := 0; i < tt.restarts; i++ {
+				stop = runTestLog(t, dst, tt.files)
+				after := sequences(t)
+				stop()
+				if len(after) != len(before) {
+					t.Fatalf("restart %d: %d records, want %d", i, len(after), len(before))
+				}
+				for message, seq := range before {
+					if after[message] != seq {
+						t.Errorf("restart %d: record %s has sequence %d, want %d", i, message, after[message], seq)
+					}
+				}
+				if index.base != tt.base {
+					t.Errorf("restart %d: base = %d, want %d", i, index.base, tt.base)
+				}
+			}
+
+			// Last-Event-ID 是最后一条记录时, 重启后不会重复发送
+			stop = runTestLog(t, dst, tt.files)
+			defer stop()
+			records, _, _, err := index.after(logQuery{}, before[fmt.Sprint(tt.written-1)]+1, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 0 {
+				t.Errorf("%d records after the last event, want 0", len(records))
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	stlog "log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 日志服务统一管理的日志级别, 实例的设置优先于服务的设置, 服务的设置优先于默认值
+// 都没有设置时客户端使用本地的级别
+type LevelConfig struct {
+	Default   *Level           `json:",omitempty"`
+	Services  map[string]Level `json:",omitempty"`
+	Instances map[string]Level `json:",omitempty"`
+}
+
+// PUT /log/levels 的请求, Service 和 Instance 都为空时设置默认值
+type LevelSetting struct {
+	Service  string `json:",omitempty"`
+	Instance string `json:",omitempty"`
+	Level    Level
+}
+
+type levelStore struct {
+	lock sync.RWMutex
+	// 为空时不保存
+	path   string
+	config LevelConfig
+}
+
+var levels = &levelStore{}
+
+// 级别设置保存在日志文件旁边, 例如 distributed.log 对应 distributed.levels.json
+func levelsPath(dst string) string {
+	return strings.TrimSuffix(dst, filepath.Ext(dst)) + ".levels.json"
+}
+
+func (s *levelStore) load(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.path = path
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			stlog.Println(err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.config); err != nil {
+		stlog.Println(err)
+	}
+}
+
+// 先写临时文件再替换, 调用方需要持有锁
+func (s *levelStore) save() {
+	if s.path == "" {
+		return
+	}
+	data, err := json.Marshal(s.config)
+	if err != nil {
+		stlog.Println(err)
+		return
+	}
+	if err := ioutil.WriteFile(s.path+".tmp", data, 0600); err != nil {
+		stlog.Println(err)
+		return
+	}
+	if err := os.Rename(s.path+".tmp", s.path); err != nil {
+		stlog.Println(err)
+	}
+}
+
+func (s *levelStore) set(setting LevelSetting) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	level := setting.Level
+	switch {
+	case setting.Instance != "":
+		if s.config.Instances == nil {
+			s.config.Instances = make(map[string]Level)
+		}
+		s.config.Instances[setting.Instance] = level
+	case setting.Service != "":
+		if s.config.Services == nil {
+			s.config.Services = make(map[string]Level)
+		}
+		s.config.Services[setting.Service] = level
+	default:
+		s.config.Default = &level
+	}
+	s.save()
+}
+
+func (s *levelStore) remove(service, instance string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case instance != "":
+		delete(s.config.Instances, instance)
+	case service != "":
+		delete(s.config.Services, service)
+	default:
+		s.config.Default = nil
+	}
+	s.save()
+}
+
+// 返回对这个实例生效的级别, 没有任何设置时返回 false
+func (s *levelStore) effective(service, instance string) (Level, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if level, ok := s.config.Instances[instance]; ok && instance != "" {
+		return level, true
+	}
+	if level, ok := s.config.Services[service]; ok && service != "" {
+		return level, true
+	}
+	if s.config.Default != nil {
+		return *s.config.Default, true
+	}
+	return LevelInfo, false
+}
+
+func (s *levelStore) snapshot() LevelConfig {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	config := LevelConfig{Default: s.config.Default}
+	if len(s.config.Services) > 0 {
+		config.Services = make(map[string]Level, len(s.config.Services))
+		for k, v := range s.config.Services {
+			config.Services[k] = v
+		}
+	}
+	if len(s.config.Instances) > 0 {
+		config.Instances = make(map[string]Level, len(s.config.Instances))
+		for k, v := range s.config.Instances {
+			config.Instances[k] = v
+		}
+	}
+	return config
+}
+
+// GET /log/levels 返回所有设置
+// GET /log/levels?service=LibraryService&instance=c03214ebb6a52450 返回对这个实例生效的级别, 没有设置时返回 204
+// PUT /log/levels 设置级别, 例如 {"Service":"LibraryService","Level":"debug"}
+// DELETE /log/levels?service=LibraryService 或 ?instance=c03214ebb6a52450 删除设置, 都为空时删除默认值
+func handleLevels(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	service, instance := query.Get("service"), query.Get("instance")
+
+	switch r.Method {
+	case http.MethodGet:
+		var v interface{} = levels.snapshot()
+		if service != "" || instance != "" {
+			level, ok := levels.effective(service, instance)
+			if !ok {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			v = LevelSetting{Service: service, Instance: instance, Level: level}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			stlog.Println(err)
+		}
+	case http.MethodPut:
+		// Level 的零值是 debug, 没有写级别的请求是错误的
+		var req struct {
+			Service  string
+			Instance string
+			Level    *Level
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Level == nil {
+			if err != nil {
+				stlog.Println(err)
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		levels.set(LevelSetting{Service: req.Service, Instance: req.Instance, Level: *req.Level})
+	case http.MethodDelete:
+		levels.remove(service, instance)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,153 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// 在 JSON 中使用名称, 例如 "warn"
+func (l Level) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+func (l *Level) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	level, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// 一条日志, 也是 POST /log 的 JSON 格式
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Service string
+	// 实例 ID, 用于按实例设置日志级别
+	Instance string `json:",omitempty"`
+	// 调用日志函数的位置, 例如 library/server.go:42
+	Caller  string `json:",omitempty"`
+	Message string
+	Fields  map[string]interface{} `json:",omitempty"`
+	// 在请求中记录的日志会带上追踪上下文
+	TraceID string `json:",omitempty"`
+	SpanID  string `json:",omitempty"`
+}
+
+// 把 key, value, key, value... 转换成 map, 多余的一个值的 key 为 !BADKEY
+func makeFields(dst map[string]interface{}, kv []interface{}) map[string]interface{} {
+	if len(kv) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]interface{}, len(kv)/2)
+	}
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 == len(kv) {
+			dst["!BADKEY"] = fieldValue(kv[i])
+			break
+		}
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		dst[key] = fieldValue(kv[i+1])
+	}
+	return dst
+}
+
+// error 直接序列化是 {}, 转换成字符串; 其他无法序列化的值也转换成字符串
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// 本地输出的文本格式: 时间 级别 [服务] 消息 key=value ...
+func (r Record) text() string {
+	return r.Time.Format("2006/01/02 15:04:05.000") + " " + r.line()
+}
+
+// 不带时间的文本格式, 用于 syslog 这类自己记录时间的地方
+func (r Record) line() string {
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(r.Level.String()))
+	if r.Service != "" {
+		b.WriteString(" [" + r.Service + "]")
+	}
+	b.WriteString(" " + r.Message)
+	for _, key := range sortedKeys(r.Fields) {
+		fmt.Fprintf(&b, " %s=%v", key, r.Fields[key])
+	}
+	if r.Caller != "" {
+		b.WriteString(" caller=" + r.Caller)
+	}
+	return b.String()
+}
+
+func sortedKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
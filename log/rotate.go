@@ -0,0 +1,300 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	stlog "log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 日志文件的轮转, 任意一个条件满足时轮转, 为 0 的条件不生效
+type Rotation struct {
+	// 文件超过这个大小时轮转
+	MaxSize int64
+	// 文件创建超过这个时间后轮转
+	Interval time.Duration
+	// 轮转出来的文件用 gzip 压缩
+	Compress bool
+}
+
+// 轮转出来的文件的保留策略, 任意一个条件不满足时删除最旧的文件, 为 0 的条件不生效
+type Retention struct {
+	MaxFiles int
+	MaxAge   time.Duration
+	// 包括正在写入的文件在内的总大小
+	MaxTotalSize int64
+}
+
+var (
+	DefaultRotation = Rotation{
+		MaxSize:  64 << 20,
+		Interval: time.Hour * 24,
+		Compress: true,
+	}
+	DefaultRetention = Retention{
+		MaxFiles:     30,
+		MaxAge:       time.Hour * 24 * 30,
+		MaxTotalSize: 1 << 30,
+	}
+)
+
+// 检查按时间轮转和清理的间隔
+const rotationCheckInterval = time.Minute
+
+var (
+	rotation  Rotation
+	retention Retention
+)
+
+// 轮转出来的文件名, 例如 distributed.log 轮转为 distributed-20061019T150405.000.log
+// 按文件名排序就是按时间排序
+func archiveName(dst string, t time.Time) string {
+	ext := filepath.Ext(dst)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(dst, ext), t.UTC().Format(archiveTimeFormat), ext)
+}
+
+const archiveTimeFormat = "20060102T150405.000"
+
+// dst 的轮转文件, suffix 是压缩时加上的 .gz 或 .gz.tmp
+// 只匹配中间是轮转时间的文件名, 同一目录下的 distributed-errors.log 这类文件不是轮转文件
+func globArchives(dst, suffix string) ([]string, error) {
+	ext := filepath.Ext(dst)
+	base := strings.TrimSuffix(dst, ext)
+	matches, err := filepath.Glob(base + "-*" + ext + suffix)
+	if err != nil {
+		return nil, err
+	}
+	// Glob 返回的路径是清理过的, 只比较文件名
+	prefix := filepath.Base(base) + "-"
+	var paths []string
+	for _, path := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), prefix), ext+suffix)
+		if _, err := time.Parse(archiveTimeFormat, stamp); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// 同一毫秒内轮转多次时不覆盖已有的文件, 并且排在上一个轮转文件 last 之后
+// 上一个文件的名字可能被往后推过, 而比它更早的文件已经被清理, 只检查文件是否存在会用回清理掉的名字
+func uniqueArchiveName(dst string, now time.Time, last string) string {
+	archive := archiveName(dst, now)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(archive); os.IsNotExist(err) && archive > last {
+			return archive
+		}
+		archive = archiveName(dst, now.Add(time.Duration(i)*time.Millisecond))
+	}
+}
+
+// 已有的轮转文件, 从旧到新, 同时有压缩和没压缩的版本时只返回压缩的
+func listArchives(dst string) ([]string, error) {
+	plain, err := globArchives(dst, "")
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := globArchives(dst, ".gz")
+	if err != nil {
+		return nil, err
+	}
+	paths := append([]string(nil), compressed...)
+	for _, path := range plain {
+		if _, err := os.Stat(path + ".gz"); err == nil {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.TrimSuffix(paths[i], ".gz") < strings.TrimSuffix(paths[j], ".gz")
+	})
+	return paths, nil
+}
+
+// 启动时清理上次退出时没有完成的压缩, 然后返回已有的轮转文件
+func archives(dst string) ([]string, error) {
+	// 压缩到一半退出时留下的临时文件
+	if tmp, err := globArchives(dst, ".gz.tmp"); err == nil {
+		for _, path := range tmp {
+			os.Remove(path)
+		}
+	}
+	// 压缩完成但没来得及删除原文件
+	if plain, err := globArchives(dst, ""); err == nil {
+		for _, path := range plain {
+			if _, err := os.Stat(path + ".gz"); err == nil {
+				os.Remove(path)
+			}
+		}
+	}
+	return listArchives(dst)
+}
+
+// 保存清理后第一条记录序号的文件, 例如 distributed.log 对应 distributed.base
+func basePath(dst string) string {
+	return strings.TrimSuffix(dst, filepath.Ext(dst)) + ".base"
+}
+
+// 启动时为已有的轮转文件和正在写入的文件建立索引
+// 序号从上次清理后的 base 开始, 和重启前一样
+func openSegments(dst string) error {
+	if err := index.loadBase(basePath(dst)); err != nil {
+		return err
+	}
+	paths, err := archives(dst)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		compressed := strings.HasSuffix(path, ".gz")
+		seg, err := index.load(path, compressed)
+		if err != nil {
+			stlog.Println(err)
+			continue
+		}
+		// 上次退出时没有压缩完的文件
+		if !compressed && rotation.Compress {
+			go compress(seg)
+		}
+	}
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		index.lock.Lock()
+		index.segments = append(index.segments, &segment{
+			path:    dst,
+			modTime: time.Now(),
+			created: time.Now(),
+			first:   index.next(),
+		})
+		index.lock.Unlock()
+		return nil
+	}
+	_, err = index.load(dst, false)
+	return err
+}
+
+// 写入 size 字节之前检查是否需要轮转, 只在 run 中调用
+// 先关闭文件再改名, 之后打开新的文件
+func (fw *fileWriter) rotateIfNeeded(size int, now time.Time) {
+	index.lock.RLock()
+	active := index.active()
+	due := active.size > 0 &&
+		((rotation.MaxSize > 0 && active.size+int64(size) > rotation.MaxSize) ||
+			(rotation.Interval > 0 && now.Sub(active.created) >= rotation.Interval))
+	var last string
+	if n := len(index.segments); n > 1 {
+		last = strings.TrimSuffix(index.segments[n-2].path, ".gz")
+	}
+	index.lock.RUnlock()
+	if !due {
+		return
+	}
+
+	archive := uniqueArchiveName(fw.path, now, last)
+	if err := fw.close(); err != nil {
+		stlog.Println(err)
+	}
+	seg, err := index.rotate(archive)
+	if err != nil {
+		stlog.Println(err)
+	} else if rotation.Compress {
+		go compress(seg)
+	}
+	if err := fw.open(); err != nil {
+		stlog.Println(err)
+	}
+	removeExpired(now)
+}
+
+// 删除超出保留策略的轮转文件
+// 先保存新的 base 再删除文件, 中途退出时重启后的序号不会比之前小
+func removeExpired(now time.Time) {
+	removed := index.expire(retention, now)
+	if len(removed) == 0 {
+		return
+	}
+	if err := index.saveBase(); err != nil {
+		stlog.Println(err)
+	}
+	for _, path := range removed {
+		if err := os.Remove(path); err != nil {
+			stlog.Println(err)
+		}
+	}
+}
+
+// 压缩完成后替换索引中的文件, 最后删除原文件
+func compress(seg *segment) {
+	index.lock.RLock()
+	path, modTime := seg.path, seg.modTime
+	index.lock.RUnlock()
+
+	gzPath, size, err := compressFile(path, modTime)
+	if err != nil {
+		// 文件不存在说明压缩前已经被清理
+		if !os.IsNotExist(err) {
+			stlog.Println(err)
+		}
+		return
+	}
+	if !index.compressed(seg, gzPath, size) {
+		// 压缩期间文件已经被清理
+		os.Remove(gzPath)
+	}
+	os.Remove(path)
+}
+
+// 压缩到临时文件, 完成后改名为 path.gz, 不删除原文件
+func compressFile(path string, modTime time.Time) (string, int64, error) {
+	gzPath := path + ".gz"
+	size, err := gzipFile(path, gzPath+".tmp")
+	if err != nil {
+		os.Remove(gzPath + ".tmp")
+		return "", 0, err
+	}
+	// 保留原文件的修改时间, 重启后按时间清理时使用
+	os.Chtimes(gzPath+".tmp", modTime, modTime)
+	if err := os.Rename(gzPath+".tmp", gzPath); err != nil {
+		os.Remove(gzPath + ".tmp")
+		return "", 0, err
+	}
+	return gzPath, size, nil
+}
+
+func gzipFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	gz := gzip.NewWriter(f)
+	if _, err := io.Copy(gz, in); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
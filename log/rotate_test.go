@@ -0,0 +1,204 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUniqueArchiveName(t *testing.T) {
+	now := time.Date(2006, 10, 19, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		existing []time.Duration
+		// 上一个轮转文件, 相对 now 的时间, 为负数时没有
+		last time.Duration
+		want time.Duration
+	}{
+		{"first", nil, -1, 0},
+		{"same millisecond", []time.Duration{0}, 0, time.Millisecond},
+		{"several in the same millisecond", []time.Duration{0, time.Millisecond}, time.Millisecond, 2 * time.Millisecond},
+		// 0 已经被清理, 1ms 是上一个文件, 不能用回 0
+		{"expired name", []time.Duration{time.Millisecond}, time.Millisecond, 2 * time.Millisecond},
+		{"last is older", nil, -time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "distributed.log")
+			for _, d := range tt.existing {
+				if err := ioutil.WriteFile(archiveName(dst, now.Add(d)), nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var last string
+			if tt.last != -1 {
+				last = archiveName(dst, now.Add(tt.last))
+			}
+			if got, want := uniqueArchiveName(dst, now, last), archiveName(dst, now.Add(tt.want)); got != want {
+				t.Errorf("uniqueArchiveName = %s, want %s", filepath.Base(got), filepath.Base(want))
+			}
+		})
+	}
+}
+
+func TestGlobArchives(t *testing.T) {
+	files := []string{
+		"distributed.log",
+		"distributed-20061019T150405.000.log",
+		"distributed-20061019T150406.000.log.gz",
+		"distributed-20061019T150407.000.log.gz.tmp",
+		"distributed-errors.log",
+		"distributed-errors-20061019T150405.000.log",
+		"distributed-20061019T150405.log",
+		"distributed-20061019.log.gz",
+		"other-20061019T150405.000.log",
+	}
+	tests := []struct {
+		name   string
+		dst    string
+		suffix string
+		want   []string
+	}{
+		{"plain", "distributed.log", "", []string{"distributed-20061019T150405.000.log"}},
+		{"compressed", "distributed.log", ".gz", []string{"distributed-20061019T150406.000.log.gz"}},
+		{"temporary", "distributed.log", ".gz.tmp", []string{"distributed-20061019T150407.000.log.gz.tmp"}},
+		// sink 写到同一目录下的文件有自己的轮转文件
+		{"sink file", "distributed-errors.log", "", []string{"distributed-errors-20061019T150405.000.log"}},
+		{"no archives", "missing.log", "", nil},
+	}
+	dir := t.TempDir()
+	for _, name := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := globArchives(filepath.Join(dir, tt.dst), tt.suffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, path := range paths {
+				got = append(got, filepath.Base(path))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("globArchives = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Now()
+	// 从旧到新的轮转文件, 最后是正在写入的文件
+	type file struct {
+		age  time.Duration
+		size int64
+	}
+	archived := []file{{5 * time.Hour, 100}, {3 * time.Hour, 100}, {time.Hour, 100}, {0, 100}}
+	tests := []struct {
+		name      string
+		files     []file
+		retention Retention
+		removed   int
+	}{
+		{"no limits", archived, Retention{}, 0},
+		{"max files", archived, Retention{MaxFiles: 1}, 2},
+		{"max files not reached", archived, Retention{MaxFiles: 3}, 0},
+		{"max age", archived, Retention{MaxAge: 2 * time.Hour}, 2},
+		{"max total size", archived, Retention{MaxTotalSize: 250}, 2},
+		{"any limit", archived, Retention{MaxFiles: 2, MaxAge: 4 * time.Hour}, 1},
+		// 正在写入的文件不会被删除
+		{"active file", []file{{10 * time.Hour, 1000}}, Retention{MaxFiles: 1, MaxAge: time.Hour, MaxTotalSize: 1}, 0},
+		{"all archives", archived, Retention{MaxTotalSize: 1}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := newLogIndex()
+			for i, f := range tt.files {
+				seg := &segment{path: fmt.Sprint(i), size: f.size, modTime: now.Add(-f.age), first: i}
+				idx.segments = append(idx.segments, seg)
+				idx.add(seg, 0, 1, Record{Service: "Test"})
+			}
+
+			removed := idx.expire(tt.retention, now)
+			var want []string
+			for i := 0; i < tt.removed; i++ {
+				want = append(want, fmt.Sprint(i))
+			}
+			if fmt.Sprint(removed) != fmt.Sprint(want) {
+				t.Errorf("removed %v, want %v", removed, want)
+			}
+			if len(idx.segments) != len(tt.files)-tt.removed || idx.base != tt.removed || len(idx.entries) != len(tt.files)-tt.removed {
+				t.Errorf("%d segments, base %d, %d entries left", len(idx.segments), idx.base, len(idx.entries))
+			}
+		})
+	}
+}
+
+// 按时间轮转从文件最后写入的时间开始计算, 重启不会重新计时
+func TestRotationIntervalAfterRestart(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration
+		rotated bool
+	}{
+		{"old file", 2 * time.Hour, true},
+		{"recent file", time.Minute, false},
+	}
+	rot := Rotation{Interval: time.Hour}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := []byte(`{"Level":"info","Message":"before restart"}` + "\n")
+			modTime := time.Now().Add(-tt.age)
+			for _, name := range []string{"distributed.log", "sink.log"} {
+				path := filepath.Join(dir, name)
+				if err := ioutil.WriteFile(path, data, 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dst := filepath.Join(dir, "distributed.log")
+			index = newLogIndex()
+			stop, err := Run(dst, rot, Retention{}, Sync{Policy: SyncAlways})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = write([]Record{{Level: LevelInfo, Message: "after restart"}}, false)
+			if stopErr := stop(context.Background()); err == nil {
+				err = stopErr
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paths, _ := listArchives(dst); (len(paths) == 1) != tt.rotated {
+				t.Errorf("log file archives %v, want rotated = %v", paths, tt.rotated)
+			}
+
+			sinkPath := filepath.Join(dir, "sink.log")
+			sink, err := NewFileSink(sinkPath, rot, Retention{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sink.Write([]Record{{Level: LevelInfo, Message: "after restart"}})
+			if closeErr := sink.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paths, _ := listArchives(sinkPath); (len(paths) == 1) != tt.rotated {
+				t.Errorf("sink archives %v, want rotated = %v", paths, tt.rotated)
+			}
+		})
+	}
+}
@@ -1,52 +1,246 @@
-// 日志服务, 接收 POST 请求, 把请求中的内容写到 LOG 文件中
+// 日志服务, 接收 POST 请求, 把请求中的日志记录以 JSON 行的格式写到 LOG 文件中, 并提供查询接口
 
 package log
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	stlog "log"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var log *stlog.Logger
-
-type fileLog string
-type aLog string
-
-func (fl fileLog) Write(data []byte) (int, error) {
-	f, err := os.OpenFile(string(fl), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
-	if err != nil {
-		return 0, err
+// 日志写到 dst, 按 rot 轮转, 按 ret 清理轮转出来的文件, 按 sync 同步到磁盘
+// 返回的函数停止写入, 等待剩下的记录写完, 文件同步关闭, sink 写完缓存的记录, 在注销之后调用
+func Run(dst string, rot Rotation, ret Retention, sync Sync) (func(ctx context.Context) error, error) {
+	rotation, retention = rot, ret
+	levels.load(levelsPath(dst))
+	if err := openSegments(dst); err != nil {
+		return nil, err
 	}
-	defer f.Close()
+	removeExpired(time.Now())
 
-	return f.Write(data)
-}
+	out = newFileWriter(dst, sync)
+	if err := out.open(); err != nil {
+		return nil, err
+	}
+	stop := make(chan struct{})
+	go out.run(stop)
 
-func Run(dst string) {
-	// fileLog 就是 io.Write 类型, 因为定义了 Write()
-	// LstdFlags 是标准 Logger 的初始值, Ldata | Ltime 组成
-	log = stlog.New(fileLog(dst), "destributed - ", stlog.LstdFlags)
+	fw := out
+	return func(ctx context.Context) error {
+		close(stop)
+		select {
+		case <-fw.closed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}, nil
 }
 
 func RegisterHandlers() {
 	http.HandleFunc("/log", func(rw http.ResponseWriter, r *http.Request) {
 		switch r.Method {
+		case http.MethodGet:
+			queryLogs(rw, r)
 		case http.MethodPost:
-			msg, err := ioutil.ReadAll(r.Body)
-			if err != nil || len(msg) == 0 {
+			body := io.Reader(r.Body)
+			// 客户端批量发送时会压缩
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				defer gz.Close()
+				body = gz
+			}
+			data, err := ioutil.ReadAll(body)
+			if err != nil || len(data) == 0 {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			records, err := decodeRecords(r.Header.Get("Content-Type"), data)
+			if err != nil {
+				stlog.Println(err)
 				rw.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			write(string(msg))
+			if err := write(records, r.Header.Get(forwardedHeader) != ""); err != nil {
+				stlog.Println(err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 		default:
 			rw.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 	})
+	http.HandleFunc("/log/levels", handleLevels)
+	http.HandleFunc("/log/stream", streamLogs)
 }
 
-func write(msg string) {
-	log.Printf("%v\n", msg)
+// application/json 可以是一条记录或者记录的数组
+// 其他类型按旧的格式处理, 整个请求体作为一条 info 记录的消息
+func decodeRecords(contentType string, data []byte) ([]Record, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/json" {
+		return []Record{{
+			Level:   LevelInfo,
+			Message: strings.TrimRight(string(data), "\n"),
+		}}, nil
+	}
+
+	var records []Record
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return append(records, r), nil
+}
+
+// 每条记录一行 JSON, 同一个请求中的记录一次写入
+func write(records []Record, forwarded bool) error {
+	var buf []byte
+	lengths := make([]int, len(records))
+	for i := range records {
+		if records[i].Time.IsZero() {
+			records[i].Time = time.Now()
+		}
+		data, err := json.Marshal(records[i])
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+		lengths[i] = len(data) + 1
+	}
+
+	return out.write(buf, records, lengths, forwarded)
+}
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// 查询结果, Next 不为空时可以用 cursor=Next 获取下一页
+type QueryResult struct {
+	Records []Record
+	Next    string `json:",omitempty"`
+}
+
+// GET /log 从新到旧查询日志, 支持的参数:
+// service 服务名称, level 最低级别, since 和 until 时间范围 (RFC3339, 包含 since 不包含 until)
+// q 消息或字段中包含的文本, regex 匹配消息或字段的正则表达式
+// limit 每页的数量, 默认 100, 最多 1000, cursor 上一页返回的 Next
+func queryLogs(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q, err := parseQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.before, q.limit = -1, defaultQueryLimit
+	if v := params.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if q.limit > maxQueryLimit {
+			q.limit = maxQueryLimit
+		}
+	}
+	if v := params.Get("cursor"); v != "" {
+		if q.before, err = strconv.Atoi(v); err != nil || q.before < 0 {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, next, err := index.query(q)
+	if err != nil {
+		stlog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := QueryResult{Records: records}
+	if next >= 0 {
+		result.Next = strconv.Itoa(next)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		stlog.Println(err)
+	}
+}
+
+// 解析查询和实时日志共用的过滤参数: service, level, since, until, q, regex
+func parseQuery(params url.Values) (logQuery, error) {
+	q := logQuery{service: params.Get("service")}
+
+	var err error
+	if v := params.Get("level"); v != "" {
+		if q.level, err = ParseLevel(v); err != nil {
+			return q, err
+		}
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.since}, {"until", &q.until}} {
+		if v := params.Get(p.name); v != "" {
+			if *p.t, err = time.Parse(time.RFC3339, v); err != nil {
+				return q, fmt.Errorf("invalid %s: %v", p.name, err)
+			}
+		}
+	}
+
+	var matchers []func(string) bool
+	if v := params.Get("q"); v != "" {
+		matchers = append(matchers, func(s string) bool { return strings.Contains(s, v) })
+	}
+	if v := params.Get("regex"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid regex: %v", err)
+		}
+		matchers = append(matchers, re.MatchString)
+	}
+	if len(matchers) > 0 {
+		q.match = func(r Record) bool {
+			text := searchText(r)
+			for _, m := range matchers {
+				if !m(text) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return q, nil
+}
+
+// 搜索的文本是消息和按 key 排序的字段, 例如 "invalid takeout request error=..."
+func searchText(r Record) string {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	for _, key := range sortedKeys(r.Fields) {
+		fmt.Fprintf(&b, " %s=%v", key, r.Fields[key])
+	}
+	return b.String()
 }
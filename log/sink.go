@@ -0,0 +1,363 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	stlog "log"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// 日志服务把写入的记录分发给每个 sink, 写到主日志文件之后才分发
+// Write 在 sink 自己的 goroutine 中调用, 慢的 sink 不会影响写入
+type Sink interface {
+	Write(records []Record) error
+	Close() error
+}
+
+// 只有符合条件的记录才会发给 sink, 为空的条件不生效
+type Filter struct {
+	// 最低级别
+	Level    Level
+	Services []string
+	// 匹配消息和字段的正则表达式
+	Pattern *regexp.Regexp
+}
+
+func (f Filter) matches(r Record) bool {
+	if r.Level < f.Level {
+		return false
+	}
+	if len(f.Services) > 0 {
+		found := false
+		for _, s := range f.Services {
+			if s == r.Service {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return f.Pattern == nil || f.Pattern.MatchString(searchText(r))
+}
+
+// 每个 sink 最多缓存的批次, 满了之后丢弃新的记录
+const sinkQueueSize = 256
+
+type sinkWorker struct {
+	name   string
+	sink   Sink
+	filter Filter
+	// 是 ForwardSink, 转发过来的记录不会再转发
+	forward bool
+	queue   chan []Record
+	// 丢弃的记录数, 下次放入队列时报告
+	dropped int
+	done    chan struct{}
+}
+
+var (
+	sinksLock sync.Mutex
+	sinks     []*sinkWorker
+)
+
+// 添加一个 sink, 需要在 Run 之前调用, name 用于日志中的错误信息
+func AddSink(name string, sink Sink, filter Filter) {
+	_, forward := sink.(*ForwardSink)
+	w := &sinkWorker{
+		name:    name,
+		sink:    sink,
+		filter:  filter,
+		forward: forward,
+		queue:   make(chan []Record, sinkQueueSize),
+		done:    make(chan struct{}),
+	}
+	sinksLock.Lock()
+	sinks = append(sinks, w)
+	sinksLock.Unlock()
+	go w.run()
+}
+
+func (w *sinkWorker) run() {
+	defer close(w.done)
+
+	for batch := range w.queue {
+		// 把已经到达的批次合并成一次写入
+		for n := len(w.queue); n > 0; n-- {
+			batch = append(batch, <-w.queue...)
+		}
+		if err := w.sink.Write(batch); err != nil {
+			stlog.Printf("sink %s: %v\n", w.name, err)
+		}
+	}
+	if err := w.sink.Close(); err != nil {
+		stlog.Printf("sink %s: %v\n", w.name, err)
+	}
+}
+
+// 在提交之后调用, 不会阻塞写入
+// forwarded 为 true 时记录是其他日志服务转发过来的, 不再交给 ForwardSink, 避免互相转发形成环
+func publishToSinks(records []Record, forwarded bool) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+
+	for _, w := range sinks {
+		if forwarded && w.forward {
+			continue
+		}
+		var batch []Record
+		for _, r := range records {
+			if w.filter.matches(r) {
+				batch = append(batch, r)
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		select {
+		case w.queue <- batch:
+			if w.dropped > 0 {
+				stlog.Printf("sink %s: dropped %d records, it is not keeping up\n", w.name, w.dropped)
+				w.dropped = 0
+			}
+		default:
+			w.dropped += len(batch)
+		}
+	}
+}
+
+// 等待 sink 写完缓存的记录并关闭
+func closeSinks() {
+	sinksLock.Lock()
+	closing := sinks
+	sinks = nil
+	sinksLock.Unlock()
+
+	for _, w := range closing {
+		close(w.queue)
+	}
+	for _, w := range closing {
+		<-w.done
+	}
+}
+
+// 写到标准输出, Format 为 json 时每行一条 JSON 记录, 否则为文本格式
+type StdoutSink struct {
+	Format string
+}
+
+func (s StdoutSink) Write(records []Record) error {
+	var buf bytes.Buffer
+	for _, r := range records {
+		if s.Format == "json" {
+			data, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			buf.Write(data)
+		} else {
+			buf.WriteString(r.text())
+		}
+		buf.WriteByte('\n')
+	}
+	_, err := os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+func (s StdoutSink) Close() error {
+	return nil
+}
+
+// 转发的请求带有这个请求头, 收到的日志服务不会再转发这些记录
+const forwardedHeader = "X-Log-Forwarded"
+
+// 转发到另一个日志服务, 和客户端一样压缩后批量发送
+// 只转发一次, 从其他日志服务转发过来的记录不会再被转发, 指向自己或者互相转发也不会循环
+type ForwardSink struct {
+	URL    string
+	client *http.Client
+}
+
+func NewForwardSink(url string) *ForwardSink {
+	return &ForwardSink{URL: url, client: &http.Client{Timeout: shipTimeout}}
+}
+
+func (s *ForwardSink) Write(records []Record) error {
+	for len(records) > 0 {
+		n := len(records)
+		if n > maxBatch {
+			n = maxBatch
+		}
+		if err := s.post(records[:n]); err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+func (s *ForwardSink) post(records []Record) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(records); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/log", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set(forwardedHeader, "1")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to forward %d records to %s. Service responded %d", len(records), s.URL, res.StatusCode)
+	}
+	return nil
+}
+
+func (s *ForwardSink) Close() error {
+	return nil
+}
+
+// sinks 配置文件中的一项, 例如把错误单独写到一个文件:
+//
+//	[
+//		{"Type": "file", "Path": "./errors.log", "Level": "error"},
+//		{"Type": "stdout", "Format": "text", "Services": ["LibraryService"]},
+//		{"Type": "syslog", "Tag": "distributed", "Level": "warn"},
+//		{"Type": "forward", "URL": "http://localhost:4001", "Pattern": "takeout"}
+//	]
+type SinkConfig struct {
+	// file, stdout, syslog 或 forward
+	Type string
+	Name string `json:",omitempty"`
+
+	// 过滤条件
+	Level    string   `json:",omitempty"`
+	Services []string `json:",omitempty"`
+	Pattern  string   `json:",omitempty"`
+
+	// file: 文件路径和轮转, 为空的条件不生效, 时间的格式为 24h, 30m
+	Path         string `json:",omitempty"`
+	MaxSize      int64  `json:",omitempty"`
+	Interval     string `json:",omitempty"`
+	Compress     bool   `json:",omitempty"`
+	MaxFiles     int    `json:",omitempty"`
+	MaxAge       string `json:",omitempty"`
+	MaxTotalSize int64  `json:",omitempty"`
+	// stdout: json 或 text
+	Format string `json:",omitempty"`
+	// syslog: unix socket 地址, 为空时使用系统默认的位置
+	Address string `json:",omitempty"`
+	Tag     string `json:",omitempty"`
+	// forward: 另一个日志服务的地址
+	URL string `json:",omitempty"`
+}
+
+// 读取 sinks 配置文件并添加所有 sink, 需要在 Run 之前调用
+// 有一项配置错误时不添加任何 sink, 已经创建的会被关闭
+func LoadSinks(path string) (err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configs []SinkConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("invalid sinks config %s: %v", path, err)
+	}
+
+	type configured struct {
+		name   string
+		sink   Sink
+		filter Filter
+	}
+	var all []configured
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, c := range all {
+			if closeErr := c.sink.Close(); closeErr != nil {
+				stlog.Printf("sink %s: %v\n", c.name, closeErr)
+			}
+		}
+	}()
+	for i, c := range configs {
+		filter := Filter{Services: c.Services}
+		if filter.Level, err = ParseLevel(c.Level); err != nil {
+			return err
+		}
+		if c.Pattern != "" {
+			if filter.Pattern, err = regexp.Compile(c.Pattern); err != nil {
+				return fmt.Errorf("invalid pattern in sink %d: %v", i, err)
+			}
+		}
+
+		var sink Sink
+		switch c.Type {
+		case "file":
+			if c.Path == "" {
+				return fmt.Errorf("file sink %d needs a path", i)
+			}
+			rot := Rotation{MaxSize: c.MaxSize, Compress: c.Compress}
+			ret := Retention{MaxFiles: c.MaxFiles, MaxTotalSize: c.MaxTotalSize}
+			if rot.Interval, err = parseDuration(c.Interval); err != nil {
+				return fmt.Errorf("invalid interval in sink %d: %v", i, err)
+			}
+			if ret.MaxAge, err = parseDuration(c.MaxAge); err != nil {
+				return fmt.Errorf("invalid max age in sink %d: %v", i, err)
+			}
+			sink, err = NewFileSink(c.Path, rot, ret)
+		case "stdout":
+			sink = StdoutSink{Format: c.Format}
+		case "syslog":
+			sink, err = NewSyslogSink(c.Address, c.Tag)
+		case "forward":
+			if c.URL == "" {
+				return fmt.Errorf("forward sink %d needs a URL", i)
+			}
+			sink = NewForwardSink(c.URL)
+		default:
+			return fmt.Errorf("unknown sink type %q", c.Type)
+		}
+		if err != nil {
+			return err
+		}
+
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("%d-%s", i, c.Type)
+		}
+		all = append(all, configured{name, sink, filter})
+	}
+	// 全部创建成功之后再添加
+	for _, c := range all {
+		AddSink(c.name, c.sink, c.filter)
+	}
+	return nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,213 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	r := Record{Level: LevelWarn, Service: "LibraryService", Message: "borrow failed", Fields: map[string]interface{}{"takeout": 42}}
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"empty", Filter{}, true},
+		{"level below", Filter{Level: LevelInfo}, true},
+		{"same level", Filter{Level: LevelWarn}, true},
+		{"level above", Filter{Level: LevelError}, false},
+		{"service", Filter{Services: []string{"BookService", "LibraryService"}}, true},
+		{"other service", Filter{Services: []string{"BookService"}}, false},
+		{"message pattern", Filter{Pattern: regexp.MustCompile("^borrow")}, true},
+		{"field pattern", Filter{Pattern: regexp.MustCompile("takeout=42")}, true},
+		{"pattern not found", Filter{Pattern: regexp.MustCompile("return")}, false},
+		{"all conditions", Filter{Level: LevelWarn, Services: []string{"LibraryService"}, Pattern: regexp.MustCompile("failed")}, true},
+		{"one condition fails", Filter{Level: LevelWarn, Services: []string{"BookService"}, Pattern: regexp.MustCompile("failed")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches(r); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 保存写入的记录
+type memorySink struct {
+	lock    sync.Mutex
+	written []string
+	closed  bool
+}
+
+func (s *memorySink) Write(records []Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range records {
+		s.written = append(s.written, r.Message)
+	}
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+// 每个 sink 只收到符合条件的记录, 转发过来的记录不会再交给 ForwardSink
+func TestPublishToSinks(t *testing.T) {
+	records := []Record{
+		{Level: LevelInfo, Service: "BookService", Message: "info"},
+		{Level: LevelError, Service: "BookService", Message: "error"},
+		{Level: LevelWarn, Service: "LibraryService", Message: "warn"},
+	}
+	tests := []struct {
+		name      string
+		forwarded bool
+		stored    []string
+		sent      []string
+	}{
+		{"written here", false, []string{"error", "warn"}, []string{"info", "error"}},
+		{"forwarded from another log service", true, []string{"error", "warn"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := &testLogService{status: respond(http.StatusOK)}
+			var header string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header.Get(forwardedHeader)
+				ls.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+
+			memory := &memorySink{}
+			AddSink("memory", memory, Filter{Level: LevelWarn})
+			AddSink("forward", NewForwardSink(srv.URL), Filter{Services: []string{"BookService"}})
+			publishToSinks(records, tt.forwarded)
+			closeSinks()
+
+			if fmt.Sprint(memory.written) != fmt.Sprint(tt.stored) || !memory.closed {
+				t.Errorf("memory sink has %v, closed = %v, want %v", memory.written, memory.closed, tt.stored)
+			}
+			if got := ls.messages(); fmt.Sprint(got) != fmt.Sprint(tt.sent) {
+				t.Errorf("forwarded %v, want %v", got, tt.sent)
+			}
+			if tt.sent != nil && header == "" {
+				t.Errorf("forwarded request has no %s header", forwardedHeader)
+			}
+		})
+	}
+}
+
+// 打开的文件数量, 只在 Linux 上可用
+func openFiles(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("/proc/self/fd is not available")
+	}
+	return len(fds)
+}
+
+func TestLoadSinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []SinkConfig
+		sinks   int
+		err     string
+	}{
+		{"valid", []SinkConfig{{Type: "file", Path: "errors.log", Level: "error"}, {Type: "stdout"}}, 2, ""},
+		{"unknown type", []SinkConfig{{Type: "file", Path: "errors.log"}, {Type: "kafka"}}, 0, "unknown sink type"},
+		{"bad level", []SinkConfig{{Type: "file", Path: "errors.log"}, {Type: "stdout", Level: "fatal"}}, 0, "unknown log level"},
+		{"bad pattern", []SinkConfig{{Type: "file", Path: "errors.log"}, {Type: "stdout", Pattern: "("}}, 0, "invalid pattern"},
+		{"file without path", []SinkConfig{{Type: "file", Path: "errors.log"}, {Type: "file"}}, 0, "needs a path"},
+		{"bad interval", []SinkConfig{{Type: "file", Path: "errors.log"}, {Type: "file", Path: "other.log", Interval: "daily"}}, 0, "invalid interval"},
+		{"forward without url", []SinkConfig{{Type: "file", Path: "errors.log"}, {Type: "forward"}}, 0, "needs a URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for i := range tt.configs {
+				if tt.configs[i].Path != "" {
+					tt.configs[i].Path = filepath.Join(dir, tt.configs[i].Path)
+				}
+			}
+			data, err := json.Marshal(tt.configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "sinks.json")
+			if err := ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			before := openFiles(t)
+			err = LoadSinks(path)
+			sinksLock.Lock()
+			added := len(sinks)
+			sinksLock.Unlock()
+			closeSinks()
+
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("LoadSinks error = %v, want %q", err, tt.err)
+			}
+			if added != tt.sinks {
+				t.Errorf("added %d sinks, want %d", added, tt.sinks)
+			}
+			// 出错时已经创建的文件 sink 被关闭
+			if tt.err != "" {
+				if after := openFiles(t); after != before {
+					t.Errorf("%d files open after a failed LoadSinks, %d before", after, before)
+				}
+			}
+		})
+	}
+}
+
+// Close 之后后台的压缩和清理都已经完成
+func TestFileSinkCloseWaitsForCompression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sink.log")
+	s, err := NewFileSink(path, Rotation{MaxSize: 1, Compress: true}, Retention{MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := s.Write([]Record{{Level: LevelInfo, Message: fmt.Sprint(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	compressed, _ := globArchives(path, ".gz")
+	plain, _ := globArchives(path, "")
+	tmp, _ := globArchives(path, ".gz.tmp")
+	if len(compressed) != 2 || len(plain) != 0 || len(tmp) != 0 {
+		t.Errorf("files after Close: %v, want 2 compressed archives", names)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error(err)
+	}
+}
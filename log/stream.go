@@ -0,0 +1,210 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	stlog "log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个订阅者最多缓存的记录数, 满了之后断开, 客户端带着 Last-Event-ID 重连后从索引中补发
+	streamBuffer = 1000
+	// 没有新记录时发送注释, 避免代理关闭空闲的连接
+	streamKeepAlive = time.Second * 15
+	// 补发时每次从索引中读取的记录数
+	replayPage = 500
+)
+
+type streamEvent struct {
+	seq    int
+	record Record
+}
+
+type subscriber struct {
+	q      logQuery
+	events chan streamEvent
+	// 缓存满了被断开时关闭
+	dropped chan struct{}
+}
+
+// 把写入的记录分发给 /log/stream 的订阅者
+type hub struct {
+	lock sync.Mutex
+	subs map[*subscriber]struct{}
+	// CloseStreams 之后关闭, 结束所有连接
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var streams = &hub{
+	subs: make(map[*subscriber]struct{}),
+	done: make(chan struct{}),
+}
+
+func (h *hub) subscribe(q logQuery) *subscriber {
+	s := &subscriber{
+		q:       q,
+		events:  make(chan streamEvent, streamBuffer),
+		dropped: make(chan struct{}),
+	}
+	h.lock.Lock()
+	h.subs[s] = struct{}{}
+	h.lock.Unlock()
+	return s
+}
+
+func (h *hub) unsubscribe(s *subscriber) {
+	h.lock.Lock()
+	delete(h.subs, s)
+	h.lock.Unlock()
+}
+
+// 在提交之后调用, 不会阻塞写入, 跟不上的订阅者被断开
+func (h *hub) publish(first int, records []Record) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for s := range h.subs {
+	send:
+		for i, r := range records {
+			if !s.q.matches(r) {
+				continue
+			}
+			select {
+			case s.events <- streamEvent{seq: first + i, record: r}:
+			default:
+				close(s.dropped)
+				delete(h.subs, s)
+				break send
+			}
+		}
+	}
+}
+
+// 结束所有实时日志的连接, 服务停止时调用, 否则连接会一直占着直到 drain timeout
+func CloseStreams() {
+	streams.closeOnce.Do(func() {
+		close(streams.done)
+	})
+}
+
+// GET /log/stream 以 Server-Sent Events 的格式推送新的记录, 事件 ID 是记录的序号
+// 过滤参数和 GET /log 相同: service, level, since, until, q, regex
+// 带上 Last-Event-ID 请求头 (或者 last_event_id 参数) 时先补发这个 ID 之后的记录
+func streamLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	params := r.URL.Query()
+	q, err := parseQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	last := -1
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = params.Get("last_event_id")
+	}
+	if lastID != "" {
+		if last, err = strconv.Atoi(lastID); err != nil || last < 0 {
+			http.Error(w, "invalid last event id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 先订阅再补发, 补发期间写入的记录在缓存中, 按序号去掉重复的
+	sub := streams.subscribe(q)
+	defer streams.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	next := 0
+	if last >= 0 {
+		next = last + 1
+		for {
+			records, seqs, end, err := index.after(q, next, replayPage)
+			if err != nil {
+				stlog.Println(err)
+				return
+			}
+			for i, record := range records {
+				if err := writeEvent(w, seqs[i], record); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+			next = end
+			if len(records) < replayPage {
+				break
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-sub.events:
+			if e.seq < next {
+				continue
+			}
+			if err := writeEvent(w, e.seq, e.record); err != nil {
+				return
+			}
+			// 把已经到达的记录一起发出去
+			for n := len(sub.events); n > 0; n-- {
+				e := <-sub.events
+				if e.seq < next {
+					continue
+				}
+				if err := writeEvent(w, e.seq, e.record); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-sub.dropped:
+			// 缓存中的记录仍然发出去, 客户端从最后一条的 ID 继续
+			for n := len(sub.events); n > 0; n-- {
+				e := <-sub.events
+				if e.seq >= next {
+					writeEvent(w, e.seq, e.record)
+				}
+			}
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		case <-streams.done:
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, seq int, r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", seq, data)
+	return err
+}
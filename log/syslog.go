@@ -0,0 +1,108 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// 本机 syslog 常见的 unix socket 地址
+var syslogAddresses = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslog 的 facility, 使用 local0
+const syslogFacility = 16
+
+// 写到本机的 syslog, 每条记录一条消息, 格式为 RFC 3164
+// 不使用 log/syslog, 它在 Windows 上无法编译
+type SyslogSink struct {
+	address string
+	tag     string
+	conn    net.Conn
+}
+
+// address 为空时依次尝试常见的地址, tag 为空时使用 distributed
+func NewSyslogSink(address, tag string) (*SyslogSink, error) {
+	if tag == "" {
+		tag = "distributed"
+	}
+	s := &SyslogSink{address: address, tag: tag}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SyslogSink) connect() error {
+	addresses := syslogAddresses
+	if s.address != "" {
+		addresses = []string{s.address}
+	}
+	for _, address := range addresses {
+		for _, network := range []string{"unixgram", "unix"} {
+			conn, err := net.Dial(network, address)
+			if err == nil {
+				s.conn = conn
+				return nil
+			}
+		}
+	}
+	return errors.New("unix syslog delivery error")
+}
+
+// debug, info, warn, error 对应 syslog 的 debug, info, warning, err
+func syslogSeverity(l Level) int {
+	switch l {
+	case LevelDebug:
+		return 7
+	case LevelInfo:
+		return 6
+	case LevelWarn:
+		return 4
+	default:
+		return 3
+	}
+}
+
+func (s *SyslogSink) Write(records []Record) error {
+	for _, r := range records {
+		msg := fmt.Sprintf("<%d>%s %s[%d]: %s\n",
+			syslogFacility*8+syslogSeverity(r.Level),
+			r.Time.Format(time.Stamp),
+			s.tag,
+			os.Getpid(),
+			strings.TrimRight(r.line(), "\n"),
+		)
+		if err := s.write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syslog 重启之后连接会断开, 重新连接一次
+func (s *SyslogSink) write(msg string) error {
+	if s.conn != nil {
+		if _, err := s.conn.Write([]byte(msg)); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	_, err := s.conn.Write([]byte(msg))
+	return err
+}
+
+func (s *SyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
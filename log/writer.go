@@ -0,0 +1,262 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	stlog "log"
+	"os"
+	"strings"
+	"time"
+)
+
+// 什么时候把写入的记录同步到磁盘
+type SyncPolicy int
+
+const (
+	// 每次提交后同步, 返回 200 时记录已经落盘
+	SyncAlways SyncPolicy = iota
+	// 按固定间隔同步, 崩溃时最多丢失一个间隔内的记录
+	SyncInterval
+	// 交给操作系统决定
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	default:
+		return fmt.Sprintf("sync(%d)", int(p))
+	}
+}
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return SyncInterval, fmt.Errorf("unknown sync policy %q", s)
+	}
+}
+
+type Sync struct {
+	Policy SyncPolicy
+	// Policy 为 SyncInterval 时同步的间隔
+	Interval time.Duration
+}
+
+var DefaultSync = Sync{Policy: SyncInterval, Interval: time.Second}
+
+const (
+	writeBufferSize = 256 << 10
+	// 一次提交最多合并的请求数
+	maxGroupSize = 1024
+)
+
+var errWriterClosed = errors.New("log writer is closed")
+
+// 一个请求中的记录, 已经编码成 JSON 行
+type writeRequest struct {
+	buf     []byte
+	records []Record
+	lengths []int
+	// 由另一个日志服务的 ForwardSink 转发过来的记录
+	forwarded bool
+	done      chan error
+}
+
+// 所有写入都交给一个 goroutine, 把同时到达的请求合并成一次写入和一次同步
+type fileWriter struct {
+	path string
+	sync Sync
+
+	// 只在 run 中访问
+	f     *os.File
+	w     *bufio.Writer
+	dirty bool
+
+	requests chan *writeRequest
+	// run 退出后关闭
+	closed chan struct{}
+}
+
+var out *fileWriter
+
+func newFileWriter(path string, sync Sync) *fileWriter {
+	return &fileWriter{
+		path:     path,
+		sync:     sync,
+		requests: make(chan *writeRequest),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (fw *fileWriter) open() error {
+	f, err := os.OpenFile(fw.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fw.f = f
+	if fw.w == nil {
+		fw.w = bufio.NewWriterSize(f, writeBufferSize)
+	} else {
+		fw.w.Reset(f)
+	}
+	return nil
+}
+
+// 写入缓冲的数据并同步, 然后关闭文件
+func (fw *fileWriter) close() error {
+	if fw.f == nil {
+		return nil
+	}
+	err := fw.w.Flush()
+	if syncErr := fw.f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := fw.f.Close(); err == nil {
+		err = closeErr
+	}
+	fw.f, fw.dirty = nil, false
+	return err
+}
+
+// 等待记录被提交, 按同步策略返回时记录可能还没有落盘
+func (fw *fileWriter) write(buf []byte, records []Record, lengths []int, forwarded bool) error {
+	req := &writeRequest{
+		buf:       buf,
+		records:   records,
+		lengths:   lengths,
+		forwarded: forwarded,
+		done:      make(chan error, 1),
+	}
+	select {
+	case fw.requests <- req:
+	case <-fw.closed:
+		return errWriterClosed
+	}
+	return <-req.done
+}
+
+// 关闭 stop 后提交剩下的请求并关闭文件
+func (fw *fileWriter) run(stop <-chan struct{}) {
+	defer close(fw.closed)
+
+	var syncC <-chan time.Time
+	if fw.sync.Policy == SyncInterval && fw.sync.Interval > 0 {
+		ticker := time.NewTicker(fw.sync.Interval)
+		defer ticker.Stop()
+		syncC = ticker.C
+	}
+	// 没有新日志写入时也要按时间轮转和清理
+	interval := rotationCheckInterval
+	if rotation.Interval > 0 && rotation.Interval < interval {
+		interval = rotation.Interval
+	}
+	rotationTicker := time.NewTicker(interval)
+	defer rotationTicker.Stop()
+
+	for {
+		select {
+		case req := <-fw.requests:
+			fw.commit(fw.gather(req))
+		case <-syncC:
+			if fw.dirty && fw.f != nil {
+				if err := fw.f.Sync(); err != nil {
+					stlog.Println(err)
+				}
+				fw.dirty = false
+			}
+		case now := <-rotationTicker.C:
+			fw.rotateIfNeeded(0, now)
+			removeExpired(now)
+		case <-stop:
+			// 提交已经在等待的请求
+		drain:
+			for {
+				select {
+				case req := <-fw.requests:
+					fw.commit(fw.gather(req))
+				default:
+					break drain
+				}
+			}
+			if err := fw.close(); err != nil {
+				stlog.Println(err)
+			}
+			closeSinks()
+			return
+		}
+	}
+}
+
+// 在提交上一组的时候到达的请求都在等待, 一起取出来
+func (fw *fileWriter) gather(req *writeRequest) []*writeRequest {
+	group := []*writeRequest{req}
+	for len(group) < maxGroupSize {
+		select {
+		case req := <-fw.requests:
+			group = append(group, req)
+		default:
+			return group
+		}
+	}
+	return group
+}
+
+// 一组请求只写入一次缓冲区, 刷新一次, 最多同步一次, 成功后再加入索引, 查询不会读到没写完的记录
+func (fw *fileWriter) commit(group []*writeRequest) {
+	size := 0
+	for _, req := range group {
+		size += len(req.buf)
+	}
+	fw.rotateIfNeeded(size, time.Now())
+
+	var err error
+	if fw.f == nil {
+		err = fw.open()
+	}
+	for _, req := range group {
+		if err != nil {
+			break
+		}
+		_, err = fw.w.Write(req.buf)
+	}
+	if err == nil {
+		err = fw.w.Flush()
+	}
+	if err == nil {
+		if fw.sync.Policy == SyncAlways {
+			err = fw.f.Sync()
+		} else {
+			fw.dirty = true
+		}
+	}
+
+	if err != nil {
+		stlog.Println(err)
+		// 丢弃缓冲区中没写出去的数据, 已经写出去多少以文件大小为准
+		if fw.f != nil {
+			fw.w.Reset(fw.f)
+		}
+		index.resize()
+	} else {
+		for _, req := range group {
+			first := index.append(req.records, req.lengths)
+			streams.publish(first, req.records)
+			publishToSinks(req.records, req.forwarded)
+		}
+	}
+	for _, req := range group {
+		req.done <- err
+	}
+}
@@ -0,0 +1,191 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 很多客户端同时写入时, 每种同步策略下持续写入的速度
+// 每次写入和一个客户端的一批相同, 10 条记录
+func BenchmarkWrite(b *testing.B) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		b.Run(policy.String(), func(b *testing.B) {
+			benchmarkWrite(b, Sync{Policy: policy, Interval: DefaultSync.Interval})
+		})
+	}
+}
+
+func benchmarkWrite(b *testing.B, sync Sync) {
+	const batch = 10
+
+	dst := filepath.Join(b.TempDir(), "distributed.log")
+	index = newLogIndex()
+	rotation, retention = Rotation{}, Retention{}
+	if err := openSegments(dst); err != nil {
+		b.Fatal(err)
+	}
+	out = newFileWriter(dst, sync)
+	if err := out.open(); err != nil {
+		b.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go out.run(stop)
+	defer func() {
+		close(stop)
+		<-out.closed
+	}()
+
+	// 每个 CPU 16 个客户端
+	b.SetParallelism(16)
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		records := make([]Record, batch)
+		for i := range records {
+			records[i] = Record{
+				Time:    time.Now(),
+				Level:   LevelInfo,
+				Service: "BenchService",
+				Message: fmt.Sprintf("benchmark record %d", i),
+				Fields:  map[string]interface{}{"request": i},
+			}
+		}
+		for pb.Next() {
+			if err := write(records, false); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*batch)/time.Since(start).Seconds(), "records/s")
+}
+
+// 文件中的记录, 从旧到新
+func readLog(t *testing.T, path string) []Record {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []Record
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		var r Record
+		if !strings.HasSuffix(line, "\n") || json.Unmarshal([]byte(line), &r) != nil {
+			t.Fatalf("incomplete line %q", line)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// 很多客户端同时写入时, 返回之前记录已经写到文件里, 每个请求的记录连续并且顺序不变,
+// 同一个客户端的请求按发送的顺序写入, 索引中的顺序和文件中的一样
+func TestGroupCommit(t *testing.T) {
+	const (
+		writers  = 8
+		requests = 20
+		batch    = 5
+	)
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		t.Run(policy.String(), func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "distributed.log")
+			index = newLogIndex()
+			stop, err := Run(dst, Rotation{}, Retention{}, Sync{Policy: policy, Interval: 10 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, writers)
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < requests; i++ {
+						records := make([]Record, batch)
+						for j := range records {
+							records[j] = Record{
+								Time:    time.Now(),
+								Level:   LevelInfo,
+								Service: fmt.Sprint("writer-", w),
+								Message: fmt.Sprintf("%d-%d", i, j),
+							}
+						}
+						if err := write(records, false); err != nil {
+							errs <- err
+							return
+						}
+						// 返回时最后一条记录已经在文件中
+						last := records[batch-1]
+						data, err := ioutil.ReadFile(dst)
+						if err != nil {
+							errs <- err
+							return
+						}
+						found := false
+						for _, line := range strings.Split(string(data), "\n") {
+							found = found || (strings.Contains(line, fmt.Sprintf(`"Service":%q`, last.Service)) &&
+								strings.Contains(line, fmt.Sprintf(`"Message":%q`, last.Message)))
+						}
+						if !found {
+							errs <- fmt.Errorf("%s %s not in the file after write returned", last.Service, last.Message)
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			if err := stop(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := write([]Record{{Message: "late"}}, false); err != errWriterClosed {
+				t.Errorf("write after stop = %v, want %v", err, errWriterClosed)
+			}
+
+			records := readLog(t, dst)
+			if len(records) != writers*requests*batch {
+				t.Fatalf("%d records in the file, want %d", len(records), writers*requests*batch)
+			}
+			next := make(map[string]int)
+			for k := 0; k < len(records); k += batch {
+				service := records[k].Service
+				for j := 0; j < batch; j++ {
+					r := records[k+j]
+					if want := fmt.Sprintf("%d-%d", next[service], j); r.Service != service || r.Message != want {
+						t.Fatalf("record %d is %s %s, want %s %s", k+j, r.Service, r.Message, service, want)
+					}
+				}
+				next[service]++
+			}
+
+			indexed, seqs, _, err := index.after(logQuery{}, 0, len(records)+1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(indexed) != len(records) {
+				t.Fatalf("%d records in the index, want %d", len(indexed), len(records))
+			}
+			for i := range indexed {
+				if seqs[i] != i || indexed[i].Service != records[i].Service || indexed[i].Message != records[i].Message {
+					t.Fatalf("index entry %d is %d %s %s, want %s %s", i, seqs[i],
+						indexed[i].Service, indexed[i].Message, records[i].Service, records[i].Message)
+				}
+			}
+		})
+	}
+}
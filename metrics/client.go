@@ -0,0 +1,191 @@
+// 服务内部的指标, 通过 /metrics 以 JSON 的形式提供给指标服务采集
+
+package metrics
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RequestsTotal   = "http_requests_total"
+	ErrorsTotal     = "http_request_errors_total"
+	RequestDuration = "http_request_duration_seconds"
+)
+
+// 请求耗时直方图的默认桶, 单位为秒
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	bounds []float64
+	// 每个桶的数量, 最后一个是 +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// 一次采集的结果
+type Snapshot struct {
+	Time       time.Time
+	Counters   map[string]float64
+	Histograms map[string]HistogramSnapshot
+}
+
+type HistogramSnapshot struct {
+	// 桶的上界, 不包含最后的 +Inf
+	Bounds []float64
+	// 累计数量, Counts[i] 是小于等于 Bounds[i] 的观测数量, 最后一个是全部
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+type collector struct {
+	lock       sync.Mutex
+	counters   map[string]float64
+	histograms map[string]*histogram
+}
+
+var col = &collector{
+	counters:   make(map[string]float64),
+	histograms: make(map[string]*histogram),
+}
+
+// 计数器只能增加, delta 小于 0 时忽略
+func IncCounter(name string, delta float64) {
+	if delta < 0 {
+		return
+	}
+	col.lock.Lock()
+	defer col.lock.Unlock()
+
+	col.counters[name] += delta
+}
+
+// 记录一次观测值, 第一次使用时用 DefaultBuckets 创建直方图
+func Observe(name string, value float64) {
+	col.lock.Lock()
+	defer col.lock.Unlock()
+
+	h, ok := col.histograms[name]
+	if !ok {
+		h = &histogram{
+			bounds: DefaultBuckets,
+			counts: make([]uint64, len(DefaultBuckets)+1),
+		}
+		col.histograms[name] = h
+	}
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+func TakeSnapshot() Snapshot {
+	col.lock.Lock()
+	defer col.lock.Unlock()
+
+	s := Snapshot{
+		Time:       time.Now(),
+		Counters:   make(map[string]float64, len(col.counters)),
+		Histograms: make(map[string]HistogramSnapshot, len(col.histograms)),
+	}
+	for name, v := range col.counters {
+		s.Counters[name] = v
+	}
+	for name, h := range col.histograms {
+		hs := HistogramSnapshot{
+			Bounds: h.bounds,
+			Counts: make([]uint64, len(h.counts)),
+			Sum:    h.sum,
+			Count:  h.count,
+		}
+		var cumulative uint64
+		for i, c := range h.counts {
+			cumulative += c
+			hs.Counts[i] = cumulative
+		}
+		s.Histograms[name] = hs
+	}
+	return s
+}
+
+var (
+	ignoredLock sync.RWMutex
+	ignored     = []string{"/metrics"}
+)
+
+// 这些路径以及它们下面的路径的请求不计入指标, 例如心跳检查
+func Ignore(paths ...string) {
+	ignoredLock.Lock()
+	defer ignoredLock.Unlock()
+
+	ignored = append(ignored, paths...)
+}
+
+func isIgnored(path string) bool {
+	ignoredLock.RLock()
+	defer ignoredLock.RUnlock()
+
+	for _, p := range ignored {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 记录请求数量, 5xx 的数量和请求耗时
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isIgnored(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r)
+
+		IncCounter(RequestsTotal, 1)
+		if sr.status >= http.StatusInternalServerError {
+			IncCounter(ErrorsTotal, 1)
+		}
+		Observe(RequestDuration, time.Since(start).Seconds())
+	})
+}
+
+// GET /metrics 返回当前的指标, 每个服务启动时都会注册
+func RegisterEndpoint() {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(TakeSnapshot()); err != nil {
+			log.Println(err)
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package metrics
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 文件头: 下一个写入位置和已写入的数量
+	ringHeaderSize = 16
+	// 每个点: unix 纳秒时间戳和值
+	ringPointSize = 16
+)
+
+// 一个时间点上的值
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// 一条时间序列的标识
+type SeriesKey struct {
+	Service  string
+	Instance string
+	Metric   string
+}
+
+func (k SeriesKey) fileName() string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(k.Service+"\x00"+k.Instance+"\x00"+k.Metric)))
+}
+
+// 容量为 0 时无法保存任何点
+var errZeroCapacity = errors.New("capacity must be greater than 0")
+
+// 保存在磁盘上的定长环形缓冲区, 写满后覆盖最旧的点
+// 只在读写时打开文件, 序列很多 (每个实例几十条) 时也不会一直占用文件描述符
+type ring struct {
+	lock     sync.Mutex
+	path     string
+	capacity uint64
+	next     uint64
+	count    uint64
+}
+
+func openRing(path string, capacity uint64) (*ring, error) {
+	if capacity == 0 {
+		return nil, errZeroCapacity
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &ring{path: path, capacity: capacity}
+
+	header := make([]byte, ringHeaderSize)
+	if n, _ := f.ReadAt(header, 0); n == ringHeaderSize {
+		r.next = binary.LittleEndian.Uint64(header[0:8])
+		r.count = binary.LittleEndian.Uint64(header[8:16])
+	}
+	// 容量变小之后旧数据无法对应, 直接丢弃
+	if r.next >= capacity || r.count > capacity {
+		r.next, r.count = 0, 0
+	}
+	return r, nil
+}
+
+func (r *ring) append(p Point) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, ringPointSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(p.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[8:16], math.Float64bits(p.Value))
+	if _, err := f.WriteAt(buf, ringHeaderSize+int64(r.next)*ringPointSize); err != nil {
+		return err
+	}
+
+	next, count := (r.next+1)%r.capacity, r.count
+	if count < r.capacity {
+		count++
+	}
+	header := make([]byte, ringHeaderSize)
+	binary.LittleEndian.PutUint64(header[0:8], next)
+	binary.LittleEndian.PutUint64(header[8:16], count)
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	r.next, r.count = next, count
+	return nil
+}
+
+// 返回 [start, end] 范围内的点, 按时间排序
+func (r *ring) read(start, end time.Time) ([]Point, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.count == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, r.count*ringPointSize)
+	if _, err := f.ReadAt(buf, ringHeaderSize); err != nil {
+		return nil, err
+	}
+
+	var points []Point
+	for i := uint64(0); i < r.count; i++ {
+		rec := buf[i*ringPointSize : (i+1)*ringPointSize]
+		t := time.Unix(0, int64(binary.LittleEndian.Uint64(rec[0:8])))
+		if t.Before(start) || t.After(end) {
+			continue
+		}
+		points = append(points, Point{
+			Time:  t,
+			Value: math.Float64frombits(binary.LittleEndian.Uint64(rec[8:16])),
+		})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+	return points, nil
+}
+
+// 所有时间序列, 每条序列一个 .ring 文件和一个记录标识的 .json 文件
+type storage struct {
+	dir      string
+	capacity uint64
+
+	lock   sync.RWMutex
+	series map[SeriesKey]*ring
+}
+
+func openStorage(dir string, capacity uint64) (*storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &storage{
+		dir:      dir,
+		capacity: capacity,
+		series:   make(map[SeriesKey]*ring),
+	}
+
+	// 重启后从 .json 文件恢复已有的序列
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var key SeriesKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			continue
+		}
+		r, err := openRing(strings.TrimSuffix(file, ".json")+".ring", capacity)
+		if err != nil {
+			return nil, err
+		}
+		s.series[key] = r
+	}
+	return s, nil
+}
+
+func (s *storage) append(key SeriesKey, p Point) error {
+	s.lock.RLock()
+	r, ok := s.series[key]
+	s.lock.RUnlock()
+
+	if !ok {
+		s.lock.Lock()
+		if r, ok = s.series[key]; !ok {
+			base := filepath.Join(s.dir, key.fileName())
+			data, err := json.Marshal(key)
+			if err != nil {
+				s.lock.Unlock()
+				return err
+			}
+			if err := ioutil.WriteFile(base+".json", data, 0600); err != nil {
+				s.lock.Unlock()
+				return err
+			}
+			if r, err = openRing(base+".ring", s.capacity); err != nil {
+				s.lock.Unlock()
+				return err
+			}
+			s.series[key] = r
+		}
+		s.lock.Unlock()
+	}
+	return r.append(p)
+}
+
+// 返回满足条件的序列, 空字符串表示不限制
+func (s *storage) find(service, metric string) []SeriesKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var keys []SeriesKey
+	for key := range s.series {
+		if (service == "" || key.Service == service) && (metric == "" || key.Metric == metric) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Metric != keys[j].Metric {
+			return keys[i].Metric < keys[j].Metric
+		}
+		return keys[i].Instance < keys[j].Instance
+	})
+	return keys
+}
+
+func (s *storage) read(key SeriesKey, start, end time.Time) ([]Point, error) {
+	s.lock.RLock()
+	r, ok := s.series[key]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return r.read(start, end)
+}
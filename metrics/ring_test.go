@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity uint64
+		appended int
+		// 重新打开时的容量, 变小之后旧数据被丢弃
+		reopen uint64
+		want   []float64
+	}{
+		{"empty", 3, 0, 3, nil},
+		{"partial", 3, 2, 3, []float64{0, 1}},
+		{"full", 3, 3, 3, []float64{0, 1, 2}},
+		{"wrapped", 3, 5, 3, []float64{2, 3, 4}},
+		{"larger capacity", 3, 5, 10, []float64{2, 3, 4}},
+		{"smaller capacity", 5, 4, 2, nil},
+	}
+	base := time.Unix(1000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "series.ring")
+			r, err := openRing(path, tt.capacity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.appended; i++ {
+				if err := r.append(Point{Time: base.Add(time.Duration(i) * time.Second), Value: float64(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r, err = openRing(path, tt.reopen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			points, err := r.read(base, base.Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []float64
+			for _, p := range points {
+				got = append(got, p.Value)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("points = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := openRing(filepath.Join(t.TempDir(), "zero.ring"), 0); err != errZeroCapacity {
+		t.Errorf("openRing with capacity 0 error = %v, want %v", err, errZeroCapacity)
+	}
+}
+
+// 序列很多时不会一直占用文件描述符
+func TestStorageFileDescriptors(t *testing.T) {
+	before, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot count open files:", err)
+	}
+
+	s, err := openStorage(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		key := SeriesKey{Service: "TestService", Instance: "instance", Metric: fmt.Sprintf("metric_%d", i)}
+		if err := s.append(key, Point{Time: time.Now(), Value: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) > len(before)+5 {
+		t.Errorf("%d files open after writing 200 series, %d before", len(after), len(before))
+	}
+}
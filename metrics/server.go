@@ -0,0 +1,424 @@
+// 指标服务, 定期从注册中心发现所有实例并采集它们的 /metrics, 保存到磁盘上的环形缓冲区,
+// 按服务提供范围查询和简单的聚合 (sum, rate, 分位数)
+
+package metrics
+
+import (
+	"distributed/registry"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 每条序列保存的点数, 默认 5 秒采集一次时可以保存 6 小时
+const DefaultCapacity = 4320
+
+// 实例是否可以采集, 1 表示可以, 0 表示不可以
+const upMetric = "up"
+
+type scraper struct {
+	interval time.Duration
+	store    *storage
+	client   *http.Client
+}
+
+var scr *scraper
+
+// 打开 dir 中的数据, 每隔 interval 采集一次所有实例, 直到 stop 被关闭
+func Run(dir string, interval time.Duration, capacity uint64, stop <-chan struct{}) error {
+	if capacity == 0 {
+		return errZeroCapacity
+	}
+	if interval <= 0 {
+		return fmt.Errorf("scrape interval must be positive, got %v", interval)
+	}
+	store, err := openStorage(dir, capacity)
+	if err != nil {
+		return err
+	}
+	scr = &scraper{
+		interval: interval,
+		store:    store,
+		client:   &http.Client{Timeout: interval},
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			scr.scrapeAll()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *scraper) scrapeAll() {
+	instances, err := registry.ListServices()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		// 正在停止的实例不再采集, 它的序列停在停止之前
+		if instance.Draining {
+			continue
+		}
+		wg.Add(1)
+		go func(instance registry.Registration) {
+			defer wg.Done()
+			s.scrape(instance)
+		}(instance)
+	}
+	wg.Wait()
+}
+
+func (s *scraper) scrape(instance registry.Registration) {
+	now := time.Now()
+	key := func(metric string) SeriesKey {
+		return SeriesKey{
+			Service:  string(instance.ServiceName),
+			Instance: instance.ID,
+			Metric:   metric,
+		}
+	}
+	store := func(metric string, v float64) {
+		if err := s.store.append(key(metric), Point{Time: now, Value: v}); err != nil {
+			log.Println(err)
+		}
+	}
+
+	snapshot, err := s.fetch(instance.ServiceURL)
+	if err != nil {
+		store(upMetric, 0)
+		return
+	}
+	store(upMetric, 1)
+
+	for name, v := range snapshot.Counters {
+		store(name, v)
+	}
+	for name, h := range snapshot.Histograms {
+		for i, c := range h.Counts {
+			le := "+Inf"
+			if i < len(h.Bounds) {
+				le = strconv.FormatFloat(h.Bounds[i], 'g', -1, 64)
+			}
+			store(bucketMetric(name, le), float64(c))
+		}
+		store(name+"_sum", h.Sum)
+		store(name+"_count", float64(h.Count))
+	}
+}
+
+func bucketMetric(name, le string) string {
+	return fmt.Sprintf("%s_bucket{le=%q}", name, le)
+}
+
+func (s *scraper) fetch(serviceURL string) (*Snapshot, error) {
+	res, err := s.client.Get(strings.TrimSuffix(serviceURL, "/") + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metrics endpoint of %s responded with code %v", serviceURL, res.StatusCode)
+	}
+	var snapshot Snapshot
+	if err := json.NewDecoder(res.Body).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// 查询参数
+type query struct {
+	service string
+	metric  string
+	// sum, rate 或者分位数
+	agg      string
+	quantile float64
+	start    time.Time
+	end      time.Time
+	step     time.Duration
+}
+
+func parseTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), nil
+}
+
+func parseQuery(r *http.Request, interval time.Duration) (query, error) {
+	values := r.URL.Query()
+	q := query{
+		service: values.Get("service"),
+		metric:  values.Get("metric"),
+		agg:     values.Get("agg"),
+	}
+	if q.service == "" || q.metric == "" {
+		return q, fmt.Errorf("service and metric are required")
+	}
+
+	var err error
+	now := time.Now()
+	if q.end, err = parseTime(values.Get("end"), now); err != nil {
+		return q, err
+	}
+	if q.start, err = parseTime(values.Get("start"), q.end.Add(-time.Hour)); err != nil {
+		return q, err
+	}
+	q.step = interval * 6
+	if step := values.Get("step"); step != "" {
+		if q.step, err = time.ParseDuration(step); err != nil {
+			return q, err
+		}
+	}
+	if q.step <= 0 || !q.start.Before(q.end) {
+		return q, fmt.Errorf("invalid range")
+	}
+	if q.end.Sub(q.start)/q.step > 10000 {
+		return q, fmt.Errorf("too many points, increase step")
+	}
+
+	switch {
+	case q.agg == "" || q.agg == "sum":
+		q.agg = "sum"
+	case q.agg == "rate":
+	case strings.HasPrefix(q.agg, "p"):
+		// p50, p95, p99.9
+		p, err := strconv.ParseFloat(q.agg[1:], 64)
+		if err != nil || p <= 0 || p >= 100 {
+			return q, fmt.Errorf("invalid percentile %q", q.agg)
+		}
+		q.quantile = p / 100
+	default:
+		return q, fmt.Errorf("unknown aggregation %q", q.agg)
+	}
+	return q, nil
+}
+
+// 不超过 t 的最后一个点, 超过 staleness 的点视为不存在
+func valueAt(points []Point, t time.Time, staleness time.Duration) (float64, bool) {
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Time.After(t)
+	})
+	if i == 0 || t.Sub(points[i-1].Time) > staleness {
+		return 0, false
+	}
+	return points[i-1].Value, true
+}
+
+// 计数器在 [t-step, t] 之间的增量, 计数器被重置 (服务重启) 时使用当前值
+func increase(points []Point, t time.Time, step, staleness time.Duration) (float64, bool) {
+	cur, ok := valueAt(points, t, staleness)
+	if !ok {
+		return 0, false
+	}
+	prev, ok := valueAt(points, t.Add(-step), staleness)
+	if !ok {
+		return 0, false
+	}
+	if cur < prev {
+		return cur, true
+	}
+	return cur - prev, true
+}
+
+func (s *scraper) evaluate(q query) ([]Point, error) {
+	staleness := s.interval * 3
+	if q.step > staleness {
+		staleness = q.step
+	}
+	// 计算 rate 和分位数需要 start 之前一个 step 的数据
+	from := q.start.Add(-q.step - staleness)
+
+	load := func(metric string) ([][]Point, error) {
+		var series [][]Point
+		for _, key := range s.store.find(q.service, metric) {
+			points, err := s.store.read(key, from, q.end)
+			if err != nil {
+				return nil, err
+			}
+			series = append(series, points)
+		}
+		return series, nil
+	}
+
+	var result []Point
+	switch q.agg {
+	case "sum", "rate":
+		series, err := load(q.metric)
+		if err != nil {
+			return nil, err
+		}
+		for t := q.start; !t.After(q.end); t = t.Add(q.step) {
+			total, found := 0.0, false
+			for _, points := range series {
+				var v float64
+				var ok bool
+				if q.agg == "sum" {
+					v, ok = valueAt(points, t, staleness)
+				} else {
+					v, ok = increase(points, t, q.step, staleness)
+					v /= q.step.Seconds()
+				}
+				if ok {
+					total += v
+					found = true
+				}
+			}
+			if found {
+				result = append(result, Point{Time: t, Value: total})
+			}
+		}
+	default:
+		// 分位数: metric 是直方图的名称, 对每个桶求所有实例的增量, 再在桶之间线性插值
+		buckets := make(map[float64][][]Point)
+		for _, key := range s.store.find(q.service, "") {
+			prefix := q.metric + `_bucket{le="`
+			if !strings.HasPrefix(key.Metric, prefix) {
+				continue
+			}
+			le := strings.TrimSuffix(strings.TrimPrefix(key.Metric, prefix), `"}`)
+			bound := math.Inf(1)
+			if le != "+Inf" {
+				var err error
+				if bound, err = strconv.ParseFloat(le, 64); err != nil {
+					continue
+				}
+			}
+			points, err := s.store.read(key, from, q.end)
+			if err != nil {
+				return nil, err
+			}
+			buckets[bound] = append(buckets[bound], points)
+		}
+		if len(buckets) == 0 {
+			return nil, nil
+		}
+		bounds := make([]float64, 0, len(buckets))
+		for bound := range buckets {
+			bounds = append(bounds, bound)
+		}
+		sort.Float64s(bounds)
+
+		for t := q.start; !t.After(q.end); t = t.Add(q.step) {
+			counts := make([]float64, len(bounds))
+			for i, bound := range bounds {
+				for _, points := range buckets[bound] {
+					if v, ok := increase(points, t, q.step, staleness); ok {
+						counts[i] += v
+					}
+				}
+			}
+			if v, ok := bucketQuantile(q.quantile, bounds, counts); ok {
+				result = append(result, Point{Time: t, Value: v})
+			}
+		}
+	}
+	return result, nil
+}
+
+// 根据累计的桶计数估算分位数, 和 Prometheus 的 histogram_quantile 做法相同
+func bucketQuantile(q float64, bounds, counts []float64) (float64, bool) {
+	if len(counts) == 0 {
+		return 0, false
+	}
+	total := counts[len(counts)-1]
+	if total <= 0 {
+		return 0, false
+	}
+	rank := q * total
+	i := sort.Search(len(counts), func(i int) bool {
+		return counts[i] >= rank
+	})
+	if i == len(counts) {
+		i = len(counts) - 1
+	}
+	// 落在 +Inf 桶里时只能返回最大的有限上界
+	if math.IsInf(bounds[i], 1) {
+		if i == 0 {
+			return 0, false
+		}
+		return bounds[i-1], true
+	}
+
+	lower, below := 0.0, 0.0
+	if i > 0 {
+		lower, below = bounds[i-1], counts[i-1]
+	}
+	inBucket := counts[i] - below
+	if inBucket <= 0 {
+		return bounds[i], true
+	}
+	return lower + (bounds[i]-lower)*(rank-below)/inBucket, true
+}
+
+// GET /metrics/query?service=LibraryService&metric=http_requests_total&agg=rate&start=&end=&step=30s
+// agg 可以是 sum (默认), rate, 或者 p50, p95, p99 这样的分位数 (此时 metric 是直方图的名称)
+// start 和 end 可以是 RFC3339 或者 unix 秒, 默认是最近一小时
+// GET /metrics/series?service=LibraryService 列出保存的序列
+func RegisterHandlers() {
+	http.HandleFunc("/metrics/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q, err := parseQuery(r, scr.interval)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		points, err := scr.evaluate(q)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if points == nil {
+			points = []Point{}
+		}
+		writeJSON(w, points)
+	})
+	http.HandleFunc("/metrics/series", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		keys := scr.store.find(r.URL.Query().Get("service"), r.URL.Query().Get("metric"))
+		if keys == nil {
+			keys = []SeriesKey{}
+		}
+		writeJSON(w, keys)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
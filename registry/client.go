@@ -2,20 +2,29 @@ package registry
 
 import (
 	"bytes"
+	"context"
+	"distributed/trace"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 )
 
-// 用于给 RegistryService 发送一个 POST 请求
-func RegisterService(r Registration) error {
+// 用于给 RegistryService 发送一个 POST 请求, 返回注册中心分配的实例 ID
+func RegisterService(r Registration) (string, error) {
+	if err := r.Validate(); err != nil {
+		return "", err
+	}
+	SetLocality(r.Region, r.Zone)
+
 	heartbeatURL, err := url.Parse(r.HeartbeatURL)
 	if err != nil {
-		return err
+		return "", err
 	}
 	http.HandleFunc(heartbeatURL.Path, func(w http.ResponseWriter, r *http.Request) {
 		// 如果是生产环境一般还会返回 CPU MEM 等其他信息
@@ -24,29 +33,129 @@ func RegisterService(r Registration) error {
 
 	serviceUpdateURL, err := url.Parse(r.ServiceUpdateURL)
 	if err != nil {
-		return err
+		return "", err
 	}
 	http.Handle(serviceUpdateURL.Path, &serviceUpdateHandler{})
 
+	id, err := register(r)
+	if err != nil {
+		return "", err
+	}
+	r.ID = id
+	registeredService.lock.Lock()
+	registeredService.reg = r
+	registeredService.lock.Unlock()
+	return id, nil
+}
+
+// 通过注册中心注册的本服务, 用于运行时增加依赖的服务
+var registeredService struct {
+	lock sync.Mutex
+	reg  Registration
+}
+
+func register(r Registration) (string, error) {
 	buf := new(bytes.Buffer)
 	enc := json.NewEncoder(buf)
 	if err := enc.Encode(r); err != nil {
-		return err
+		return "", err
 	}
+	data := buf.Bytes()
 
-	res, err := http.Post(ServerURL, "application/json", buf)
+	res, err := sendWithRetry(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, ServerURL, bytes.NewBuffer(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to register service. Registry service"+
-			"responded with code %v", res.StatusCode)
+		msg, _ := ioutil.ReadAll(res.Body)
+		return "", fmt.Errorf("failed to register service. Registry service "+
+			"responded with code %v: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var registered Registration
+	if err := json.NewDecoder(res.Body).Decode(&registered); err != nil {
+		return "", err
+	}
+
+	return registered.ID, nil
+}
+
+// 运行时把 names 加入本服务的可选依赖, 之后可以通过 GetProvider 和 GetProviders 找到它们的实例
+// 注册中心模式下会重新注册, 注册中心把这些服务已有的实例发过来; gossip 模式下从已知的成员中找出它们
+// 用于调度服务这种要调用哪些服务在启动时还不知道的场景
+func RequireServices(names ...ServiceName) error {
+	if g := currentGossip(); g != nil {
+		g.require(names)
+		return nil
 	}
 
+	registeredService.lock.Lock()
+	defer registeredService.lock.Unlock()
+
+	r := registeredService.reg
+	if r.ServiceURL == "" {
+		return fmt.Errorf("service is not registered")
+	}
+	r.RequiredServices, r.OptionalServices = addOptional(r, names)
+	if len(r.RequiredServices) == len(registeredService.reg.RequiredServices) {
+		return nil
+	}
+	if _, err := register(r); err != nil {
+		return err
+	}
+	registeredService.reg = r
 	return nil
 }
 
+// 返回加入 names 之后的 RequiredServices 和 OptionalServices, 已经依赖的服务保持不变
+func addOptional(r Registration, names []ServiceName) ([]ServiceName, []ServiceName) {
+	required := append([]ServiceName(nil), r.RequiredServices...)
+	optional := append([]ServiceName(nil), r.OptionalServices...)
+	for _, name := range names {
+		if name == "" || containsName(required, name) {
+			continue
+		}
+		required = append(required, name)
+		optional = append(optional, name)
+	}
+	return required, optional
+}
+
+// 被注册中心限流时最多尝试的次数
+const registryAttempts = 5
+
+// 发送请求, 收到 429 时按 Retry-After 等待后重试, 每次重试都会重新创建请求
+// 每次尝试都是一个 client span, 追踪上下文会通过 traceparent 传给注册中心
+func sendWithRetry(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		res, err := trace.Do(context.Background(), http.DefaultClient, req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusTooManyRequests || attempt == registryAttempts {
+			return res, nil
+		}
+		res.Body.Close()
+
+		wait := retryAfter(res, time.Second)
+		log.Printf("Registry service is rate limiting, retrying in %v\n", wait)
+		time.Sleep(wait)
+	}
+}
+
 type serviceUpdateHandler struct{}
 
 func (sh *serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -68,81 +177,419 @@ func (sh *serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	prov.Update(p)
 }
 
-// 用于取消服务
+// 用于取消服务, url 可以是服务地址或者实例 ID
 func ShutdownService(url string) error {
-	// http 包中没有单独的 del 函数
-	req, err := http.NewRequest(
-		http.MethodDelete,
-		ServerURL,
-		bytes.NewBuffer([]byte(url)),
-	)
+	res, err := sendWithRetry(func() (*http.Request, error) {
+		// http 包中没有单独的 del 函数
+		req, err := http.NewRequest(
+			http.MethodDelete,
+			ServerURL,
+			bytes.NewBuffer([]byte(url)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "text/plain")
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "text/plain")
-	res, err := http.DefaultClient.Do(req)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to deregister service, Registry "+
+			"service responded with code %v", res.StatusCode)
+	}
+
+	return nil
+}
+
+// 通知注册中心实例即将停止, url 可以是服务地址或者实例 ID
+func MarkDraining(url string) error {
+	res, err := sendWithRetry(func() (*http.Request, error) {
+		req, err := http.NewRequest(
+			http.MethodPost,
+			ServerURL+"/drain",
+			bytes.NewBuffer([]byte(url)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "text/plain")
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to deregister service, Registry "+
+		return fmt.Errorf("failed to mark service as draining, Registry "+
 			"service responded with code %v", res.StatusCode)
 	}
-
 	return nil
 }
 
+// 从注册中心获取所有已注册的实例, 包括正在停止的, 它们的 Draining 为 true, 调用方不应该再把请求发给它们
+func ListServices() ([]Registration, error) {
+	res, err := sendWithRetry(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, ServerURL, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list services, Registry "+
+			"service responded with code %v", res.StatusCode)
+	}
+
+	var regs []Registration
+	if err := json.NewDecoder(res.Body).Decode(&regs); err != nil {
+		return nil, err
+	}
+	return regs, nil
+}
+
 // 被依赖的服务给其他服务使用
 type providers struct {
-	// 一个服务可能有多个 url 因此用 []string
-	services map[ServiceName][]string
+	// 一个服务可能有多个实例, 保存实例的 URL 和所在的区域
+	services map[ServiceName][]patchEntry
 	lock     *sync.RWMutex
+	// 本服务所在的区域, 选择 provider 时优先同一个 zone 的实例
+	region, zone string
+	// 同 zone 的实例少于这个数量时, 按比例把请求分给其他 zone
+	spilloverThreshold int
+	// 服务名称 -> 版本 -> 流量权重, 由注册中心下发
+	traffic map[ServiceName]map[string]int
+	// 每次更新后关闭并重新创建, 用来唤醒等待依赖服务的协程
+	changed chan struct{}
+	// 依赖服务出现 (从无到有) 和消失 (全部下线) 时的回调
+	upHandlers   []func(name ServiceName, url string)
+	downHandlers []func(name ServiceName)
 }
 
 func (p *providers) Update(pat patch) {
 	p.lock.Lock()
-	defer p.lock.Unlock()
 
-	// added
-	for _, patchEntry := range pat.Added {
+	// 记录更新前已有 provider 的服务, 用于判断服务是出现还是消失
+	before := make(map[ServiceName]bool)
+	for name, entries := range p.services {
+		before[name] = len(entries) > 0
+	}
+
+	// added, updated
+	// 已经存在的实例用新的信息替换, 不会重复添加
+	for _, entry := range append(pat.Added, pat.Updated...) {
 		// 如果服务名称不存在
-		if _, ok := p.services[patchEntry.Name]; !ok {
-			p.services[patchEntry.Name] = make([]string, 0)
+		if _, ok := p.services[entry.Name]; !ok {
+			p.services[entry.Name] = make([]patchEntry, 0)
+		}
+		if i := indexOfURL(p.services[entry.Name], entry.URL); i >= 0 {
+			p.services[entry.Name][i] = entry
+		} else {
+			p.services[entry.Name] = append(p.services[entry.Name], entry)
 		}
-		p.services[patchEntry.Name] = append(p.services[patchEntry.Name], patchEntry.URL)
 	}
 
 	// removed
-	for _, patchEntry := range pat.Removed {
+	for _, entry := range pat.Removed {
 		// 如果服务名称存在
-		if providerURLs, ok := p.services[patchEntry.Name]; ok {
-			for i := range providerURLs {
-				if providerURLs[i] == patchEntry.URL {
-					p.services[patchEntry.Name] = append(providerURLs[:i], providerURLs[i+1:]...)
-				}
+		if entries, ok := p.services[entry.Name]; ok {
+			if i := indexOfURL(entries, entry.URL); i >= 0 {
+				p.services[entry.Name] = append(entries[:i], entries[i+1:]...)
+			}
+		}
+	}
+
+	// traffic
+	for name, weights := range pat.Traffic {
+		if len(weights) == 0 {
+			delete(p.traffic, name)
+		} else {
+			p.traffic[name] = weights
+		}
+	}
+
+	// 收集状态发生变化的服务, 回调在释放锁之后执行, 避免回调里再调用 GetProvider 造成死锁
+	type change struct {
+		name ServiceName
+		url  string
+		up   bool
+	}
+	var changes []change
+	for name, entries := range p.services {
+		if !before[name] && len(entries) > 0 {
+			changes = append(changes, change{name: name, url: entries[0].URL, up: true})
+		} else if before[name] && len(entries) == 0 {
+			changes = append(changes, change{name: name})
+		}
+	}
+	upHandlers := p.upHandlers
+	downHandlers := p.downHandlers
+
+	close(p.changed)
+	p.changed = make(chan struct{})
+	p.lock.Unlock()
+
+	for _, c := range changes {
+		if c.up {
+			for _, fn := range upHandlers {
+				fn(c.name, c.url)
 			}
+			continue
+		}
+		for _, fn := range downHandlers {
+			fn(c.name)
+		}
+	}
+}
+
+func indexOfURL(entries []patchEntry, url string) int {
+	for i := range entries {
+		if entries[i].URL == url {
+			return i
 		}
 	}
+	return -1
 }
 
 // 使用服务名称来找到它的 URL
+// 配置了流量权重时先按权重选出一个版本, 再在这个版本的实例中选择
+// 优先选择同一个 zone 的实例, 同 zone 的实例数量低于 spilloverThreshold 时,
+// 按缺少的比例把请求分给同 region 的实例, 同 region 也没有时再分给其他所有实例
 // 偷懒, 本来该返回 []string
-func (p providers) get(name ServiceName) (string, error) {
-	providers, ok := p.services[name]
-	if !ok {
+func (p *providers) get(name ServiceName) (string, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	entries, ok := p.services[name]
+	if !ok || len(entries) == 0 {
 		return "", fmt.Errorf("no providers avaliable for service %v", name)
 	}
+	entries = p.pickVersion(name, withoutDraining(entries))
+
+	// 没有配置区域时不区分
+	if p.zone == "" && p.region == "" {
+		return randomEntry(entries).URL, nil
+	}
+
+	var local, region, remote []patchEntry
+	for _, entry := range entries {
+		switch {
+		case entry.Region == p.region && entry.Zone == p.zone:
+			local = append(local, entry)
+		case entry.Region == p.region:
+			region = append(region, entry)
+		default:
+			remote = append(remote, entry)
+		}
+	}
+
+	threshold := p.spilloverThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	// 同 zone 的容量足够, 或者以 (threshold - 本地数量) / threshold 的概率外溢
+	if len(local) >= threshold ||
+		(len(local) > 0 && rand.Intn(threshold) < len(local)) {
+		return randomEntry(local).URL, nil
+	}
+	if len(region) > 0 {
+		return randomEntry(region).URL, nil
+	}
+	if len(remote) > 0 {
+		return randomEntry(remote).URL, nil
+	}
+	return randomEntry(local).URL, nil
+}
+
+// 按流量权重随机选择一个版本, 返回该版本的实例
+// 没有配置权重, 或者有权重的版本都没有实例时返回所有实例, 调用方需要持有锁
+func (p *providers) pickVersion(name ServiceName, entries []patchEntry) []patchEntry {
+	weights, ok := p.traffic[name]
+	if !ok {
+		return entries
+	}
+
+	// 权重的 key 是规范写法, 实例的版本号可能带 v 前缀
+	byVersion := make(map[string][]patchEntry)
+	total := 0
+	for _, entry := range entries {
+		v := canonicalVersion(entry.Version)
+		if weights[v] <= 0 {
+			continue
+		}
+		if _, ok := byVersion[v]; !ok {
+			total += weights[v]
+		}
+		byVersion[v] = append(byVersion[v], entry)
+	}
+	if total == 0 {
+		return entries
+	}
 
+	n := rand.Intn(total)
+	for v, versionEntries := range byVersion {
+		n -= weights[v]
+		if n < 0 {
+			return versionEntries
+		}
+	}
+	return entries
+}
+
+// 去掉正在停止的实例, 全部都在停止时仍然返回它们, 总比没有好
+func withoutDraining(entries []patchEntry) []patchEntry {
+	var serving []patchEntry
+	for _, entry := range entries {
+		if !entry.Draining {
+			serving = append(serving, entry)
+		}
+	}
+	if len(serving) == 0 {
+		return entries
+	}
+	return serving
+}
+
+func randomEntry(entries []patchEntry) patchEntry {
 	// 偷懒, 本来应该返回 []string 的
-	idx := int(rand.Float32() * float32(len(providers)))
-	return providers[idx], nil
+	idx := int(rand.Float32() * float32(len(entries)))
+	return entries[idx]
+}
+
+// 设置本服务所在的区域, RegisterService 和 JoinGossip 会根据注册信息自动设置
+func SetLocality(region, zone string) {
+	prov.lock.Lock()
+	defer prov.lock.Unlock()
+
+	prov.region, prov.zone = region, zone
+}
+
+// 设置服务各版本之间的流量权重, 通常由注册中心下发, gossip 模式下可以在本地设置
+// weights 为空时取消按版本分流
+func SetTrafficWeights(name ServiceName, weights map[string]int) {
+	prov.Update(patch{Traffic: map[ServiceName]map[string]int{name: weights}})
+}
+
+// 同 zone 至少要有 n 个实例才不会把请求分给其他 zone, 默认为 1
+func SetSpilloverThreshold(n int) {
+	prov.lock.Lock()
+	defer prov.lock.Unlock()
+
+	prov.spilloverThreshold = n
+}
+
+// 返回 names 中目前还没有任何 provider 的服务, 以及下一次更新时会被关闭的 channel
+func (p *providers) missing(names []ServiceName) ([]ServiceName, <-chan struct{}) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var missing []ServiceName
+	for _, name := range names {
+		if len(p.services[name]) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	return missing, p.changed
+}
+
+// 返回 names 中目前还没有任何 provider 的服务
+func MissingProviders(names []ServiceName) []ServiceName {
+	missing, _ := prov.missing(names)
+	return missing
 }
 
 func GetProvider(name ServiceName) (string, error) {
 	return prov.get(name)
 }
 
+// 返回服务的所有 provider, 用于一个失败后换另一个
+// 第一个和 GetProvider 的选择方式相同, 其余的按同 zone, 同 region, 其他的顺序, 同一组内随机
+func GetProviders(name ServiceName) ([]string, error) {
+	first, err := prov.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return prov.failover(name, first), nil
+}
+
+func (p *providers) failover(name ServiceName, first string) []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var local, region, remote []string
+	for _, entry := range withoutDraining(p.services[name]) {
+		switch {
+		case entry.URL == first:
+		case entry.Region == p.region && entry.Zone == p.zone:
+			local = append(local, entry.URL)
+		case entry.Region == p.region:
+			region = append(region, entry.URL)
+		default:
+			remote = append(remote, entry.URL)
+		}
+	}
+	urls := []string{first}
+	for _, group := range [][]string{local, region, remote} {
+		rand.Shuffle(len(group), func(i, j int) {
+			group[i], group[j] = group[j], group[i]
+		})
+		urls = append(urls, group...)
+	}
+	return urls
+}
+
+// 依赖的服务从没有 provider 变为有 provider 时调用 fn, url 为其中一个 provider
+// 需要在 RegisterService 之前设置, 否则会错过注册时下发的第一次更新
+func OnServiceUp(fn func(name ServiceName, url string)) {
+	prov.lock.Lock()
+	defer prov.lock.Unlock()
+
+	prov.upHandlers = append(prov.upHandlers, fn)
+}
+
+// 依赖的服务最后一个 provider 被移除时调用 fn
+func OnServiceDown(fn func(name ServiceName)) {
+	prov.lock.Lock()
+	defer prov.lock.Unlock()
+
+	prov.downHandlers = append(prov.downHandlers, fn)
+}
+
+// 阻塞直到 names 中的每个服务都至少有一个 provider, 或者 ctx 结束
+// 每隔 interval 通过 progress 报告仍在等待的服务, progress 可以为 nil
+func WaitForProviders(
+	ctx context.Context,
+	names []ServiceName,
+	interval time.Duration,
+	progress func(missing []ServiceName),
+) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		missing, changed := prov.missing(names)
+		if len(missing) == 0 {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+			if progress != nil {
+				progress(missing)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("required services %v not available: %w", missing, ctx.Err())
+		}
+	}
+}
+
 var prov = providers{
-	services: make(map[ServiceName][]string),
-	lock:     new(sync.RWMutex),
+	services:           make(map[ServiceName][]patchEntry),
+	lock:               new(sync.RWMutex),
+	changed:            make(chan struct{}),
+	spilloverThreshold: 1,
+	traffic:            make(map[ServiceName]map[string]int),
 }
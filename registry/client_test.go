@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// 用 -race 运行, 更新 provider 视图的同时选择实例不能有数据竞争
+func TestProvidersConcurrentAccess(t *testing.T) {
+	const name = ServiceName("ConcurrentService")
+	entry := func(i int) patchEntry {
+		return patchEntry{
+			ID:      fmt.Sprintf("instance-%d", i),
+			Name:    name,
+			URL:     fmt.Sprintf("http://instance-%d", i),
+			Zone:    fmt.Sprintf("zone-%d", i%2),
+			Version: fmt.Sprintf("1.%d.0", i%3),
+		}
+	}
+	prov.Update(patch{Added: []patchEntry{entry(0)}})
+	defer func() {
+		SetLocality("", "")
+		SetSpilloverThreshold(0)
+		SetTrafficWeights(name, nil)
+		prov.Update(patch{Removed: []patchEntry{entry(0)}})
+	}()
+
+	stop := make(chan struct{})
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			e := entry(i % 10)
+			if i%10 == 0 {
+				// 保留 instance-0, 始终有可用的实例
+				e = entry(1)
+			}
+			prov.Update(patch{Added: []patchEntry{e}})
+			prov.Update(patch{Removed: []patchEntry{e}})
+			SetLocality("", fmt.Sprintf("zone-%d", i%2))
+			SetSpilloverThreshold(i % 3)
+			SetTrafficWeights(name, map[string]int{"1.0.0": 1, fmt.Sprintf("1.%d.0", i%3): 1})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				if _, err := GetProvider(name); err != nil {
+					t.Error(err)
+					return
+				}
+				urls, err := GetProviders(name)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(urls) == 0 {
+					t.Error("GetProviders() returned no urls")
+					return
+				}
+			}
+		}()
+	}
+
+	// 读的协程都结束之后再停止更新
+	wg.Wait()
+	close(stop)
+	<-updated
+}
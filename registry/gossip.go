@@ -0,0 +1,645 @@
+// 不依赖注册中心的服务发现方式, 服务之间通过 SWIM 协议组成 gossip 集群
+// 每个服务定期随机探测一个成员, 探测失败时请其他成员代为探测 (indirect probe),
+// 仍然失败则把成员标记为疑似下线 (suspect), 超时后标记为下线 (dead)
+// 成员状态的变化附带在探测消息里传播 (dissemination), 并转换成 patch 交给本地的 providers
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 每一轮探测的间隔
+	gossipProbeInterval = time.Second * 1
+	// 等待 ack 的时间
+	gossipProbeTimeout = time.Millisecond * 500
+	// 直接探测失败后, 请多少个成员代为探测
+	gossipIndirectProbes = 3
+	// 疑似下线多久之后确认下线
+	gossipSuspicionTimeout = time.Second * 5
+	// 下线的成员保留多久, 足够把下线的消息传播出去, 之后从成员表中删除
+	gossipDeadTimeout = time.Second * 30
+	// 每条消息最多附带的状态更新数量
+	gossipMaxPiggyback = 8
+	// 每条状态更新的传播次数为 gossipRetransmitMult * log10(n+1)
+	gossipRetransmitMult = 4
+)
+
+type memberState int
+
+const (
+	stateAlive memberState = iota
+	stateSuspect
+	stateDead
+)
+
+func (s memberState) String() string {
+	switch s {
+	case stateAlive:
+		return "alive"
+	case stateSuspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+// 集群中的一个成员, 也是传播的最小单位
+type member struct {
+	Registration Registration
+	// 只有成员自己可以增加, 用于反驳别人对自己的怀疑
+	Incarnation uint64
+	State       memberState
+}
+
+type gossipMessage struct {
+	// 发送方的实例 ID
+	From string
+	// 附带的状态更新
+	Updates []member
+	// ping-req 时需要代为探测的成员
+	Target *member `json:",omitempty"`
+}
+
+type gossipAck struct {
+	Updates []member
+}
+
+// 等待传播的状态更新
+type broadcast struct {
+	m         member
+	transmits int
+}
+
+type memberInfo struct {
+	member
+	// 被标记为 suspect 的时间
+	suspectAt time.Time
+	// 被标记为 dead 的时间
+	deadAt time.Time
+}
+
+type gossip struct {
+	self  member
+	seeds []string
+
+	lock    sync.Mutex
+	members map[string]*memberInfo
+	queue   []*broadcast
+	// 探测顺序, 每一轮打乱一次, 保证每个成员在有限时间内都会被探测到
+	probeOrder []string
+	probeIdx   int
+
+	client *http.Client
+	// ping-req 需要等待对方再去探测目标, 超时时间更长
+	indirectClient *http.Client
+	stop           chan struct{}
+	done           chan struct{}
+}
+
+var (
+	gsp *gossip
+	// JoinGossip 和服务停止时的 DrainGossip, LeaveGossip 在不同的协程中调用
+	gspLock sync.Mutex
+)
+
+func currentGossip() *gossip {
+	gspLock.Lock()
+	defer gspLock.Unlock()
+
+	return gsp
+}
+
+// 以 gossip 方式加入集群, seeds 是集群中已有成员的 ServiceURL
+// 没有可用的 seed 时先以单节点运行, 之后每一轮都会重新尝试加入
+func JoinGossip(r Registration, seeds []string) (string, error) {
+	if err := r.Validate(); err != nil {
+		return "", err
+	}
+	gspLock.Lock()
+	defer gspLock.Unlock()
+	if gsp != nil {
+		return "", fmt.Errorf("already joined gossip cluster as %s", gsp.self.Registration.ID)
+	}
+	r.ID = InstanceID(r.ServiceURL)
+	r.parseVersions()
+	SetLocality(r.Region, r.Zone)
+
+	serviceURL, err := url.Parse(r.ServiceURL)
+	if err != nil {
+		return "", err
+	}
+
+	g := &gossip{
+		self:           member{Registration: r, State: stateAlive},
+		members:        make(map[string]*memberInfo),
+		client:         &http.Client{Timeout: gossipProbeTimeout},
+		indirectClient: &http.Client{Timeout: gossipProbeTimeout * 2},
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	for _, seed := range seeds {
+		seed = strings.TrimSuffix(seed, "/")
+		if seed != "" && seed != r.ServiceURL {
+			g.seeds = append(g.seeds, seed)
+		}
+	}
+
+	http.Handle(strings.TrimSuffix(serviceURL.Path, "/")+"/gossip/", g)
+
+	gsp = g
+	g.join()
+	go g.run()
+
+	return r.ID, nil
+}
+
+// 通知集群自己即将停止, 其他成员不再把新的请求发给自己
+func DrainGossip() error {
+	g := currentGossip()
+	if g == nil {
+		return fmt.Errorf("not in a gossip cluster")
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.self.Registration.Draining {
+		g.self.Registration.Draining = true
+		g.self.Incarnation++
+		g.enqueue(g.self)
+	}
+	return nil
+}
+
+// 通知集群自己主动下线, 并停止探测
+func LeaveGossip() error {
+	g := currentGossip()
+	if g == nil {
+		return fmt.Errorf("not in a gossip cluster")
+	}
+
+	g.lock.Lock()
+	g.self.State = stateDead
+	g.enqueue(g.self)
+	targets := g.randomMembers(gossipIndirectProbes, "")
+	g.lock.Unlock()
+
+	close(g.stop)
+	<-g.done
+
+	// 主动把下线消息发给几个成员, 由它们继续传播
+	for _, target := range targets {
+		if _, err := g.send(target, "ping", g.message(nil)); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+func gossipURL(r Registration, action string) string {
+	return strings.TrimSuffix(r.ServiceURL, "/") + "/gossip/" + action
+}
+
+// 向 seed 请求完整的成员列表
+func (g *gossip) join() bool {
+	for _, seed := range g.seeds {
+		g.lock.Lock()
+		self := g.self
+		g.lock.Unlock()
+
+		data, err := json.Marshal(self)
+		if err != nil {
+			log.Println(err)
+			return false
+		}
+		res, err := g.client.Post(seed+"/gossip/join", "application/json", bytes.NewBuffer(data))
+		if err != nil {
+			continue
+		}
+		var ack gossipAck
+		err = json.NewDecoder(res.Body).Decode(&ack)
+		res.Body.Close()
+		if err != nil || res.StatusCode != http.StatusOK {
+			continue
+		}
+
+		g.apply(ack.Updates)
+		log.Printf("Joined gossip cluster through %s\n", seed)
+		return true
+	}
+	return false
+}
+
+func (g *gossip) run() {
+	defer close(g.done)
+
+	ticker := time.NewTicker(gossipProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-g.stop:
+			return
+		}
+
+		g.expireSuspects()
+		g.reapDead()
+
+		target, ok := g.nextTarget()
+		if !ok {
+			// 还是单节点, 继续尝试通过 seed 加入集群
+			g.join()
+			continue
+		}
+		g.probe(target)
+	}
+}
+
+// 探测一个成员: 先直接 ping, 失败后请其他成员 ping-req, 都失败则标记为 suspect
+func (g *gossip) probe(target member) {
+	if ack, err := g.send(target.Registration, "ping", g.message(nil)); err == nil {
+		g.apply(ack.Updates)
+		return
+	}
+
+	g.lock.Lock()
+	helpers := g.randomMembers(gossipIndirectProbes, target.Registration.ID)
+	g.lock.Unlock()
+
+	acks := make(chan *gossipAck, len(helpers))
+	for _, helper := range helpers {
+		go func(helper Registration) {
+			ack, err := g.send(helper, "ping-req", g.message(&target))
+			if err != nil {
+				ack = nil
+			}
+			acks <- ack
+		}(helper)
+	}
+	for range helpers {
+		if ack := <-acks; ack != nil {
+			g.apply(ack.Updates)
+			return
+		}
+	}
+
+	log.Printf("Gossip probe failed for %v at %s\n",
+		target.Registration.ServiceName, target.Registration.ServiceURL)
+	target.State = stateSuspect
+	g.apply([]member{target})
+}
+
+// suspect 超时的成员标记为 dead
+func (g *gossip) expireSuspects() {
+	g.lock.Lock()
+	var dead []member
+	for _, m := range g.members {
+		if m.State == stateSuspect && time.Since(m.suspectAt) > gossipSuspicionTimeout {
+			d := m.member
+			d.State = stateDead
+			dead = append(dead, d)
+		}
+	}
+	g.lock.Unlock()
+
+	g.apply(dead)
+}
+
+// 下线超过 gossipDeadTimeout 的成员从成员表中删除, 否则成员表和 join 返回的列表会随着实例的更替一直增长
+// 删除之后再收到旧的 alive 消息会被当作新成员, 所以要等下线的消息传播完
+func (g *gossip) reapDead() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for id, m := range g.members {
+		if m.State == stateDead && time.Since(m.deadAt) > gossipDeadTimeout {
+			delete(g.members, id)
+		}
+	}
+}
+
+// 按打乱后的顺序选择下一个要探测的成员
+func (g *gossip) nextTarget() (member, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for attempts := 0; attempts < 2; attempts++ {
+		for g.probeIdx < len(g.probeOrder) {
+			id := g.probeOrder[g.probeIdx]
+			g.probeIdx++
+			if m, ok := g.members[id]; ok && m.State != stateDead {
+				return m.member, true
+			}
+		}
+
+		// 一轮结束, 重新打乱
+		g.probeOrder = g.probeOrder[:0]
+		for id, m := range g.members {
+			if m.State != stateDead {
+				g.probeOrder = append(g.probeOrder, id)
+			}
+		}
+		rand.Shuffle(len(g.probeOrder), func(i, j int) {
+			g.probeOrder[i], g.probeOrder[j] = g.probeOrder[j], g.probeOrder[i]
+		})
+		g.probeIdx = 0
+	}
+	return member{}, false
+}
+
+// 随机选择最多 n 个未下线的成员, 调用方需要持有锁
+func (g *gossip) randomMembers(n int, exclude string) []Registration {
+	var candidates []Registration
+	for id, m := range g.members {
+		if id != exclude && m.State != stateDead {
+			candidates = append(candidates, m.Registration)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+func (g *gossip) message(target *member) gossipMessage {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return gossipMessage{
+		From:    g.self.Registration.ID,
+		Updates: g.piggyback(),
+		Target:  target,
+	}
+}
+
+func (g *gossip) send(to Registration, action string, msg gossipMessage) (*gossipAck, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	client := g.client
+	if action == "ping-req" {
+		client = g.indirectClient
+	}
+	res, err := client.Post(gossipURL(to, action), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gossip %s to %s responded with code %v", action, to.ServiceURL, res.StatusCode)
+	}
+	var ack gossipAck
+	if err := json.NewDecoder(res.Body).Decode(&ack); err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// 把状态更新放进传播队列, 同一个成员只保留最新的一条, 调用方需要持有锁
+func (g *gossip) enqueue(m member) {
+	for i, b := range g.queue {
+		if b.m.Registration.ID == m.Registration.ID {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			break
+		}
+	}
+	g.queue = append(g.queue, &broadcast{m: m})
+}
+
+// 取出要附带在消息中的状态更新, 传播次数足够的更新会被丢弃, 调用方需要持有锁
+func (g *gossip) piggyback() []member {
+	limit := gossipRetransmitMult * int(math.Ceil(math.Log10(float64(len(g.members)+2))))
+
+	// 传播次数少的优先
+	sort.SliceStable(g.queue, func(i, j int) bool {
+		return g.queue[i].transmits < g.queue[j].transmits
+	})
+	var updates []member
+	var remaining []*broadcast
+	for _, b := range g.queue {
+		if len(updates) < gossipMaxPiggyback && b.transmits < limit {
+			updates = append(updates, b.m)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			remaining = append(remaining, b)
+		}
+	}
+	g.queue = remaining
+	return updates
+}
+
+// 按 SWIM 的规则合并状态更新, 并把可用实例的变化交给本地的 providers
+func (g *gossip) apply(updates []member) {
+	var p patch
+	g.lock.Lock()
+	for _, m := range updates {
+		g.merge(m, &p)
+	}
+	g.lock.Unlock()
+
+	if len(p.Added) > 0 || len(p.Removed) > 0 || len(p.Updated) > 0 {
+		prov.Update(p)
+	}
+}
+
+// 把 names 加入自己的可选依赖, 并把已知的满足条件的成员交给 providers
+func (g *gossip) require(names []ServiceName) {
+	var p patch
+	g.lock.Lock()
+	self := &g.self.Registration
+	required := self.RequiredServices
+	self.RequiredServices, self.OptionalServices = addOptional(*self, names)
+	for _, info := range g.members {
+		entry := newPatchEntry(info.Registration)
+		if info.State != stateDead && !containsName(required, entry.Name) && self.accepts(entry) {
+			p.Added = append(p.Added, entry)
+		}
+	}
+	g.lock.Unlock()
+
+	if len(p.Added) > 0 {
+		prov.Update(p)
+	}
+}
+
+// 调用方需要持有锁
+func (g *gossip) merge(m member, p *patch) {
+	id := m.Registration.ID
+
+	if id == g.self.Registration.ID {
+		switch {
+		case m.State != stateAlive && m.Incarnation >= g.self.Incarnation && g.self.State == stateAlive:
+			// 有人怀疑自己, 提高 incarnation 后广播自己还活着
+			g.self.Incarnation = m.Incarnation + 1
+			g.enqueue(g.self)
+		case m.Incarnation > g.self.Incarnation:
+			// 重启后从 0 开始, 沿用集群里已经传播的 incarnation, 之后的反驳才能生效
+			g.self.Incarnation = m.Incarnation
+		}
+		return
+	}
+
+	existing, ok := g.members[id]
+	if ok && !overrides(m, existing.member) {
+		return
+	}
+
+	wasUp := ok && existing.State != stateDead
+	nowUp := m.State != stateDead
+	info := &memberInfo{member: m}
+	switch m.State {
+	case stateSuspect:
+		info.suspectAt = time.Now()
+		if ok && existing.State == stateSuspect {
+			info.suspectAt = existing.suspectAt
+		}
+	case stateDead:
+		info.deadAt = time.Now()
+	}
+	g.members[id] = info
+	g.enqueue(m)
+
+	if !ok || existing.State != m.State {
+		log.Printf("Gossip member %v at %s is %v\n", m.Registration.ServiceName, m.Registration.ServiceURL, m.State)
+	}
+
+	// 和注册中心一样, 只把自己依赖并且满足版本约束的服务交给 providers
+	self := g.self.Registration
+	entry := newPatchEntry(m.Registration)
+	switch {
+	case !wasUp && nowUp:
+		if self.accepts(entry) {
+			p.Added = append(p.Added, entry)
+		}
+	case wasUp && !nowUp:
+		if self.requires(entry.Name) {
+			p.Removed = append(p.Removed, entry)
+		}
+	case wasUp && nowUp && !existing.Registration.equal(m.Registration):
+		old := newPatchEntry(existing.Registration)
+		if old.Name != entry.Name && self.requires(old.Name) {
+			p.Removed = append(p.Removed, old)
+		}
+		switch {
+		case self.accepts(entry):
+			p.Updated = append(p.Updated, entry)
+		case self.requires(entry.Name):
+			p.Removed = append(p.Removed, entry)
+		}
+	}
+}
+
+// 新的状态是否可以覆盖已知的状态
+func overrides(m member, existing member) bool {
+	switch m.State {
+	case stateAlive:
+		return m.Incarnation > existing.Incarnation
+	case stateSuspect:
+		switch existing.State {
+		case stateAlive:
+			return m.Incarnation >= existing.Incarnation
+		case stateSuspect:
+			return m.Incarnation > existing.Incarnation
+		}
+		return false
+	default:
+		return existing.State != stateDead && m.Incarnation >= existing.Incarnation
+	}
+}
+
+// /gossip/join 新成员加入, 返回完整的成员列表
+// /gossip/ping 探测, 返回 ack
+// /gossip/ping-req 代为探测 Target, 成功时返回 ack
+func (g *gossip) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	action := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	switch action {
+	case "join":
+		var m member
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := m.Registration.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Registration.ID = InstanceID(m.Registration.ServiceURL)
+		m.State = stateAlive
+
+		var p patch
+		g.lock.Lock()
+		// 加入请求来自成员自己, 比别人传播的状态更可信
+		// 重启过的成员 incarnation 从 0 开始, 要超过之前留下的状态才能覆盖 dead
+		if existing, ok := g.members[m.Registration.ID]; ok && m.Incarnation <= existing.Incarnation {
+			m.Incarnation = existing.Incarnation + 1
+		}
+		g.merge(m, &p)
+		ack := gossipAck{Updates: []member{g.self}}
+		for _, info := range g.members {
+			ack.Updates = append(ack.Updates, info.member)
+		}
+		g.lock.Unlock()
+
+		if len(p.Added) > 0 || len(p.Removed) > 0 || len(p.Updated) > 0 {
+			prov.Update(p)
+		}
+		g.writeAck(w, ack)
+	case "ping":
+		var msg gossipMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		g.apply(msg.Updates)
+		g.writeAck(w, gossipAck{Updates: g.message(nil).Updates})
+	case "ping-req":
+		var msg gossipMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.Target == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		g.apply(msg.Updates)
+		ack, err := g.send(msg.Target.Registration, "ping", g.message(nil))
+		if err != nil {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		g.apply(ack.Updates)
+		g.writeAck(w, gossipAck{Updates: g.message(nil).Updates})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (g *gossip) writeAck(w http.ResponseWriter, ack gossipAck) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ack); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func TestGossipOverrides(t *testing.T) {
+	m := func(state memberState, incarnation uint64) member {
+		return member{State: state, Incarnation: incarnation}
+	}
+	tests := []struct {
+		name     string
+		update   member
+		existing member
+		want     bool
+	}{
+		{"alive newer incarnation", m(stateAlive, 2), m(stateAlive, 1), true},
+		{"alive same incarnation", m(stateAlive, 1), m(stateAlive, 1), false},
+		{"alive refutes suspect", m(stateAlive, 2), m(stateSuspect, 1), true},
+		{"alive does not refute suspect of same incarnation", m(stateAlive, 1), m(stateSuspect, 1), false},
+		{"alive revives dead with newer incarnation", m(stateAlive, 2), m(stateDead, 1), true},
+		{"alive does not revive dead", m(stateAlive, 1), m(stateDead, 1), false},
+		{"suspect alive of same incarnation", m(stateSuspect, 1), m(stateAlive, 1), true},
+		{"suspect alive of older incarnation", m(stateSuspect, 0), m(stateAlive, 1), false},
+		{"suspect again", m(stateSuspect, 1), m(stateSuspect, 1), false},
+		{"suspect newer incarnation", m(stateSuspect, 2), m(stateSuspect, 1), true},
+		{"suspect dead", m(stateSuspect, 5), m(stateDead, 1), false},
+		{"dead alive", m(stateDead, 1), m(stateAlive, 1), true},
+		{"dead suspect", m(stateDead, 1), m(stateSuspect, 1), true},
+		{"dead older incarnation", m(stateDead, 0), m(stateAlive, 1), false},
+		{"dead again", m(stateDead, 2), m(stateDead, 1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overrides(tt.update, tt.existing); got != tt.want {
+				t.Errorf("overrides() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestGossip(required ...ServiceName) *gossip {
+	self := Registration{
+		ID:               "self",
+		ServiceName:      "Self",
+		ServiceURL:       "http://self",
+		RequiredServices: required,
+	}
+	return &gossip{
+		self:    member{Registration: self, State: stateAlive},
+		members: make(map[string]*memberInfo),
+	}
+}
+
+func gossipMember(id string, name ServiceName, state memberState, incarnation uint64) member {
+	return member{
+		Registration: Registration{ID: id, ServiceName: name, ServiceURL: "http://" + id},
+		State:        state,
+		Incarnation:  incarnation,
+	}
+}
+
+func TestGossipMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []member
+		update   member
+		// 合并之后的状态, 成员被忽略时和原来一样
+		want        memberState
+		wantAdded   int
+		wantRemoved int
+		wantUpdated int
+	}{
+		{
+			name:      "new required member",
+			update:    gossipMember("a", "Required", stateAlive, 0),
+			want:      stateAlive,
+			wantAdded: 1,
+		},
+		{
+			name:   "new member not required",
+			update: gossipMember("a", "Other", stateAlive, 0),
+			want:   stateAlive,
+		},
+		{
+			name:     "suspect keeps provider",
+			existing: []member{gossipMember("a", "Required", stateAlive, 0)},
+			update:   gossipMember("a", "Required", stateSuspect, 0),
+			want:     stateSuspect,
+		},
+		{
+			name:        "dead removes provider",
+			existing:    []member{gossipMember("a", "Required", stateSuspect, 0)},
+			update:      gossipMember("a", "Required", stateDead, 0),
+			want:        stateDead,
+			wantRemoved: 1,
+		},
+		{
+			name:      "revived with newer incarnation",
+			existing:  []member{gossipMember("a", "Required", stateDead, 1)},
+			update:    gossipMember("a", "Required", stateAlive, 2),
+			want:      stateAlive,
+			wantAdded: 1,
+		},
+		{
+			name:     "stale alive ignored",
+			existing: []member{gossipMember("a", "Required", stateDead, 1)},
+			update:   gossipMember("a", "Required", stateAlive, 1),
+			want:     stateDead,
+		},
+		{
+			name:     "renamed away",
+			existing: []member{gossipMember("a", "Required", stateAlive, 0)},
+			update:   gossipMember("a", "Other", stateAlive, 1),
+			want:     stateAlive,
+			// 旧名称移除, 新名称不需要
+			wantRemoved: 1,
+		},
+		{
+			name:     "draining is an update",
+			existing: []member{gossipMember("a", "Required", stateAlive, 0)},
+			update: func() member {
+				m := gossipMember("a", "Required", stateAlive, 1)
+				m.Registration.Draining = true
+				return m
+			}(),
+			want:        stateAlive,
+			wantUpdated: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGossip("Required")
+			for _, m := range tt.existing {
+				g.members[m.Registration.ID] = &memberInfo{member: m}
+			}
+			var p patch
+			g.merge(tt.update, &p)
+
+			if got := g.members[tt.update.Registration.ID].State; got != tt.want {
+				t.Errorf("state = %v, want %v", got, tt.want)
+			}
+			if len(p.Added) != tt.wantAdded || len(p.Removed) != tt.wantRemoved || len(p.Updated) != tt.wantUpdated {
+				t.Errorf("patch = %+v, want %d added, %d removed, %d updated",
+					p, tt.wantAdded, tt.wantRemoved, tt.wantUpdated)
+			}
+		})
+	}
+}
+
+// 别人对自己的怀疑会被反驳, 更高的 incarnation 会被沿用
+func TestGossipMergeSelf(t *testing.T) {
+	tests := []struct {
+		name        string
+		incarnation uint64
+		update      member
+		want        uint64
+		wantRefuted bool
+	}{
+		{"suspected", 0, gossipMember("self", "Self", stateSuspect, 0), 1, true},
+		{"declared dead", 0, gossipMember("self", "Self", stateDead, 3), 4, true},
+		{"already refuted", 2, gossipMember("self", "Self", stateSuspect, 1), 2, false},
+		{"alive from before restart", 0, gossipMember("self", "Self", stateAlive, 5), 5, false},
+		{"own old alive", 2, gossipMember("self", "Self", stateAlive, 1), 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGossip()
+			g.self.Incarnation = tt.incarnation
+			var p patch
+			g.merge(tt.update, &p)
+			if g.self.Incarnation != tt.want {
+				t.Errorf("incarnation = %d, want %d", g.self.Incarnation, tt.want)
+			}
+			if refuted := len(g.queue) > 0; refuted != tt.wantRefuted {
+				t.Errorf("refuted = %v, want %v", refuted, tt.wantRefuted)
+			}
+			if len(g.members) != 0 {
+				t.Errorf("self added to members")
+			}
+		})
+	}
+}
+
+// 重启后的成员 incarnation 从 0 开始, 通过 join 重新加入时要覆盖之前的 dead
+func TestGossipRejoin(t *testing.T) {
+	g := newTestGossip()
+	restarted := gossipMember("", "Other", stateAlive, 0)
+	restarted.Registration.ServiceURL = "http://restarted"
+	restarted.Registration.ServiceUpdateURL = "http://restarted/services"
+	restarted.Registration.HeartbeatURL = "http://restarted/heartbeat"
+	id := InstanceID(restarted.Registration.ServiceURL)
+	dead := restarted
+	dead.Registration.ID = id
+	dead.State = stateDead
+	dead.Incarnation = 3
+	g.members[id] = &memberInfo{member: dead}
+
+	data, err := json.Marshal(restarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/gossip/join", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("join responded with %d", w.Code)
+	}
+
+	m := g.members[id]
+	if m.State != stateAlive || m.Incarnation != 4 {
+		t.Fatalf("member is %v at incarnation %d, want alive at 4", m.State, m.Incarnation)
+	}
+	var ack gossipAck
+	if err := json.NewDecoder(w.Body).Decode(&ack); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range ack.Updates {
+		if u.Registration.ID == id && u.Incarnation != 4 {
+			t.Errorf("ack has incarnation %d for the member, want 4", u.Incarnation)
+		}
+	}
+}
+
+// 运行时加入的依赖, 已知的成员中活着的实例交给 providers
+func TestGossipRequire(t *testing.T) {
+	g := newTestGossip("Required")
+	for _, m := range []member{
+		gossipMember("late-1", "Late", stateAlive, 0),
+		gossipMember("late-2", "Late", stateSuspect, 0),
+		gossipMember("late-3", "Late", stateDead, 0),
+		gossipMember("other", "Other", stateAlive, 0),
+	} {
+		g.members[m.Registration.ID] = &memberInfo{member: m}
+	}
+	defer prov.Update(patch{Removed: []patchEntry{
+		newPatchEntry(g.members["late-1"].Registration),
+		newPatchEntry(g.members["late-2"].Registration),
+	}})
+
+	g.require([]ServiceName{"Late", "Required"})
+	if fmt.Sprint(g.self.Registration.RequiredServices) != "[Required Late]" ||
+		fmt.Sprint(g.self.Registration.OptionalServices) != "[Late]" {
+		t.Fatalf("required %v, optional %v", g.self.Registration.RequiredServices, g.self.Registration.OptionalServices)
+	}
+	urls, err := GetProviders("Late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(urls)
+	if fmt.Sprint(urls) != "[http://late-1 http://late-2]" {
+		t.Errorf("providers = %v, want the alive and suspect members", urls)
+	}
+	if _, err := GetProvider("Other"); err == nil {
+		t.Errorf("service that is not required has providers")
+	}
+}
@@ -0,0 +1,267 @@
+package registry
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个服务实例两次心跳检查之间的间隔
+	heartbeatInterval = time.Second * 3
+	// 在间隔上随机加减的比例, 避免所有实例在同一时刻被检查
+	heartbeatJitter = 0.2
+	// 同时进行心跳检查的协程数量
+	heartbeatWorkers = 16
+	// 单次检查失败后的重试次数和重试间隔
+	heartbeatAttempts   = 3
+	heartbeatRetryDelay = time.Second * 1
+)
+
+// 每个服务实例对应一个心跳任务
+type heartbeatTask struct {
+	reg Registration
+	// 下一次检查的时间
+	next time.Time
+	// 在堆中的位置, 正在被 worker 检查时为 -1
+	index int
+}
+
+// 按下一次检查时间排序的最小堆
+type heartbeatQueue []*heartbeatTask
+
+func (q heartbeatQueue) Len() int           { return len(q) }
+func (q heartbeatQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q heartbeatQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *heartbeatQueue) Push(x interface{}) {
+	task := x.(*heartbeatTask)
+	task.index = len(*q)
+	*q = append(*q, task)
+}
+
+func (q *heartbeatQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	task.index = -1
+	*q = old[:n-1]
+	return task
+}
+
+// 心跳调度器
+// 一个协程按时间顺序把到期的任务分发给固定数量的 worker, 没有到期任务时就睡眠,
+// 所以 CPU 占用只和检查的次数有关, 和注册的实例数量无关
+type heartbeatScheduler struct {
+	interval time.Duration
+	jitter   float64
+	workers  int
+	// 执行一次检查, 返回实例是否健康
+	check func(reg Registration) bool
+
+	lock  sync.Mutex
+	queue heartbeatQueue
+	// 按实例 ID 索引正在调度的任务
+	tasks map[string]*heartbeatTask
+	// 有新任务加入时唤醒调度协程
+	wake chan struct{}
+}
+
+func newHeartbeatScheduler(
+	interval time.Duration,
+	jitter float64,
+	workers int,
+	check func(reg Registration) bool,
+) *heartbeatScheduler {
+	return &heartbeatScheduler{
+		interval: interval,
+		jitter:   jitter,
+		workers:  workers,
+		check:    check,
+		tasks:    make(map[string]*heartbeatTask),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// 在 interval 的基础上加上随机抖动
+func (s *heartbeatScheduler) nextDelay() time.Duration {
+	if s.jitter <= 0 {
+		return s.interval
+	}
+	delta := (rand.Float64()*2 - 1) * s.jitter * float64(s.interval)
+	return s.interval + time.Duration(delta)
+}
+
+// 开始检查一个实例, 已经在调度的实例会被替换
+func (s *heartbeatScheduler) schedule(reg Registration) {
+	s.lock.Lock()
+	if old, ok := s.tasks[reg.ID]; ok && old.index >= 0 {
+		heap.Remove(&s.queue, old.index)
+	}
+	task := &heartbeatTask{
+		reg:  reg,
+		next: time.Now().Add(s.nextDelay()),
+	}
+	s.tasks[reg.ID] = task
+	heap.Push(&s.queue, task)
+	s.lock.Unlock()
+
+	s.notify()
+}
+
+// 停止检查一个实例, 正在进行的检查完成后也不会再被调度
+func (s *heartbeatScheduler) unschedule(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return
+	}
+	delete(s.tasks, id)
+	if task.index >= 0 {
+		heap.Remove(&s.queue, task.index)
+	}
+}
+
+func (s *heartbeatScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 启动调度协程和 worker, 一直运行到 stop 被关闭
+func (s *heartbeatScheduler) run(stop <-chan struct{}) {
+	jobs := make(chan *heartbeatTask)
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range jobs {
+				s.check(task.reg)
+				s.reschedule(task)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(jobs)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		for _, task := range s.due(time.Now()) {
+			select {
+			case jobs <- task:
+			case <-stop:
+				return
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(s.untilNext())
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// 取出所有到期的任务
+func (s *heartbeatScheduler) due(now time.Time) []*heartbeatTask {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var tasks []*heartbeatTask
+	for s.queue.Len() > 0 && !s.queue[0].next.After(now) {
+		tasks = append(tasks, heap.Pop(&s.queue).(*heartbeatTask))
+	}
+	return tasks
+}
+
+// 距离下一个任务到期的时间, 没有任务时等待一个完整的间隔
+func (s *heartbeatScheduler) untilNext() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.queue.Len() == 0 {
+		return s.interval
+	}
+	return time.Until(s.queue[0].next)
+}
+
+// 检查完成后, 如果实例还在调度中就放回堆里
+func (s *heartbeatScheduler) reschedule(task *heartbeatTask) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tasks[task.reg.ID] != task {
+		return
+	}
+	task.next = time.Now().Add(s.nextDelay())
+	heap.Push(&s.queue, task)
+}
+
+// 心跳请求不能无限等待, 否则一个卡住的服务会占住一个 worker
+var heartbeatClient = &http.Client{Timeout: time.Second * 2}
+
+// 对一个实例做心跳检查, 失败时从注册中心暂时移除, 重试成功后再加回来
+// 加回来的是移除时注册中心里的信息, 而不是调度时的快照, 这样 Draining 等状态不会丢失
+func (r *registry) checkHeartbeat(reg Registration) bool {
+	success := true
+	for attemps := 0; attemps < heartbeatAttempts; attemps++ {
+		res, err := heartbeatClient.Get(reg.HeartbeatURL)
+		// 请求失败
+		if err != nil {
+			log.Println(err)
+		} else {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				// 请求成功
+				log.Printf("Heartbeat check passed for %v", reg.ServiceName)
+				// 判断是否有失败过, 失败过则重新把服务添加回 r 中
+				if !success {
+					if err := r.resume(context.Background(), reg.ID); err != nil {
+						log.Println(err)
+					}
+				}
+				return true
+			}
+		}
+
+		// 请求失败继续往下走
+		log.Printf("Heartbeat check failed for %v", reg.ServiceName)
+		if success {
+			success = false
+			r.webhooks.emit(EventHeartbeatFailed, reg)
+			if err := r.suspend(context.Background(), reg.ID); err != nil {
+				// 已经被注销了, 不需要再重试
+				log.Println(err)
+				return false
+			}
+		}
+
+		// 等 1s 重试
+		time.Sleep(heartbeatRetryDelay)
+	}
+	r.forget(reg.ID)
+	return false
+}
@@ -0,0 +1,196 @@
+//go:build !windows
+// +build !windows
+
+package registry
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		jitter   float64
+		min, max time.Duration
+	}{
+		{"no jitter", 0, time.Second, time.Second},
+		{"default jitter", heartbeatJitter, time.Millisecond * 800, time.Millisecond * 1200},
+		{"half", 0.5, time.Millisecond * 500, time.Millisecond * 1500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newHeartbeatScheduler(time.Second, tt.jitter, 1, nil)
+			for i := 0; i < 1000; i++ {
+				if d := s.nextDelay(); d < tt.min || d > tt.max {
+					t.Fatalf("nextDelay() = %v, want between %v and %v", d, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestHeartbeatSchedulerOrder(t *testing.T) {
+	s := newHeartbeatScheduler(time.Second, 0, 1, nil)
+	now := time.Now()
+	// 按和到期时间不同的顺序加入
+	offsets := map[string]time.Duration{
+		"c":       time.Second * 3,
+		"a":       time.Second,
+		"late":    time.Minute,
+		"b":       time.Second * 2,
+		"removed": time.Second * 2,
+	}
+	for id, offset := range offsets {
+		task := &heartbeatTask{reg: Registration{ID: id}, next: now.Add(offset)}
+		s.tasks[id] = task
+		heap.Push(&s.queue, task)
+	}
+	s.unschedule("removed")
+
+	due := s.due(now.Add(time.Second * 10))
+	var got []string
+	for _, task := range due {
+		got = append(got, task.reg.ID)
+	}
+	if fmt.Sprint(got) != "[a b c]" {
+		t.Fatalf("due = %v, want [a b c]", got)
+	}
+	if d := s.untilNext(); d < time.Second*49 || d > time.Minute {
+		t.Errorf("untilNext() = %v, want about 50s", d)
+	}
+
+	// 检查期间被取消的任务不会被放回堆里
+	s.unschedule("b")
+	for _, task := range due {
+		s.reschedule(task)
+	}
+	if s.queue.Len() != 3 {
+		t.Fatalf("queue has %d tasks, want 3", s.queue.Len())
+	}
+	for _, task := range s.queue {
+		if task.reg.ID == "b" {
+			t.Fatalf("unscheduled task was rescheduled")
+		}
+	}
+}
+
+func TestCheckHeartbeatRecovery(t *testing.T) {
+	tests := []struct {
+		name       string
+		draining   bool
+		deregister bool
+		want       bool
+	}{
+		{"recovered", false, false, true},
+		{"keeps draining", true, false, true},
+		{"deregistered while failing", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRegistry()
+			var checks int32
+			var id string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/heartbeat" {
+					return
+				}
+				// 第一次检查失败, 第二次检查之前实例可能已经注销
+				if atomic.AddInt32(&checks, 1) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				if tt.deregister {
+					if err := r.remove(context.Background(), id); err != nil {
+						t.Errorf("remove: %v", err)
+					}
+				}
+			}))
+			defer srv.Close()
+
+			added, err := r.add(context.Background(), Registration{
+				ServiceName:      "TestService",
+				ServiceURL:       srv.URL,
+				ServiceUpdateURL: srv.URL + "/services",
+				HeartbeatURL:     srv.URL + "/heartbeat",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			id = added.ID
+			if tt.draining {
+				if err := r.drain(context.Background(), id); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 调度器里的快照没有 Draining
+			if !r.checkHeartbeat(added) {
+				t.Fatal("checkHeartbeat() = false, want true")
+			}
+			got, ok := r.get(id)
+			if ok != tt.want {
+				t.Fatalf("registered = %v, want %v", ok, tt.want)
+			}
+			if ok && got.Draining != tt.draining {
+				t.Errorf("Draining = %v, want %v", got.Draining, tt.draining)
+			}
+			if len(r.suspended) != 0 {
+				t.Errorf("%d instances still suspended", len(r.suspended))
+			}
+		})
+	}
+}
+
+// 几千个实例时调度器本身占用的 CPU, 检查是空的, 只统计调度的开销
+// cpu-ms/s 是每秒钟用掉的 CPU 时间, checks/s 是每秒完成的检查数
+func BenchmarkHeartbeatScheduler(b *testing.B) {
+	for _, n := range []int{1000, 5000, 10000} {
+		b.Run(fmt.Sprintf("instances=%d", n), func(b *testing.B) {
+			benchmarkHeartbeatScheduler(b, n)
+		})
+	}
+}
+
+func benchmarkHeartbeatScheduler(b *testing.B, n int) {
+	var checks int64
+	target := int64(b.N)
+	done := make(chan struct{})
+	s := newHeartbeatScheduler(time.Second, heartbeatJitter, heartbeatWorkers, func(reg Registration) bool {
+		if atomic.AddInt64(&checks, 1) == target {
+			close(done)
+		}
+		return true
+	})
+	for i := 0; i < n; i++ {
+		s.schedule(Registration{ID: fmt.Sprintf("instance-%d", i), ServiceName: "BenchService"})
+	}
+
+	stop := make(chan struct{})
+	b.ResetTimer()
+	start, cpuStart := time.Now(), cpuTime()
+	go s.run(stop)
+	<-done
+	elapsed, cpu := time.Since(start), cpuTime()-cpuStart
+	b.StopTimer()
+	close(stop)
+
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "checks/s")
+	b.ReportMetric(float64(cpu.Milliseconds())/elapsed.Seconds(), "cpu-ms/s")
+}
+
+// 进程使用的用户态和内核态 CPU 时间
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
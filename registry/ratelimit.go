@@ -0,0 +1,196 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 注册中心 API 的限流和配额, 值为 0 表示不限制
+type Limits struct {
+	// 每个来源 IP 每秒允许的注册和注销请求数, 以及允许的突发数量, 在解析请求体之前检查
+	// 同一台机器上的服务共用一个 IP, 所以默认值比按实例限流宽松得多, 只用来挡住整台机器的请求洪水
+	SourceRate  float64
+	SourceBurst int
+	// 每个实例 (按 ServiceURL 区分) 每秒允许的注册和注销请求数, 以及允许的突发数量
+	// 一个实例频繁注册不会影响同一台机器上的其他实例
+	InstanceRate  float64
+	InstanceBurst int
+	// 每个服务名称每秒允许的注册和注销请求数, 以及允许的突发数量
+	ServiceRate  float64
+	ServiceBurst int
+	// 每个服务最多可以注册的实例数量, 已注册的实例重新注册不受影响
+	MaxInstancesPerService int
+}
+
+var DefaultLimits = Limits{
+	SourceRate:             50,
+	SourceBurst:            200,
+	InstanceRate:           5,
+	InstanceBurst:          20,
+	ServiceRate:            10,
+	ServiceBurst:           50,
+	MaxInstancesPerService: 100,
+}
+
+// 服务的实例数量达到配额
+var errQuotaExceeded = errors.New("instance quota exceeded")
+
+// 令牌桶, 每秒补充 rate 个令牌, 最多存放 burst 个
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	// 上一次清理空闲令牌桶的时间
+	swept time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// 尝试为 key 取一个令牌, 失败时返回需要等待的时间
+func (l *rateLimiter) take(key string) (bool, time.Duration) {
+	if l == nil || l.rate <= 0 {
+		return true, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// 每分钟清理一次已经补满的令牌桶, 避免实例很多时 map 一直增长, 调用方需要持有锁
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type limiters struct {
+	lock       sync.RWMutex
+	limits     Limits
+	bySource   *rateLimiter
+	byInstance *rateLimiter
+	byService  *rateLimiter
+}
+
+func newLimiters(l Limits) *limiters {
+	return &limiters{
+		limits:     l,
+		bySource:   newRateLimiter(l.SourceRate, l.SourceBurst),
+		byInstance: newRateLimiter(l.InstanceRate, l.InstanceBurst),
+		byService:  newRateLimiter(l.ServiceRate, l.ServiceBurst),
+	}
+}
+
+func (l *limiters) set(limits Limits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.limits = limits
+	l.bySource = newRateLimiter(limits.SourceRate, limits.SourceBurst)
+	l.byInstance = newRateLimiter(limits.InstanceRate, limits.InstanceBurst)
+	l.byService = newRateLimiter(limits.ServiceRate, limits.ServiceBurst)
+}
+
+func (l *limiters) maxInstances() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.limits.MaxInstancesPerService
+}
+
+func (l *limiters) allowSource(r *http.Request) (bool, time.Duration) {
+	source, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		source = r.RemoteAddr
+	}
+
+	l.lock.RLock()
+	limiter := l.bySource
+	l.lock.RUnlock()
+	return limiter.take(source)
+}
+
+func (l *limiters) allowInstance(id string) (bool, time.Duration) {
+	l.lock.RLock()
+	limiter := l.byInstance
+	l.lock.RUnlock()
+	return limiter.take(id)
+}
+
+func (l *limiters) allowService(name ServiceName) (bool, time.Duration) {
+	l.lock.RLock()
+	limiter := l.byService
+	l.lock.RUnlock()
+	return limiter.take(string(name))
+}
+
+// 修改注册中心的限流和配额
+func SetLimits(l Limits) {
+	reg.limits.set(l)
+}
+
+// 返回 429, 并通过 Retry-After 告诉调用方多少秒后再试
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, what string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("rate limit exceeded for %s, retry after %d seconds", what, seconds),
+		http.StatusTooManyRequests)
+}
+
+// 解析 Retry-After, 只支持秒数的格式, 解析失败时返回 fallback
+func retryAfter(res *http.Response, fallback time.Duration) time.Duration {
+	seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
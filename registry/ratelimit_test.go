@@ -0,0 +1,165 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		requests int
+		// 连续请求时允许的数量
+		allowed int
+		// 第一个被拒绝的请求需要等待的时间
+		wait time.Duration
+	}{
+		{name: "burst", rate: 1, burst: 3, requests: 5, allowed: 3, wait: time.Second},
+		{name: "faster refill", rate: 4, burst: 2, requests: 5, allowed: 2, wait: time.Second / 4},
+		{name: "burst below one", rate: 1, burst: 0, requests: 3, allowed: 1, wait: time.Second},
+		{name: "unlimited", rate: 0, burst: 1, requests: 100, allowed: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.rate, tt.burst)
+			allowed := 0
+			var wait time.Duration
+			for i := 0; i < tt.requests; i++ {
+				ok, w := l.take("key")
+				if ok {
+					allowed++
+				} else if wait == 0 {
+					wait = w
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed %d requests, want %d", allowed, tt.allowed)
+			}
+			// 请求之间过去的时间会补充一点令牌
+			if wait > tt.wait || wait < tt.wait-time.Millisecond*50 {
+				t.Errorf("wait = %v, want about %v", wait, tt.wait)
+			}
+
+			// 不同的 key 互不影响
+			if ok, _ := l.take("other"); !ok {
+				t.Errorf("another key was limited")
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter(2, 4)
+	for i := 0; i < 4; i++ {
+		l.take("key")
+	}
+	if ok, _ := l.take("key"); ok {
+		t.Fatal("bucket should be empty")
+	}
+
+	// 假装过去了 1 秒, 补充 2 个令牌
+	l.buckets["key"].last = l.buckets["key"].last.Add(-time.Second)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("key"); !ok {
+			t.Fatalf("request %d after refill was limited", i)
+		}
+	}
+	if ok, _ := l.take("key"); ok {
+		t.Fatal("refilled more than rate tokens")
+	}
+
+	// 很久之后最多补满 burst 个
+	l.buckets["key"].last = l.buckets["key"].last.Add(-time.Hour)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.take("key"); ok {
+			allowed++
+		}
+	}
+	if allowed != 4 {
+		t.Errorf("allowed %d requests after a long pause, want 4", allowed)
+	}
+}
+
+func TestTooManyRequests(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{0, "1"},
+		{time.Millisecond * 100, "1"},
+		{time.Second, "1"},
+		{time.Millisecond * 1200, "2"},
+		{time.Second * 30, "30"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tooManyRequests(w, tt.wait, "test")
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %d, want 429", w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.want {
+			t.Errorf("Retry-After for %v = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	const fallback = time.Second * 7
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", fallback},
+		{"3", time.Second * 3},
+		{"0", 0},
+		{"-1", fallback},
+		{"soon", fallback},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", fallback},
+	}
+	for _, tt := range tests {
+		res := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			res.Header.Set("Retry-After", tt.header)
+		}
+		if got := retryAfter(res, fallback); got != tt.want {
+			t.Errorf("retryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+// 按来源限流在解析请求体之前进行, 同一个来源超出后即使请求体无效也返回 429
+func TestServeHTTPRateLimits(t *testing.T) {
+	old := reg
+	reg = newRegistry()
+	defer func() { reg = old }()
+	SetLimits(Limits{SourceRate: 1, SourceBurst: 2, InstanceRate: 1, InstanceBurst: 1})
+
+	tests := []struct {
+		name   string
+		remote string
+		body   string
+		want   int
+	}{
+		{"first from source", "10.0.0.1:1234", "invalid", http.StatusBadRequest},
+		{"second from source", "10.0.0.1:1235", "invalid", http.StatusBadRequest},
+		{"source exhausted", "10.0.0.1:1236", "invalid", http.StatusTooManyRequests},
+		{"another source", "10.0.0.2:1234", `{"ServiceName":"A","ServiceURL":"http://a"}`, http.StatusBadRequest},
+		{"instance exhausted", "10.0.0.3:1234", `{"ServiceName":"A","ServiceURL":"http://a"}`, http.StatusTooManyRequests},
+		{"another instance", "10.0.0.3:1235", `{"ServiceName":"A","ServiceURL":"http://b"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/services", strings.NewReader(tt.body))
+		req.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		RegistryService{}.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -1,29 +1,231 @@
 package registry
 
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/url"
+)
+
 type ServiceName string
 
 type Registration struct {
+	// 实例 ID, 由注册中心根据 ServiceURL 生成, 同一个 URL 重复注册得到的 ID 不变
+	ID          string
 	ServiceName ServiceName
 	ServiceURL  string
 	// 存放服务依赖的服务
 	RequiredServices []ServiceName
+	// RequiredServices 中可以缺少的服务, 没有 provider 时服务降级运行, 其余的是硬依赖
+	OptionalServices []ServiceName
+	// 对依赖的服务的版本约束, 例如 ">=1.2.0, <2.0.0", 没有约束的服务可以是任意版本
+	RequiredVersions map[ServiceName]string
+	// 实例的语义化版本
+	Version string
 	// 存放服务自己的 URL 地址, 当自己依赖用的服务发生变更, 可以让注册中心通过这个地址告知服务
 	ServiceUpdateURL string
 	// 用于做心跳检查
 	HeartbeatURL string
+	// 实例所在的区域 (例如机房) 和可用区 (例如机架), 调用方会优先选择同一个 zone 的实例
+	Region string
+	Zone   string
+	// 实例正在停止, 调用方不再选择它, 由注册中心或者 gossip 集群设置
+	Draining bool `json:",omitempty"`
+
+	// 解析过的 RequiredVersions, 注册时解析一次, 每次通知时直接使用
+	versions map[ServiceName]versionConstraint
 }
 
 const (
-	LogService     = ServiceName("LogService")
-	LibraryService = ServiceName("LibraryService")
+	LogService       = ServiceName("LogService")
+	LibraryService   = ServiceName("LibraryService")
+	TraceService     = ServiceName("TraceService")
+	MetricsService   = ServiceName("MetricsService")
+	EventBusService  = ServiceName("EventBusService")
+	SchedulerService = ServiceName("SchedulerService")
 )
 
+// 根据服务地址生成稳定的实例 ID
+func InstanceID(serviceURL string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(serviceURL)))[:16]
+}
+
+// 检查注册信息是否完整, 在发送和接收注册请求时都会调用
+func (r Registration) Validate() error {
+	if r.ServiceName == "" {
+		return fmt.Errorf("service name is required")
+	}
+	for _, u := range []struct {
+		field string
+		value string
+	}{
+		{"ServiceURL", r.ServiceURL},
+		{"ServiceUpdateURL", r.ServiceUpdateURL},
+		{"HeartbeatURL", r.HeartbeatURL},
+	} {
+		if err := validateURL(u.value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", u.field, u.value, err)
+		}
+	}
+	for _, name := range r.RequiredServices {
+		if name == "" {
+			return fmt.Errorf("required service name of %v is empty", r.ServiceName)
+		}
+	}
+	for _, name := range r.OptionalServices {
+		if !r.requires(name) {
+			return fmt.Errorf("optional service %v is not a required service", name)
+		}
+	}
+	if r.Version != "" {
+		if _, err := parseVersion(r.Version); err != nil {
+			return err
+		}
+	}
+	for name, constraint := range r.RequiredVersions {
+		if !r.requires(name) {
+			return fmt.Errorf("version constraint for %v which is not a required service", name)
+		}
+		if _, err := parseVersionConstraint(constraint); err != nil {
+			return fmt.Errorf("invalid version constraint for %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (r Registration) requires(name ServiceName) bool {
+	return containsName(r.RequiredServices, name)
+}
+
+func containsName(names []ServiceName, name ServiceName) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 没有 provider 时服务无法运行的依赖
+func (r Registration) HardDependencies() []ServiceName {
+	var hard []ServiceName
+	for _, name := range r.RequiredServices {
+		if !containsName(r.OptionalServices, name) {
+			hard = append(hard, name)
+		}
+	}
+	return hard
+}
+
+// 解析 RequiredVersions 保存在注册信息中, 需要先通过 Validate
+func (r *Registration) parseVersions() {
+	r.versions = make(map[ServiceName]versionConstraint, len(r.RequiredVersions))
+	for name, constraint := range r.RequiredVersions {
+		if c, err := parseVersionConstraint(constraint); err == nil {
+			r.versions[name] = c
+		}
+	}
+}
+
+// 实例是否是 r 依赖的服务, 并且满足版本约束
+// 没有约束时任何版本都满足, 有约束时没有版本号的实例不满足
+func (r Registration) accepts(entry patchEntry) bool {
+	if !r.requires(entry.Name) {
+		return false
+	}
+	constraint, ok := r.RequiredVersions[entry.Name]
+	if !ok || constraint == "" {
+		return true
+	}
+	c, ok := r.versions[entry.Name]
+	if !ok {
+		// 没有调用过 parseVersions 的注册信息
+		var err error
+		if c, err = parseVersionConstraint(constraint); err != nil {
+			return false
+		}
+	}
+	v, err := parseVersion(entry.Version)
+	if err != nil {
+		return false
+	}
+	return c.matches(v)
+}
+
+func validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	return nil
+}
+
+// 除 ID 以外的字段是否都相同
+func (r Registration) equal(o Registration) bool {
+	if r.ServiceName != o.ServiceName ||
+		r.ServiceURL != o.ServiceURL ||
+		r.ServiceUpdateURL != o.ServiceUpdateURL ||
+		r.HeartbeatURL != o.HeartbeatURL ||
+		r.Region != o.Region ||
+		r.Zone != o.Zone ||
+		r.Version != o.Version ||
+		r.Draining != o.Draining ||
+		len(r.RequiredServices) != len(o.RequiredServices) ||
+		len(r.OptionalServices) != len(o.OptionalServices) ||
+		len(r.RequiredVersions) != len(o.RequiredVersions) {
+		return false
+	}
+	for i := range r.RequiredServices {
+		if r.RequiredServices[i] != o.RequiredServices[i] {
+			return false
+		}
+	}
+	for i := range r.OptionalServices {
+		if r.OptionalServices[i] != o.OptionalServices[i] {
+			return false
+		}
+	}
+	for name, constraint := range r.RequiredVersions {
+		if o.RequiredVersions[name] != constraint {
+			return false
+		}
+	}
+	return true
+}
+
 type patchEntry struct {
-	Name ServiceName
-	URL  string
+	ID      string
+	Name    ServiceName
+	URL     string
+	Region  string
+	Zone    string
+	Version string
+	// 正在停止的实例, 还有其他实例时不会被选择
+	Draining bool `json:",omitempty"`
 }
 
 type patch struct {
 	Added   []patchEntry
 	Removed []patchEntry
+	// 实例重新注册并且信息有变化时, 用新的信息替换同一个 ID 的旧信息
+	Updated []patchEntry
+	// 服务各版本之间的流量权重, 只包含发生变化的服务, 空的权重表示取消按版本分流
+	Traffic map[ServiceName]map[string]int `json:",omitempty"`
+}
+
+func newPatchEntry(reg Registration) patchEntry {
+	return patchEntry{
+		ID:       reg.ID,
+		Name:     reg.ServiceName,
+		URL:      reg.ServiceURL,
+		Region:   reg.Region,
+		Zone:     reg.Zone,
+		Version:  reg.Version,
+		Draining: reg.Draining,
+	}
 }
@@ -2,13 +2,17 @@ package registry
 
 import (
 	"bytes"
+	"context"
+	"distributed/trace"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
-	"time"
 )
 
 const (
@@ -17,183 +21,483 @@ const (
 )
 
 type registry struct {
-	// 目前已经注册的服务
-	registrations []Registration
+	// 目前已经注册的服务实例, key 为实例 ID
+	registrations map[string]Registration
+	// 服务名称 -> 提供该服务的实例
+	byName map[ServiceName]map[string]struct{}
+	// 服务名称 -> 依赖该服务的实例, 服务变更时只需要通知这些实例
+	dependents map[ServiceName]map[string]struct{}
+	// 服务名称 -> 版本 -> 流量权重, 用于金丝雀发布
+	traffic map[ServiceName]map[string]int
 	// 可能会被多个协程并发访问
 	lock *sync.RWMutex
+	// 对已注册的服务做心跳检查
+	heartbeats *heartbeatScheduler
+	// 把注册和下线等事件推送给外部系统
+	webhooks *webhookManager
+	// 注册和注销请求的限流, 以及每个服务的实例数量配额
+	limits *limiters
+	// 因为心跳检查失败被暂时移除的实例, 重试成功后按这里保存的注册信息加回来
+	suspended map[string]Registration
 }
 
-func (r *registry) add(reg Registration) error {
+// 往 name 对应的集合里加入 id
+func addIndex(index map[ServiceName]map[string]struct{}, name ServiceName, id string) {
+	if _, ok := index[name]; !ok {
+		index[name] = make(map[string]struct{})
+	}
+	index[name][id] = struct{}{}
+}
+
+// 从 name 对应的集合里移除 id, 集合为空时删掉整个 key
+func removeIndex(index map[ServiceName]map[string]struct{}, name ServiceName, id string) {
+	ids, ok := index[name]
+	if !ok {
+		return
+	}
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(index, name)
+	}
+}
+
+// 把实例从 byName 和 dependents 中移除, 调用方需要持有写锁
+func (r *registry) unindex(reg Registration) {
+	removeIndex(r.byName, reg.ServiceName, reg.ID)
+	for _, reqService := range reg.RequiredServices {
+		removeIndex(r.dependents, reqService, reg.ID)
+	}
+}
+
+// 注册或更新一个实例, 返回带有实例 ID 的注册信息
+// 同一个 ServiceURL 重复注册是幂等的, 只有信息发生变化时才会通知依赖方
+func (r *registry) add(ctx context.Context, reg Registration) (Registration, error) {
+	if err := reg.Validate(); err != nil {
+		return reg, err
+	}
+	reg.ID = InstanceID(reg.ServiceURL)
+	reg.parseVersions()
+
 	r.lock.Lock()
-	r.registrations = append(r.registrations, reg)
+	old, exists := r.registrations[reg.ID]
+	// 新实例需要检查配额, 已注册的实例重新注册不受影响
+	if max := r.limits.maxInstances(); !exists && max > 0 && len(r.byName[reg.ServiceName]) >= max {
+		r.lock.Unlock()
+		return reg, fmt.Errorf("%w: %v already has %d instances", errQuotaExceeded, reg.ServiceName, max)
+	}
+	// 重新注册之后不再需要按心跳检查前的信息恢复
+	delete(r.suspended, reg.ID)
+	// 同一个实例重新注册时先清掉旧的索引
+	if exists {
+		r.unindex(old)
+	}
+	r.registrations[reg.ID] = reg
+	addIndex(r.byName, reg.ServiceName, reg.ID)
+	for _, reqService := range reg.RequiredServices {
+		addIndex(r.dependents, reqService, reg.ID)
+	}
 	r.lock.Unlock()
 
+	r.heartbeats.schedule(reg)
+	if reg.ServiceName == TraceService || (exists && old.ServiceName == TraceService) {
+		r.updateTraceReporter()
+	}
+
 	// 在服务注册的时候还会进行依赖服务的声明
-	if err := r.sendRequiredServices(reg); err != nil {
+	// 重新注册的实例可能是重启过的, 所以每次都发送
+	if err := r.sendRequiredServices(ctx, reg); err != nil {
 		log.Println("send required services failed")
-		return err
+		return reg, err
 	}
 
-	r.notify(patch{
-		Added: []patchEntry{
-			patchEntry{
-				Name: reg.ServiceName,
-				URL:  reg.ServiceURL,
-			},
-		},
-	})
+	switch {
+	case !exists:
+		r.webhooks.emit(EventRegistered, reg)
+	case !old.equal(reg):
+		r.webhooks.emit(EventUpdated, reg)
+	}
 
-	return nil
+	switch {
+	case !exists:
+		r.notify(ctx, patch{Added: []patchEntry{newPatchEntry(reg)}})
+	case old.ServiceName != reg.ServiceName:
+		// 换了服务名称, 对依赖方来说是旧服务少了一个实例, 新服务多了一个实例
+		r.notify(ctx, patch{
+			Removed: []patchEntry{newPatchEntry(old)},
+			Added:   []patchEntry{newPatchEntry(reg)},
+		})
+	case !old.equal(reg):
+		r.notify(ctx, patch{Updated: []patchEntry{newPatchEntry(reg)}})
+	}
+
+	return reg, nil
 }
 
-func (r *registry) notify(fullPath patch) {
+func (r *registry) notify(ctx context.Context, fullPath patch) {
 	r.lock.RLock()
-	defer r.lock.RUnlock()
 
-	for _, reg := range r.registrations {
-		// 针对每个注册的服务都开一个 goroutine
-		go func(reg Registration) {
-			// 对每个服务所依赖的服务进行循环
-			for _, reqService := range reg.RequiredServices {
-				p := patch{Added: []patchEntry{}, Removed: []patchEntry{}}
-				sendUpdate := false
-
-				for _, added := range fullPath.Added {
-					if added.Name == reqService {
-						p.Added = append(p.Added, added)
-						sendUpdate = true
-					}
-				}
-				for _, removed := range fullPath.Removed {
-					if removed.Name == reqService {
-						p.Removed = append(p.Removed, removed)
-						sendUpdate = true
-					}
-				}
-				if sendUpdate {
-					if err := r.sendPatch(p, reg.ServiceUpdateURL); err != nil {
-						log.Println(err)
-						return
-					}
-				}
+	// 按依赖方汇总需要发送的 patch, 只会访问依赖了变更服务的实例
+	patches := make(map[string]*patch)
+	patchFor := func(id string) *patch {
+		p, ok := patches[id]
+		if !ok {
+			p = &patch{Added: []patchEntry{}, Removed: []patchEntry{}, Updated: []patchEntry{}}
+			patches[id] = p
+		}
+		return p
+	}
+	for _, entry := range fullPath.Added {
+		for id := range r.dependents[entry.Name] {
+			// 不满足版本约束的实例不发给依赖方
+			if r.registrations[id].accepts(entry) {
+				patchFor(id).Added = append(patchFor(id).Added, entry)
+			}
+		}
+	}
+	for _, entry := range fullPath.Removed {
+		for id := range r.dependents[entry.Name] {
+			patchFor(id).Removed = append(patchFor(id).Removed, entry)
+		}
+	}
+	for _, entry := range fullPath.Updated {
+		for id := range r.dependents[entry.Name] {
+			// 更新后不再满足版本约束, 对依赖方来说就是移除
+			if r.registrations[id].accepts(entry) {
+				patchFor(id).Updated = append(patchFor(id).Updated, entry)
+			} else {
+				patchFor(id).Removed = append(patchFor(id).Removed, entry)
 			}
-		}(reg)
+		}
+	}
+	for name, weights := range fullPath.Traffic {
+		for id := range r.dependents[name] {
+			p := patchFor(id)
+			if p.Traffic == nil {
+				p.Traffic = make(map[ServiceName]map[string]int)
+			}
+			p.Traffic[name] = weights
+		}
 	}
 
+	updateURLs := make(map[string]string, len(patches))
+	for id := range patches {
+		updateURLs[id] = r.registrations[id].ServiceUpdateURL
+	}
+	r.lock.RUnlock()
+
+	// 请求结束后 patch 可能还没有发送完
+	ctx = trace.Detach(ctx)
+	for id, p := range patches {
+		// 针对每个依赖方都开一个 goroutine
+		go func(p patch, updateURL string) {
+			if err := r.sendPatch(ctx, p, updateURL); err != nil {
+				log.Println(err)
+			}
+		}(*p, updateURLs[id])
+	}
 }
 
-func (r *registry) sendRequiredServices(reg Registration) error {
+func (r *registry) sendRequiredServices(ctx context.Context, reg Registration) error {
 	r.lock.RLock()
-	defer r.lock.RUnlock()
-
 	// 有增有减的
 	var p patch
-	// 循环查找已注册的服务
-	for _, serviceReg := range r.registrations {
-		// 循环查找依赖的服务
-		for _, reqService := range reg.RequiredServices {
-			if serviceReg.ServiceName == reqService {
-				p.Added = append(p.Added, patchEntry{
-					Name: serviceReg.ServiceName,
-					URL:  serviceReg.ServiceURL,
-				})
+	// 直接按服务名称找到依赖的服务的实例
+	for _, reqService := range reg.RequiredServices {
+		for id := range r.byName[reqService] {
+			entry := newPatchEntry(r.registrations[id])
+			if reg.accepts(entry) {
+				p.Added = append(p.Added, entry)
+			} else {
+				// 重新注册时版本约束可能变了, 让依赖方去掉不再满足约束的实例
+				p.Removed = append(p.Removed, entry)
+			}
+		}
+		if weights, ok := r.traffic[reqService]; ok {
+			if p.Traffic == nil {
+				p.Traffic = make(map[ServiceName]map[string]int)
 			}
+			p.Traffic[reqService] = weights
 		}
 	}
+	r.lock.RUnlock()
+
 	// 通过更新 URL 把 patch / 依赖的相关服务的 URL 发送过去
-	if err := r.sendPatch(p, reg.ServiceUpdateURL); err != nil {
+	if err := r.sendPatch(ctx, p, reg.ServiceUpdateURL); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (r *registry) sendPatch(p patch, updateURL string) error {
+// 设置服务各版本之间的流量权重并通知依赖方, weights 为空时取消按版本分流
+// 版本号按规范写法保存, 例如 v1.0.0 保存为 1.0.0, 不完整的版本号 (例如 1.0) 会被拒绝
+func (r *registry) setTraffic(ctx context.Context, name ServiceName, weights map[string]int) error {
+	normalized := make(map[string]int, len(weights))
+	for raw, weight := range weights {
+		v, err := parseVersion(raw)
+		if err != nil {
+			return err
+		}
+		if weight < 0 {
+			return fmt.Errorf("negative weight %d for version %s", weight, raw)
+		}
+		if _, ok := normalized[v.String()]; ok {
+			return fmt.Errorf("duplicate weight for version %s", v)
+		}
+		normalized[v.String()] = weight
+	}
+	weights = normalized
+
+	r.lock.Lock()
+	if len(weights) == 0 {
+		delete(r.traffic, name)
+		weights = map[string]int{}
+	} else {
+		r.traffic[name] = weights
+	}
+	r.lock.Unlock()
+
+	r.notify(ctx, patch{Traffic: map[ServiceName]map[string]int{name: weights}})
+	return nil
+}
+
+// 实例的就绪状态, 硬依赖都有满足版本约束的 provider 时才是就绪的
+type instanceStatus struct {
+	ID          string
+	ServiceName ServiceName
+	ServiceURL  string
+	Ready       bool
+	Draining    bool `json:",omitempty"`
+	// 缺少 provider 的硬依赖
+	Missing []ServiceName `json:",omitempty"`
+	// 缺少 provider 的可选依赖, 服务处于降级状态
+	Degraded []ServiceName `json:",omitempty"`
+}
+
+func (r *registry) status() []instanceStatus {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	hasProvider := func(reg Registration, name ServiceName) bool {
+		for id := range r.byName[name] {
+			if reg.accepts(newPatchEntry(r.registrations[id])) {
+				return true
+			}
+		}
+		return false
+	}
+
+	statuses := make([]instanceStatus, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		st := instanceStatus{
+			ID:          reg.ID,
+			ServiceName: reg.ServiceName,
+			ServiceURL:  reg.ServiceURL,
+			Draining:    reg.Draining,
+		}
+		hard := reg.HardDependencies()
+		for _, name := range reg.RequiredServices {
+			if hasProvider(reg, name) {
+				continue
+			}
+			if containsName(hard, name) {
+				st.Missing = append(st.Missing, name)
+			} else {
+				st.Degraded = append(st.Degraded, name)
+			}
+		}
+		st.Ready = len(st.Missing) == 0
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ServiceURL < statuses[j].ServiceURL
+	})
+	return statuses
+}
+
+func (r *registry) getTraffic() map[ServiceName]map[string]int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	traffic := make(map[ServiceName]map[string]int, len(r.traffic))
+	for name, weights := range r.traffic {
+		traffic[name] = weights
+	}
+	return traffic
+}
+
+func (r *registry) sendPatch(ctx context.Context, p patch, updateURL string) error {
 	data, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
 
-	_, err = http.Post(updateURL, "application/json", bytes.NewBuffer(data))
+	req, err := http.NewRequest(http.MethodPost, updateURL, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := trace.Do(ctx, http.DefaultClient, req)
 	if err != nil {
 		return err
 	}
+	res.Body.Close()
 
 	return nil
 }
 
-func (r *registry) remove(url string) error {
-	for i := range r.registrations {
-		if url == r.registrations[i].ServiceURL {
-			r.notify(patch{
-				Removed: []patchEntry{
-					{
-						Name: r.registrations[i].ServiceName,
-						URL:  r.registrations[i].ServiceURL,
-					},
-				},
-			})
+// 注册中心不通过 providers 发现服务, 直接从已注册的实例中选择追踪服务上报 span
+func (r *registry) updateTraceReporter() {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for id := range r.byName[TraceService] {
+		trace.SetReporter(r.registrations[id].ServiceURL)
+		return
+	}
+	trace.UnsetReporter()
+}
+
+func (r *registry) get(id string) (Registration, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	reg, ok := r.registrations[id]
+	return reg, ok
+}
 
-			r.lock.Lock()
-			defer r.lock.Unlock()
+// 把实例标记为正在停止, 依赖方收到 Updated 之后不再把新的请求发给它
+func (r *registry) drain(ctx context.Context, id string) error {
+	r.lock.Lock()
+	reg, found := r.registrations[id]
+	if !found || reg.Draining {
+		r.lock.Unlock()
+		if !found {
+			return fmt.Errorf("service instance %s not found", id)
+		}
+		return nil
+	}
+	reg.Draining = true
+	r.registrations[id] = reg
+	r.lock.Unlock()
 
-			r.registrations = append(r.registrations[:i], r.registrations[i+1:]...)
+	r.webhooks.emit(EventUpdated, reg)
+	r.notify(ctx, patch{Updated: []patchEntry{newPatchEntry(reg)}})
+	return nil
+}
 
-			return nil
+// 所有实例, 按服务名称和地址排序, 正在停止的实例也在里面, 用 Draining 区分
+func (r *registry) list() []Registration {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	regs := make([]Registration, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		regs = append(regs, reg)
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		if regs[i].ServiceName != regs[j].ServiceName {
+			return regs[i].ServiceName < regs[j].ServiceName
 		}
+		return regs[i].ServiceURL < regs[j].ServiceURL
+	})
+	return regs
+}
+
+// 注销一个实例, 心跳检查失败时暂时移除的实例也不会再被加回来
+func (r *registry) remove(ctx context.Context, id string) error {
+	r.lock.Lock()
+	_, suspended := r.suspended[id]
+	delete(r.suspended, id)
+	r.lock.Unlock()
+
+	err := r.drop(ctx, id, false)
+	if err != nil && suspended {
+		return nil
 	}
-	return fmt.Errorf("service at URL %s not found", url)
+	return err
 }
 
-var reg = registry{
-	registrations: make([]Registration, 0),
-	lock:          new(sync.RWMutex),
+// 心跳检查失败时暂时移除实例, 保留当时的注册信息 (包括 Draining) 以便恢复
+func (r *registry) suspend(ctx context.Context, id string) error {
+	return r.drop(ctx, id, true)
 }
 
-func (r *registry) heartbeat(freq time.Duration) {
-	for {
-		var wg sync.WaitGroup
-		for _, reg := range r.registrations {
-			wg.Add(1)
-			go func(reg Registration) {
-				defer wg.Done()
+// 心跳检查恢复后把暂时移除的实例加回来
+// 期间实例已经注销或者重新注册过时不做任何事
+func (r *registry) resume(ctx context.Context, id string) error {
+	r.lock.Lock()
+	reg, ok := r.suspended[id]
+	delete(r.suspended, id)
+	r.lock.Unlock()
 
-				success := true
-				for attemps := 0; attemps < 3; attemps++ {
-					res, err := http.Get(reg.HeartbeatURL)
-					// 请求失败
-					if err != nil {
-						log.Println(err)
-					} else if res.StatusCode == http.StatusOK {
-						// 请求成功
-						log.Printf("Heartbeat check passed for %v", reg.ServiceName)
-						// 判断是否有失败过, 失败过则重新把服务添加回 r 中
-						if !success {
-							r.add(reg)
-						}
-						break
-					}
+	if !ok {
+		return nil
+	}
+	_, err := r.add(ctx, reg)
+	return err
+}
 
-					// 请求失败继续往下走
-					log.Printf("Heartbeat check failed for %v", reg.ServiceName)
-					if success {
-						success = false
-						r.remove(reg.ServiceURL)
-					}
+// 重试全部失败, 实例不会再被恢复
+func (r *registry) forget(id string) {
+	r.lock.Lock()
+	delete(r.suspended, id)
+	r.lock.Unlock()
+}
 
-					// 等 1s 重试
-					time.Sleep(time.Second * 1)
-				}
-			}(reg)
+func (r *registry) drop(ctx context.Context, id string, suspend bool) error {
+	r.lock.Lock()
+	removed, found := r.registrations[id]
+	if found {
+		delete(r.registrations, id)
+		r.unindex(removed)
+		if suspend {
+			r.suspended[id] = removed
 		}
 	}
+	r.lock.Unlock()
+
+	if !found {
+		return fmt.Errorf("service instance %s not found", id)
+	}
+
+	r.heartbeats.unschedule(id)
+	if removed.ServiceName == TraceService {
+		r.updateTraceReporter()
+	}
+	r.webhooks.emit(EventDeregistered, removed)
+	r.notify(ctx, patch{Removed: []patchEntry{newPatchEntry(removed)}})
+
+	return nil
+}
+
+var reg = newRegistry()
+
+func newRegistry() *registry {
+	r := &registry{
+		registrations: make(map[string]Registration),
+		byName:        make(map[ServiceName]map[string]struct{}),
+		dependents:    make(map[ServiceName]map[string]struct{}),
+		traffic:       make(map[ServiceName]map[string]int),
+		lock:          new(sync.RWMutex),
+		webhooks:      newWebhookManager(),
+		limits:        newLimiters(DefaultLimits),
+		suspended:     make(map[string]Registration),
+	}
+	r.heartbeats = newHeartbeatScheduler(
+		heartbeatInterval,
+		heartbeatJitter,
+		heartbeatWorkers,
+		r.checkHeartbeat,
+	)
+	return r
 }
 
 var once sync.Once
 
 func SetupRegistryService() {
 	once.Do(func() {
-		go reg.heartbeat(time.Second * 3)
+		go reg.heartbeats.run(make(chan struct{}))
 	})
 }
 
@@ -205,8 +509,21 @@ func (s RegistryService) ServeHTTP(
 	r *http.Request,
 ) {
 	log.Println("Request received")
+	// 先按来源限流, 避免解析请求体
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		if ok, wait := reg.limits.allowSource(r); !ok {
+			log.Printf("Rate limit exceeded for %s\n", r.RemoteAddr)
+			tooManyRequests(w, wait, "source "+r.RemoteAddr)
+			return
+		}
+	}
+
 	switch r.Method {
+	case http.MethodGet:
+		// 列出所有实例, 供指标服务等发现服务使用
+		writeJSON(w, reg.list())
 	case http.MethodPost:
+		ctx := r.Context()
 		dec := json.NewDecoder(r.Body)
 
 		var r Registration
@@ -215,13 +532,32 @@ func (s RegistryService) ServeHTTP(
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		// 再按实例限流, 最后按服务名称限流
+		if ok, wait := reg.limits.allowInstance(InstanceID(r.ServiceURL)); !ok {
+			log.Printf("Rate limit exceeded for %s\n", r.ServiceURL)
+			tooManyRequests(w, wait, "instance "+r.ServiceURL)
+			return
+		}
+		if ok, wait := reg.limits.allowService(r.ServiceName); !ok {
+			log.Printf("Rate limit exceeded for %v\n", r.ServiceName)
+			tooManyRequests(w, wait, "service "+string(r.ServiceName))
+			return
+		}
 		log.Printf("Adding service: %v with URL: %s\n", r.ServiceName, r.ServiceURL)
 
-		if err := reg.add(r); err != nil {
+		r, err := reg.add(ctx, r)
+		if errors.Is(err, errQuotaExceeded) {
 			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		// 把分配的实例 ID 返回给服务
+		writeJSON(w, r)
 	case http.MethodDelete:
 		payload, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -229,9 +565,25 @@ func (s RegistryService) ServeHTTP(
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		url := string(payload)
-		log.Printf("Removing service at URL: %s", url)
-		if err := reg.remove(url); err != nil {
+		// 请求体可以是实例 ID, 也可以是服务地址
+		id := string(payload)
+		if strings.Contains(id, "://") {
+			id = InstanceID(id)
+		}
+		if ok, wait := reg.limits.allowInstance(id); !ok {
+			log.Printf("Rate limit exceeded for %s\n", id)
+			tooManyRequests(w, wait, "instance "+id)
+			return
+		}
+		if existing, ok := reg.get(id); ok {
+			if ok, wait := reg.limits.allowService(existing.ServiceName); !ok {
+				log.Printf("Rate limit exceeded for %v\n", existing.ServiceName)
+				tooManyRequests(w, wait, "service "+string(existing.ServiceName))
+				return
+			}
+		}
+		log.Printf("Removing service instance: %s", string(payload))
+		if err := reg.remove(r.Context(), id); err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -242,3 +594,71 @@ func (s RegistryService) ServeHTTP(
 	}
 
 }
+
+// POST /services/drain 把实例标记为正在停止, 请求体是实例 ID 或者服务地址
+type DrainService struct{}
+
+func (s DrainService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	id := string(payload)
+	if strings.Contains(id, "://") {
+		id = InstanceID(id)
+	}
+	log.Printf("Draining service instance: %s", string(payload))
+	if err := reg.drain(r.Context(), id); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+}
+
+// 管理服务各版本之间的流量权重
+// GET 返回所有服务的权重
+// PUT {"Service": "LogService", "Weights": {"1.0.0": 90, "1.1.0": 10}} 设置一个服务的权重, Weights 为空时取消
+type TrafficService struct{}
+
+type trafficRequest struct {
+	Service ServiceName
+	Weights map[string]int
+}
+
+func (s TrafficService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, reg.getTraffic())
+	case http.MethodPut:
+		var req trafficRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Service == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("Setting traffic weights of %v to %v\n", req.Service, req.Weights)
+		if err := reg.setTraffic(r.Context(), req.Service, req.Weights); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// GET 返回所有实例的就绪状态, 硬依赖没有 provider 的实例是 unready 的
+type StatusService struct{}
+
+func (s StatusService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, reg.status())
+}
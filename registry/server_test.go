@@ -0,0 +1,243 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 按 registrations 重新计算 byName 和 dependents, 和增量维护的索引比较
+func checkIndex(t *testing.T, r *registry) {
+	t.Helper()
+	byName := make(map[ServiceName]map[string]struct{})
+	dependents := make(map[ServiceName]map[string]struct{})
+	for id, reg := range r.registrations {
+		addIndex(byName, reg.ServiceName, id)
+		for _, name := range reg.RequiredServices {
+			addIndex(dependents, name, id)
+		}
+	}
+	if !reflect.DeepEqual(r.byName, byName) {
+		t.Errorf("byName = %v, want %v", r.byName, byName)
+	}
+	if !reflect.DeepEqual(r.dependents, dependents) {
+		t.Errorf("dependents = %v, want %v", r.dependents, dependents)
+	}
+}
+
+// 每一步之后检查索引, 以及依赖方收到的 patch
+func TestRegistryIndex(t *testing.T) {
+	patches := make(chan patch, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var p patch
+		if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+			t.Error(err)
+			return
+		}
+		// 只关心发给 consumer 的增量, 注册时发送的完整列表不算
+		if req.URL.Path == "/consumer/services" && len(p.Added)+len(p.Removed)+len(p.Updated) > 0 {
+			patches <- p
+		}
+	}))
+	defer srv.Close()
+
+	instance := func(name ServiceName, path, version string, required ...ServiceName) Registration {
+		return Registration{
+			ServiceName:      name,
+			ServiceURL:       srv.URL + path,
+			RequiredServices: required,
+			ServiceUpdateURL: srv.URL + path + "/services",
+			HeartbeatURL:     srv.URL + path + "/heartbeat",
+			Version:          version,
+		}
+	}
+	provider := InstanceID(srv.URL + "/provider")
+
+	r := newRegistry()
+	tests := []struct {
+		name string
+		op   func() error
+		// consumer 收到的 patch, 为 nil 时不应该收到
+		want *patch
+	}{
+		{
+			name: "add consumer",
+			op:   addOp(r, instance("Consumer", "/consumer", "", "Provider")),
+		},
+		{
+			name: "add provider",
+			op:   addOp(r, instance("Provider", "/provider", "1.0.0")),
+			want: &patch{Added: []patchEntry{{ID: provider, Name: "Provider", URL: srv.URL + "/provider", Version: "1.0.0"}}},
+		},
+		{
+			name: "re-register unchanged",
+			op:   addOp(r, instance("Provider", "/provider", "1.0.0")),
+		},
+		{
+			name: "re-register with new version",
+			op:   addOp(r, instance("Provider", "/provider", "1.1.0")),
+			want: &patch{Updated: []patchEntry{{ID: provider, Name: "Provider", URL: srv.URL + "/provider", Version: "1.1.0"}}},
+		},
+		{
+			name: "rename provider",
+			op:   addOp(r, instance("Other", "/provider", "1.1.0")),
+			want: &patch{Removed: []patchEntry{{ID: provider, Name: "Provider", URL: srv.URL + "/provider", Version: "1.1.0"}}},
+		},
+		{
+			name: "rename back",
+			op:   addOp(r, instance("Provider", "/provider", "1.1.0")),
+			want: &patch{Added: []patchEntry{{ID: provider, Name: "Provider", URL: srv.URL + "/provider", Version: "1.1.0"}}},
+		},
+		{
+			name: "remove provider",
+			op:   func() error { return r.remove(context.Background(), provider) },
+			want: &patch{Removed: []patchEntry{{ID: provider, Name: "Provider", URL: srv.URL + "/provider", Version: "1.1.0"}}},
+		},
+		{
+			name: "remove consumer",
+			op:   func() error { return r.remove(context.Background(), InstanceID(srv.URL+"/consumer")) },
+		},
+	}
+	for _, tt := range tests {
+		if err := tt.op(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		checkIndex(t, r)
+
+		select {
+		case p := <-patches:
+			if tt.want == nil {
+				t.Fatalf("%s: unexpected patch %+v", tt.name, p)
+			}
+			if len(p.Added)+len(tt.want.Added) > 0 && !reflect.DeepEqual(p.Added, tt.want.Added) ||
+				len(p.Removed)+len(tt.want.Removed) > 0 && !reflect.DeepEqual(p.Removed, tt.want.Removed) ||
+				len(p.Updated)+len(tt.want.Updated) > 0 && !reflect.DeepEqual(p.Updated, tt.want.Updated) {
+				t.Fatalf("%s: patch = %+v, want %+v", tt.name, p, *tt.want)
+			}
+		case <-time.After(time.Millisecond * 200):
+			if tt.want != nil {
+				t.Fatalf("%s: no patch received", tt.name)
+			}
+		}
+	}
+	if len(r.registrations) != 0 || len(r.byName) != 0 || len(r.dependents) != 0 {
+		t.Errorf("registry not empty: %v %v %v", r.registrations, r.byName, r.dependents)
+	}
+}
+
+func addOp(r *registry, reg Registration) func() error {
+	return func() error {
+		_, err := r.add(context.Background(), reg)
+		return err
+	}
+}
+
+const (
+	// 已经注册的实例数
+	benchRegistrations = 10000
+	// 实例平均分到这些服务中, 每个实例依赖下一个服务, 所以每个服务有 100 个依赖方
+	benchServices = 100
+)
+
+// patch 不真的发出去, 只统计索引和分发的开销
+type discardTransport struct{}
+
+func (discardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+var discardOnce sync.Once
+
+func benchService(i int) ServiceName {
+	return ServiceName(fmt.Sprintf("Service-%d", i%benchServices))
+}
+
+func benchRegistration(i int) Registration {
+	url := fmt.Sprintf("http://instance-%d:8080", i)
+	return Registration{
+		ServiceName:      benchService(i),
+		ServiceURL:       url,
+		RequiredServices: []ServiceName{benchService(i + 1)},
+		ServiceUpdateURL: url + "/services",
+		HeartbeatURL:     url + "/heartbeat",
+	}
+}
+
+// 返回已经有 benchRegistrations 个实例的注册中心, 不限流, 不限制实例数
+func newBenchRegistry(b *testing.B) *registry {
+	// notify 在后台发送 patch, 换掉之后不再换回来, 避免和还没发完的 patch 竞争
+	discardOnce.Do(func() {
+		http.DefaultClient.Transport = discardTransport{}
+	})
+
+	r := newRegistry()
+	r.limits = newLimiters(Limits{})
+	for i := 0; i < benchRegistrations; i++ {
+		if _, err := r.add(context.Background(), benchRegistration(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return r
+}
+
+func BenchmarkAdd(b *testing.B) {
+	r := newBenchRegistry(b)
+	regs := make([]Registration, b.N)
+	for i := range regs {
+		regs[i] = benchRegistration(benchRegistrations + i)
+	}
+
+	b.ResetTimer()
+	for _, reg := range regs {
+		if _, err := r.add(context.Background(), reg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRemove(b *testing.B) {
+	r := newBenchRegistry(b)
+	// 删掉的是另外加入的实例, 注册中心始终保持 benchRegistrations 个实例
+	ids := make([]string, b.N)
+	for i := range ids {
+		reg, err := r.add(context.Background(), benchRegistration(benchRegistrations+i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids[i] = reg.ID
+	}
+
+	b.ResetTimer()
+	for _, id := range ids {
+		if err := r.remove(context.Background(), id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNotify(b *testing.B) {
+	r := newBenchRegistry(b)
+	entries := make([]patchEntry, benchServices)
+	for i := range entries {
+		reg := benchRegistration(i)
+		reg.ID = InstanceID(reg.ServiceURL)
+		entries[i] = newPatchEntry(reg)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.notify(context.Background(), patch{Updated: []patchEntry{entries[i%benchServices]}})
+	}
+}
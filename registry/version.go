@@ -0,0 +1,253 @@
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 语义化版本 MAJOR.MINOR.PATCH, 可以带 v 前缀, -pre 后缀和 +build 后缀
+type version struct {
+	major, minor, patch uint64
+	// 点分隔的预发布标识, 例如 rc.1
+	pre string
+}
+
+// 按 semver 2.0.0 解析, 必须写全 MAJOR.MINOR.PATCH, 1 和 1.2 这样不完整的版本号会被拒绝
+func parseVersion(s string) (version, error) {
+	var v version
+	raw := s
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		if !validIdentifiers(s[i+1:], false) {
+			return v, fmt.Errorf("invalid build metadata in version %q", raw)
+		}
+		s = s[:i]
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.pre = s[i+1:]
+		if !validIdentifiers(v.pre, true) {
+			return v, fmt.Errorf("invalid pre-release in version %q", raw)
+		}
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("version %q must be MAJOR.MINOR.PATCH", raw)
+	}
+	nums := []*uint64{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil || !isNumeric(part) || len(part) > 1 && part[0] == '0' {
+			return v, fmt.Errorf("invalid version %q", raw)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// 点分隔的标识只能包含字母, 数字和 -, 不能为空
+// 预发布标识中的纯数字不能有前导 0
+func validIdentifiers(s string, pre bool) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		for _, c := range id {
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+				return false
+			}
+		}
+		if pre && isNumeric(id) && len(id) > 1 && id[0] == '0' {
+			return false
+		}
+	}
+	return true
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// 规范的写法 MAJOR.MINOR.PATCH[-pre], 不带 v 前缀和 +build 后缀
+func (v version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if v.pre != "" {
+		s += "-" + v.pre
+	}
+	return s
+}
+
+// 返回版本号的规范写法, 无法解析时原样返回
+func canonicalVersion(s string) string {
+	v, err := parseVersion(s)
+	if err != nil {
+		return s
+	}
+	return v.String()
+}
+
+// MAJOR.MINOR.PATCH 是否相同, 不比较 pre
+func (v version) sameCore(o version) bool {
+	return v.major == o.major && v.minor == o.minor && v.patch == o.patch
+}
+
+// 返回 -1, 0, 1, 带 pre 的版本小于不带 pre 的同一版本
+func (v version) compare(o version) int {
+	for _, pair := range [][2]uint64{
+		{v.major, o.major},
+		{v.minor, o.minor},
+		{v.patch, o.patch},
+	} {
+		if pair[0] < pair[1] {
+			return -1
+		}
+		if pair[0] > pair[1] {
+			return 1
+		}
+	}
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case o.pre == "":
+		return -1
+	}
+	return comparePre(v.pre, o.pre)
+}
+
+// 按 semver 第 11 条逐个比较点分隔的标识: 纯数字按数值比较, 并且小于非纯数字,
+// 非纯数字按 ASCII 比较, 前面都相同时标识少的更小, 例如 rc.2 < rc.10 < rc.10.1
+func comparePre(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, y := as[i], bs[i]
+		if x == y {
+			continue
+		}
+		xNum, yNum := isNumeric(x), isNumeric(y)
+		switch {
+		case xNum && yNum:
+			// 没有前导 0, 位数少的数值更小, 不会溢出
+			if len(x) != len(y) {
+				if len(x) < len(y) {
+					return -1
+				}
+				return 1
+			}
+		case xNum:
+			return -1
+		case yNum:
+			return 1
+		}
+		if x < y {
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+type versionCondition struct {
+	op string
+	v  version
+}
+
+// 版本约束, 多个条件用逗号分隔, 需要同时满足, 例如 ">=1.2.0, <2.0.0"
+// 支持 =, !=, >, >=, <, <=, ^ (主版本相同, 0.x 时次版本相同) 和 ~ (主次版本相同), 没有操作符时表示 =
+type versionConstraint []versionCondition
+
+func parseVersionConstraint(s string) (versionConstraint, error) {
+	var c versionConstraint
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		op := "="
+		for _, candidate := range []string{">=", "<=", "!=", ">", "<", "=", "^", "~"} {
+			if strings.HasPrefix(part, candidate) {
+				op = candidate
+				part = strings.TrimSpace(part[len(candidate):])
+				break
+			}
+		}
+		v, err := parseVersion(part)
+		if err != nil {
+			return nil, err
+		}
+		c = append(c, versionCondition{op: op, v: v})
+	}
+	if len(c) == 0 {
+		return nil, fmt.Errorf("empty version constraint %q", s)
+	}
+	return c, nil
+}
+
+// 和 npm 一样, 预发布版本只有在约束中写了同一个 MAJOR.MINOR.PATCH 的预发布版本时才会匹配,
+// 例如 ">=1.2.0-rc.1" 匹配 1.2.0-rc.2, 但 "^1.0.0" 不匹配 1.3.0-beta
+func (c versionConstraint) matches(v version) bool {
+	if v.pre != "" && !c.allowsPre(v) {
+		return false
+	}
+	for _, cond := range c {
+		cmp := v.compare(cond.v)
+		ok := false
+		switch cond.op {
+		case "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case "^":
+			// 和 npm, Cargo 一样, 0.x 的次版本之间不兼容, 0.0.x 只匹配自己
+			switch {
+			case cond.v.major > 0:
+				ok = cmp >= 0 && v.major == cond.v.major
+			case cond.v.minor > 0:
+				ok = cmp >= 0 && v.major == 0 && v.minor == cond.v.minor
+			default:
+				ok = cmp >= 0 && v.major == 0 && v.minor == 0 && v.patch == cond.v.patch
+			}
+		case "~":
+			ok = cmp >= 0 && v.major == cond.v.major && v.minor == cond.v.minor
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c versionConstraint) allowsPre(v version) bool {
+	for _, cond := range c {
+		if cond.v.pre != "" && cond.v.sameCore(v) {
+			return true
+		}
+	}
+	return false
+}
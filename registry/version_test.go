@@ -0,0 +1,151 @@
+package registry
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "1.2.3", want: "1.2.3"},
+		{in: "v1.2.3", want: "1.2.3"},
+		{in: " 1.2.3 ", want: "1.2.3"},
+		{in: "1.2.3-rc.1", want: "1.2.3-rc.1"},
+		{in: "1.2.3-alpha-1", want: "1.2.3-alpha-1"},
+		{in: "1.2.3+build.5", want: "1.2.3"},
+		{in: "1.2.3-beta+exp.sha.5114f85", want: "1.2.3-beta"},
+		{in: "0.0.0", want: "0.0.0"},
+		{in: "1", wantErr: true},
+		{in: "1.2", wantErr: true},
+		{in: "1.2.3.4", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "1.02.3", wantErr: true},
+		{in: "1.2.x", wantErr: true},
+		{in: "1.2.-3", wantErr: true},
+		{in: "1.2.3-", wantErr: true},
+		{in: "1.2.3-rc..1", wantErr: true},
+		{in: "1.2.3-rc.01", wantErr: true},
+		{in: "1.2.3-rc_1", wantErr: true},
+		{in: "1.2.3+", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			v, err := parseVersion(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVersion(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if err == nil && v.String() != tt.want {
+				t.Errorf("parseVersion(%q) = %v, want %v", tt.in, v, tt.want)
+			}
+		})
+	}
+}
+
+// semver 第 11 条中的例子, 每一个都小于后一个
+func TestVersionCompare(t *testing.T) {
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.1.0",
+		"2.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, err := parseVersion(ordered[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parseVersion(ordered[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if got := a.compare(b); got != want {
+				t.Errorf("compare(%s, %s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"=1.2.3", "1.2.4", false},
+		{"!=1.2.3", "1.2.4", true},
+		{">=1.2.0, <2.0.0", "1.9.9", true},
+		{">=1.2.0, <2.0.0", "2.0.0", false},
+		{">1.2.0", "1.2.0", false},
+		{"<=1.2.0", "1.2.0", true},
+		// ^ 主版本相同
+		{"^1.2.3", "1.9.0", true},
+		{"^1.2.3", "1.2.2", false},
+		{"^1.2.3", "2.0.0", false},
+		// 0.x 时次版本相同, 0.0.x 只匹配自己
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.3", true},
+		{"^0.0.3", "0.0.4", false},
+		// ~ 主次版本相同
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"~1.2.3", "1.2.2", false},
+		// 约束里没有预发布版本时不匹配预发布版本
+		{"^1.0.0", "1.3.0-beta", false},
+		{">=1.0.0", "2.0.0-rc.1", false},
+		{"!=1.2.3", "1.2.4-rc.1", false},
+		// 写了同一个 MAJOR.MINOR.PATCH 的预发布版本时才匹配
+		{">=1.2.0-rc.1", "1.2.0-rc.2", true},
+		{">=1.2.0-rc.1", "1.2.0-rc.10", true},
+		{">=1.2.0-rc.2", "1.2.0-rc.10", true},
+		{">=1.2.0-rc.1", "1.2.0", true},
+		{">=1.2.0-rc.1", "1.3.0-rc.1", false},
+		{"^1.2.0-beta.2", "1.2.0-beta.11", true},
+		{"^1.2.0-beta.2", "1.2.0-beta.1", false},
+		{"~1.2.0-rc.1, <1.2.0", "1.2.0-rc.3", true},
+		{"1.2.0-rc.1", "1.2.0-rc.1", true},
+		// 版本号不合法时不匹配
+		{"^1.0.0", "", false},
+		{"^1.0.0", "1.2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint+" "+tt.version, func(t *testing.T) {
+			reg := Registration{
+				RequiredServices: []ServiceName{"Dep"},
+				RequiredVersions: map[ServiceName]string{"Dep": tt.constraint},
+			}
+			reg.parseVersions()
+			if len(reg.versions) != 1 {
+				t.Fatalf("constraint %q was not parsed", tt.constraint)
+			}
+			if got := reg.accepts(patchEntry{Name: "Dep", Version: tt.version}); got != tt.want {
+				t.Errorf("accepts(%q) with %q = %v, want %v", tt.version, tt.constraint, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVersionConstraintErrors(t *testing.T) {
+	for _, s := range []string{"", " , ", "^1", "~1.2", ">=1.2.0, <2", ">=x.y.z", "1.2.3-"} {
+		if _, err := parseVersionConstraint(s); err == nil {
+			t.Errorf("parseVersionConstraint(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventRegistered      = EventType("registered")
+	EventUpdated         = EventType("updated")
+	EventDeregistered    = EventType("deregistered")
+	EventHeartbeatFailed = EventType("heartbeat_failed")
+)
+
+const (
+	// 投递失败后的重试次数, 每次重试的间隔翻倍
+	webhookAttempts     = 5
+	webhookRetryDelay   = time.Second * 1
+	webhookTimeout      = time.Second * 5
+	webhookDeliveryLogs = 500
+	// 签名放在这个请求头里, 格式为 sha256=<hex>
+	webhookSignatureHeader = "X-Registry-Signature"
+)
+
+// 发送给 webhook 的事件
+type Event struct {
+	ID           string
+	Type         EventType
+	Time         time.Time
+	Registration Registration
+}
+
+// webhook 订阅
+type Webhook struct {
+	ID string
+	// 接收事件的地址
+	URL string
+	// 只接收这些服务的事件, 为空时接收所有服务
+	Services []ServiceName `json:",omitempty"`
+	// 只接收这些类型的事件, 为空时接收所有类型
+	Events []EventType `json:",omitempty"`
+	// 用于对请求体做 HMAC-SHA256 签名, 查询时不会返回
+	Secret string `json:",omitempty"`
+}
+
+func (wh Webhook) matches(e Event) bool {
+	if len(wh.Services) > 0 && !containsName(wh.Services, e.Registration.ServiceName) {
+		return false
+	}
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, t := range wh.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// 一次投递尝试的记录
+type Delivery struct {
+	WebhookID  string
+	EventID    string
+	EventType  EventType
+	Attempt    int
+	Time       time.Time
+	StatusCode int    `json:",omitempty"`
+	Error      string `json:",omitempty"`
+	Success    bool
+}
+
+type webhookManager struct {
+	lock     sync.RWMutex
+	webhooks map[string]Webhook
+	// 最近的投递记录, 超过 webhookDeliveryLogs 条时丢弃最旧的
+	deliveries []Delivery
+	client     *http.Client
+}
+
+func newWebhookManager() *webhookManager {
+	return &webhookManager{
+		webhooks: make(map[string]Webhook),
+		client:   &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func (m *webhookManager) add(wh Webhook) (Webhook, error) {
+	if err := validateURL(wh.URL); err != nil {
+		return wh, fmt.Errorf("invalid webhook URL %q: %v", wh.URL, err)
+	}
+	for _, t := range wh.Events {
+		switch t {
+		case EventRegistered, EventUpdated, EventDeregistered, EventHeartbeatFailed:
+		default:
+			return wh, fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	wh.ID = randomID()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.webhooks[wh.ID] = wh
+	return wh, nil
+}
+
+func (m *webhookManager) remove(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.webhooks[id]; !ok {
+		return fmt.Errorf("webhook %s not found", id)
+	}
+	delete(m.webhooks, id)
+	return nil
+}
+
+// 返回所有订阅, 不包含 Secret
+func (m *webhookManager) list() []Webhook {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	webhooks := make([]Webhook, 0, len(m.webhooks))
+	for _, wh := range m.webhooks {
+		wh.Secret = ""
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks
+}
+
+func (m *webhookManager) deliveryLog() []Delivery {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	deliveries := make([]Delivery, len(m.deliveries))
+	copy(deliveries, m.deliveries)
+	return deliveries
+}
+
+// 把事件发给所有匹配的订阅, 每个订阅一个 goroutine, 不会阻塞调用方
+func (m *webhookManager) emit(t EventType, reg Registration) {
+	e := Event{
+		ID:           randomID(),
+		Type:         t,
+		Time:         time.Now(),
+		Registration: reg,
+	}
+
+	m.lock.RLock()
+	var targets []Webhook
+	for _, wh := range m.webhooks {
+		if wh.matches(e) {
+			targets = append(targets, wh)
+		}
+	}
+	m.lock.RUnlock()
+
+	if len(targets) == 0 {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, wh := range targets {
+		go m.deliver(wh, e, data)
+	}
+}
+
+// 投递失败时按指数退避重试
+func (m *webhookManager) deliver(wh Webhook, e Event, data []byte) {
+	delay := webhookRetryDelay
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		d := Delivery{
+			WebhookID: wh.ID,
+			EventID:   e.ID,
+			EventType: e.Type,
+			Attempt:   attempt,
+			Time:      time.Now(),
+		}
+
+		status, err := m.post(wh, e, data)
+		d.StatusCode = status
+		if err != nil {
+			d.Error = err.Error()
+		}
+		d.Success = err == nil
+		m.record(d)
+
+		if d.Success {
+			return
+		}
+		// 订阅已经被删除就不用再重试了
+		m.lock.RLock()
+		_, ok := m.webhooks[wh.ID]
+		m.lock.RUnlock()
+		if !ok || attempt == webhookAttempts {
+			break
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+	log.Printf("Failed to deliver %v event %s to webhook %s\n", e.Type, e.ID, wh.URL)
+}
+
+func (m *webhookManager) post(wh Webhook, e Event, data []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewBuffer(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Registry-Event", string(e.Type))
+	req.Header.Set("X-Registry-Delivery", e.ID)
+	if wh.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+sign(wh.Secret, data))
+	}
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("webhook responded with code %v", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+func (m *webhookManager) record(d Delivery) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.deliveries = append(m.deliveries, d)
+	if len(m.deliveries) > webhookDeliveryLogs {
+		m.deliveries = m.deliveries[len(m.deliveries)-webhookDeliveryLogs:]
+	}
+}
+
+// 对请求体做 HMAC-SHA256 签名, 接收方用同一个 secret 计算后比较
+func sign(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 管理 webhook 订阅
+// GET /services/webhooks 返回所有订阅
+// POST /services/webhooks 创建订阅, 返回带 ID 的订阅
+// DELETE /services/webhooks 删除订阅, 请求体为订阅 ID
+// GET /services/webhooks/deliveries 返回最近的投递记录
+type WebhookService struct{}
+
+func (s WebhookService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/deliveries") {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, reg.webhooks.deliveryLog())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, reg.webhooks.list())
+	case http.MethodPost:
+		var wh Webhook
+		if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wh, err := reg.webhooks.add(wh)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Adding webhook %s for %s\n", wh.ID, wh.URL)
+		wh.Secret = ""
+		writeJSON(w, wh)
+	case http.MethodDelete:
+		payload, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		id := strings.TrimSpace(string(payload))
+		log.Printf("Removing webhook %s\n", id)
+		if err := reg.webhooks.remove(id); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
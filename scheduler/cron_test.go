@@ -0,0 +1,149 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+// 把位图展开成满足条件的值
+func values(bits uint64) []int {
+	var result []int
+	for i := 0; i < 64; i++ {
+		if has(bits, i) {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+func TestParseField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+		wantErr  bool
+	}{
+		{field: "*", min: 0, max: 5, want: []int{0, 1, 2, 3, 4, 5}},
+		{field: "3", min: 0, max: 59, want: []int{3}},
+		{field: "1,3,5", min: 0, max: 59, want: []int{1, 3, 5}},
+		{field: "1-4", min: 0, max: 59, want: []int{1, 2, 3, 4}},
+		{field: "*/15", min: 0, max: 59, want: []int{0, 15, 30, 45}},
+		{field: "1-10/3", min: 0, max: 59, want: []int{1, 4, 7, 10}},
+		// 单个数字带步长表示从这个数字开始到最大值
+		{field: "5/20", min: 0, max: 59, want: []int{5, 25, 45}},
+		{field: "*/2", min: 1, max: 12, want: []int{1, 3, 5, 7, 9, 11}},
+		{field: "0-4,10-12/2", min: 0, max: 23, want: []int{0, 1, 2, 3, 4, 10, 12}},
+		{field: "7", min: 0, max: 7, want: []int{7}},
+		{field: "60", min: 0, max: 59, wantErr: true},
+		{field: "0", min: 1, max: 31, wantErr: true},
+		{field: "5-1", min: 0, max: 59, wantErr: true},
+		{field: "*/0", min: 0, max: 59, wantErr: true},
+		{field: "*/-1", min: 0, max: 59, wantErr: true},
+		{field: "a", min: 0, max: 59, wantErr: true},
+		{field: "1-", min: 0, max: 59, wantErr: true},
+		{field: "1,,2", min: 0, max: 59, wantErr: true},
+		{field: "", min: 0, max: 59, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			bits, err := parseField(tt.field, tt.min, tt.max)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseField(%q) error = %v, wantErr %v", tt.field, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := values(bits)
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseField(%q) = %v, want %v", tt.field, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("parseField(%q) = %v, want %v", tt.field, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name string
+		spec string
+		from string
+		// 为空时表示永远不会执行
+		want string
+	}{
+		{"every minute", "* * * * *", "2024-03-01 10:00", "2024-03-01 10:01"},
+		{"skips the current minute", "0 * * * *", "2024-03-01 10:00", "2024-03-01 11:00"},
+		{"step", "*/15 * * * *", "2024-03-01 10:16", "2024-03-01 10:30"},
+		{"next day", "30 9 * * *", "2024-03-01 10:00", "2024-03-02 09:30"},
+		{"next month", "0 0 1 * *", "2024-03-01 10:00", "2024-04-01 00:00"},
+		{"next year", "@yearly", "2024-03-01 10:00", "2025-01-01 00:00"},
+		{"leap day", "0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		// 2024-03-01 是星期五
+		{"weekdays", "0 9 * * 1-5", "2024-03-01 10:00", "2024-03-04 09:00"},
+		{"sunday as 0", "0 0 * * 0", "2024-03-01 10:00", "2024-03-03 00:00"},
+		{"sunday as 7", "0 0 * * 7", "2024-03-01 10:00", "2024-03-03 00:00"},
+		{"range ending with 7", "0 0 * * 6-7", "2024-03-01 10:00", "2024-03-02 00:00"},
+		// 日和星期都有限制时满足其中一个即可
+		{"dom or dow, dow first", "0 0 15 * 1", "2024-03-01 10:00", "2024-03-04 00:00"},
+		{"dom or dow, dom first", "0 0 2 * 3", "2024-03-01 10:00", "2024-03-02 00:00"},
+		// 只有一个有限制时按这一个
+		{"dom only", "0 0 15 * *", "2024-03-01 10:00", "2024-03-15 00:00"},
+		{"dow only", "0 0 * * 3", "2024-03-01 10:00", "2024-03-06 00:00"},
+		{"31st skips short months", "0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"february 30", "0 0 30 2 *", "2024-01-01 00:00", ""},
+		{"april 31", "0 0 31 4 *", "2024-01-01 00:00", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched, err := parseSchedule(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := sched.next(at(tt.from))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("next(%s) = %v, want never", tt.from, got)
+				}
+				return
+			}
+			if want := at(tt.want); !got.Equal(want) {
+				t.Errorf("next(%s) = %v, want %v", tt.from, got, want)
+			}
+		})
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"@hourly", false},
+		{"@every 30s", false},
+		{"@every 500ms", true},
+		{"@every soon", true},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"0 24 * * *", true},
+		{"0 0 * 13 *", true},
+		{"0 0 * * 8", true},
+		{"@weekly-ish", true},
+	}
+	for _, tt := range tests {
+		if _, err := parseSchedule(tt.spec); (err != nil) != tt.wantErr {
+			t.Errorf("parseSchedule(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// 锁住数据目录, 进程退出 (包括崩溃) 时由系统释放
+func lockDir(dir string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, errLocked
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,22 @@
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// 没有 flock, 用独占创建的文件代替, 进程崩溃后需要手动删除
+func lockDir(dir string) (func(), error) {
+	path := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if os.IsExist(err) {
+		return nil, errLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		f.Close()
+		os.Remove(path)
+	}, nil
+}
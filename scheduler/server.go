@@ -0,0 +1,625 @@
+// 任务调度服务, 按 cron 表达式定时调用其他服务的接口
+// 每次执行只发给目标服务的一个实例, 失败后重试, 任务和执行记录保存在磁盘上, 重启后继续
+
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"distributed/registry"
+	"distributed/trace"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 没有设置 MaxAttempts 时的默认值
+	defaultAttempts = 3
+	// 重试间隔, 每次翻倍
+	retryDelay    = time.Second * 2
+	maxRetryDelay = time.Minute
+	// 每次调用的超时时间
+	dispatchTimeout = time.Second * 30
+	// 每个任务保存的执行记录数量
+	maxHistory = 50
+	// 检查到期任务的间隔
+	tickInterval = time.Second
+	// 调用目标服务时带上这两个请求头, 目标服务可以用 Run ID 对重试去重
+	jobIDHeader = "X-Job-ID"
+	runIDHeader = "X-Job-Run-ID"
+	// 数据目录中的锁文件, 同一时间只有一个调度服务可以使用这个目录
+	lockFile = "scheduler.lock"
+)
+
+// 另一个调度服务正在使用同一个数据目录, 两个都执行的话每个任务会被执行两次
+var errLocked = errors.New("data directory is used by another scheduler")
+
+// 任务定义
+type Job struct {
+	ID   string
+	Name string
+	// cron 表达式, 例如 "0 9 * * 1-5", 也可以是 "@hourly", "@every 30s"
+	Schedule string
+	// 调用 Service 的一个实例的 Path, Method 默认为 POST
+	Service registry.ServiceName
+	Path    string
+	Method  string          `json:",omitempty"`
+	Payload json.RawMessage `json:",omitempty"`
+	// 最多尝试的次数, 为 0 时使用默认值
+	MaxAttempts int `json:",omitempty"`
+	// 暂停后不再按计划执行, 仍然可以手动触发
+	Paused  bool
+	NextRun time.Time
+	LastRun time.Time
+}
+
+func (j *Job) validate() error {
+	if j.Name == "" {
+		return fmt.Errorf("job name is required")
+	}
+	if j.Service == "" {
+		return fmt.Errorf("target service is required")
+	}
+	if !strings.HasPrefix(j.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if j.Method == "" {
+		j.Method = http.MethodPost
+	}
+	j.Method = strings.ToUpper(j.Method)
+	if j.MaxAttempts < 0 {
+		return fmt.Errorf("max attempts must not be negative")
+	}
+	if len(j.Payload) > 0 && !json.Valid(j.Payload) {
+		return fmt.Errorf("payload must be JSON")
+	}
+	_, err := parseSchedule(j.Schedule)
+	return err
+}
+
+type RunStatus string
+
+const (
+	RunRunning   = RunStatus("running")
+	RunSucceeded = RunStatus("succeeded")
+	RunFailed    = RunStatus("failed")
+)
+
+// 一次尝试
+type Attempt struct {
+	Time       time.Time
+	Instance   string `json:",omitempty"`
+	StatusCode int    `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+// 一次执行, 包含所有尝试
+type Execution struct {
+	ID        string
+	JobID     string
+	Scheduled time.Time
+	// 手动触发的执行
+	Manual   bool `json:",omitempty"`
+	Status   RunStatus
+	Attempts []Attempt
+	Finished time.Time
+}
+
+type scheduler struct {
+	dir    string
+	lock   sync.Mutex
+	jobs   map[string]*Job
+	sched  map[string]schedule
+	runs   map[string][]*Execution
+	client *http.Client
+}
+
+var s *scheduler
+
+func randomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// 从 dir 中恢复任务和执行记录, 继续重启前没有完成的执行, 然后开始调度, 直到 stop 被关闭
+// 同一个 dir 只能有一个调度服务在使用, 否则返回 errLocked
+func Run(dir string, stop <-chan struct{}) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	if err := load(dir); err != nil {
+		unlock()
+		return err
+	}
+
+	go func() {
+		defer unlock()
+
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+		resumed := false
+		for {
+			select {
+			case now := <-ticker.C:
+				// 第一次检查时服务已经注册完成, 可以找到目标服务的实例
+				if !resumed {
+					resumed = true
+					s.resume()
+				}
+				s.dispatchDue(now)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// 已有的任务调用的服务, 启动时把它们声明为可选依赖, 新的服务在第一次调用时加入
+func Targets() []registry.ServiceName {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	targets := make([]registry.ServiceName, 0)
+	seen := make(map[registry.ServiceName]bool)
+	for _, job := range s.jobs {
+		if !seen[job.Service] {
+			seen[job.Service] = true
+			targets = append(targets, job.Service)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i] < targets[j]
+	})
+	return targets
+}
+
+func load(dir string) error {
+	s = &scheduler{
+		dir:    dir,
+		jobs:   make(map[string]*Job),
+		sched:  make(map[string]schedule),
+		runs:   make(map[string][]*Execution),
+		client: &http.Client{Timeout: dispatchTimeout},
+	}
+
+	var jobs []*Job
+	if err := readJSON(filepath.Join(dir, "jobs.json"), &jobs); err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		sched, err := parseSchedule(job.Schedule)
+		if err != nil {
+			log.Printf("Skipping job %s: %v\n", job.ID, err)
+			continue
+		}
+		s.jobs[job.ID] = job
+		s.sched[job.ID] = sched
+	}
+	if err := readJSON(filepath.Join(dir, "runs.json"), &s.runs); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 继续重启前没有完成的执行
+func (s *scheduler) resume() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, runs := range s.runs {
+		for _, run := range runs {
+			if run.Status != RunRunning {
+				continue
+			}
+			if job, ok := s.jobs[run.JobID]; ok {
+				log.Printf("Resuming run %s of job %s\n", run.ID, job.Name)
+				go s.execute(*job, run)
+			}
+		}
+	}
+}
+
+// 启动所有到期的任务, 停机期间错过的多次执行只补一次
+func (s *scheduler) dispatchDue(now time.Time) {
+	s.lock.Lock()
+	var due []*Execution
+	var jobs []Job
+	for id, job := range s.jobs {
+		if job.Paused || job.NextRun.IsZero() || job.NextRun.After(now) {
+			continue
+		}
+		run := s.newRun(job, job.NextRun, false)
+		job.NextRun = s.sched[id].next(now)
+		due = append(due, run)
+		jobs = append(jobs, *job)
+	}
+	if len(due) > 0 {
+		// 先保存下一次的时间和执行记录再调用, 重启后不会重复执行, 也不会丢失正在执行的任务
+		s.save()
+	}
+	s.lock.Unlock()
+
+	for i := range due {
+		go s.execute(jobs[i], due[i])
+	}
+}
+
+// 调用方需要持有锁
+func (s *scheduler) newRun(job *Job, scheduled time.Time, manual bool) *Execution {
+	run := &Execution{
+		ID:        randomID(),
+		JobID:     job.ID,
+		Scheduled: scheduled,
+		Manual:    manual,
+		Status:    RunRunning,
+	}
+	job.LastRun = time.Now()
+	runs := append(s.runs[job.ID], run)
+	if len(runs) > maxHistory {
+		runs = runs[len(runs)-maxHistory:]
+	}
+	s.runs[job.ID] = runs
+	return run
+}
+
+// 执行一次任务, 失败时换一个实例重试, 每次尝试之后保存记录
+func (s *scheduler) execute(job Job, run *Execution) {
+	attempts := job.MaxAttempts
+	if attempts == 0 {
+		attempts = defaultAttempts
+	}
+	ctx, span := trace.StartSpan(context.Background(), "job "+job.Name, trace.KindInternal)
+	span.SetAttribute("job.id", job.ID)
+	span.SetAttribute("job.run_id", run.ID)
+	defer span.End()
+
+	s.lock.Lock()
+	tried := make(map[string]bool)
+	for _, a := range run.Attempts {
+		tried[a.Instance] = true
+	}
+	done := len(run.Attempts)
+	// 恢复的执行已经用完了尝试次数 (例如 MaxAttempts 被调小了), 不会再尝试, 直接标记为失败
+	if done >= attempts && run.Status == RunRunning {
+		run.Status = RunFailed
+		run.Finished = time.Now()
+		s.save()
+	}
+	s.lock.Unlock()
+
+	delay := retryDelay
+	for i := done; i < attempts; i++ {
+		if i > done || done > 0 {
+			time.Sleep(delay)
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+
+		a := s.attempt(ctx, job, run.ID, tried)
+		tried[a.Instance] = true
+
+		s.lock.Lock()
+		run.Attempts = append(run.Attempts, a)
+		if a.Error == "" {
+			run.Status = RunSucceeded
+			run.Finished = time.Now()
+		} else if i == attempts-1 {
+			run.Status = RunFailed
+			run.Finished = time.Now()
+		}
+		s.save()
+		s.lock.Unlock()
+
+		if a.Error == "" {
+			return
+		}
+		log.Printf("Job %s attempt %d/%d failed: %s\n", job.Name, i+1, attempts, a.Error)
+	}
+	span.SetError(fmt.Errorf("job %s failed after %d attempts", job.Name, attempts))
+}
+
+// 和其他服务一样通过 GetProviders 选择目标服务的实例, 所以 gossip 模式, 正在停止的实例,
+// zone 和按版本分流都和普通的调用相同, 重试时优先选择还没有尝试过的实例
+func (s *scheduler) attempt(ctx context.Context, job Job, runID string, tried map[string]bool) Attempt {
+	a := Attempt{Time: time.Now()}
+
+	// 目标服务不在依赖中时先加进去, 之后才能找到它的实例
+	if err := registry.RequireServices(job.Service); err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	urls, err := registry.GetProviders(job.Service)
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	a.Instance = urls[0]
+	for _, u := range urls {
+		if !tried[u] {
+			a.Instance = u
+			break
+		}
+	}
+
+	req, err := http.NewRequest(job.Method, strings.TrimSuffix(a.Instance, "/")+job.Path, bytes.NewBuffer(job.Payload))
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	if len(job.Payload) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(jobIDHeader, job.ID)
+	req.Header.Set(runIDHeader, runID)
+	res, err := trace.Do(ctx, s.client, req)
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	res.Body.Close()
+	a.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		a.Error = fmt.Sprintf("responded with code %v", res.StatusCode)
+	}
+	return a
+}
+
+func (s *scheduler) add(job Job) (Job, error) {
+	if err := job.validate(); err != nil {
+		return job, err
+	}
+	sched, _ := parseSchedule(job.Schedule)
+	job.ID = randomID()
+	job.NextRun = sched.next(time.Now())
+	job.LastRun = time.Time{}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.jobs[job.ID] = &job
+	s.sched[job.ID] = sched
+	s.save()
+	return job, nil
+}
+
+// 修改任务定义, 保留 ID 和执行记录, 重新计算下一次执行的时间
+func (s *scheduler) update(id string, job Job) (Job, error) {
+	if err := job.validate(); err != nil {
+		return job, err
+	}
+	sched, _ := parseSchedule(job.Schedule)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existing, ok := s.jobs[id]
+	if !ok {
+		return job, fmt.Errorf("job %s not found", id)
+	}
+	job.ID = id
+	job.LastRun = existing.LastRun
+	job.NextRun = sched.next(time.Now())
+	s.jobs[id] = &job
+	s.sched[id] = sched
+	s.save()
+	return job, nil
+}
+
+func (s *scheduler) remove(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.jobs[id]; !ok {
+		return fmt.Errorf("job %s not found", id)
+	}
+	delete(s.jobs, id)
+	delete(s.sched, id)
+	delete(s.runs, id)
+	s.save()
+	return nil
+}
+
+// 立即执行一次, 不影响计划中的下一次执行
+func (s *scheduler) trigger(id string) (Execution, error) {
+	s.lock.Lock()
+	job, ok := s.jobs[id]
+	if !ok {
+		s.lock.Unlock()
+		return Execution{}, fmt.Errorf("job %s not found", id)
+	}
+	run := s.newRun(job, time.Now(), true)
+	s.save()
+	copied := *run
+	// dispatchDue 会在锁内修改 job, 复制之后再交给 execute
+	jobCopy := *job
+	s.lock.Unlock()
+
+	go s.execute(jobCopy, run)
+	return copied, nil
+}
+
+func (s *scheduler) list() []Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Name < jobs[j].Name
+	})
+	return jobs
+}
+
+func (s *scheduler) get(id string) (Job, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// 最近的执行记录, 新的在前
+func (s *scheduler) history(id string, limit int) []Execution {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	runs := s.runs[id]
+	history := make([]Execution, 0, len(runs))
+	for i := len(runs) - 1; i >= 0 && len(history) < limit; i-- {
+		run := *runs[i]
+		run.Attempts = append([]Attempt(nil), run.Attempts...)
+		history = append(history, run)
+	}
+	return history
+}
+
+// 保存任务和执行记录, 调用方需要持有锁
+func (s *scheduler) save() {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	if err := writeJSON(filepath.Join(s.dir, "jobs.json"), jobs); err != nil {
+		log.Println(err)
+	}
+	if err := writeJSON(filepath.Join(s.dir, "runs.json"), s.runs); err != nil {
+		log.Println(err)
+	}
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// 先写临时文件再替换, 写到一半崩溃不会破坏原来的文件
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func respondJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// GET /jobs 列出任务
+// POST /jobs 创建任务
+// GET /jobs/{id} 查询任务
+// PUT /jobs/{id} 修改任务
+// DELETE /jobs/{id} 删除任务和执行记录
+// POST /jobs/{id}/run 立即执行一次
+// GET /jobs/{id}/runs?limit=20 最近的执行记录
+func RegisterHandlers() {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(pathSegments) == 1 && r.Method == http.MethodGet:
+			respondJSON(w, s.list())
+		case len(pathSegments) == 1 && r.Method == http.MethodPost:
+			var job Job
+			if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			job, err := s.add(job)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			respondJSON(w, job)
+		case len(pathSegments) == 2 && r.Method == http.MethodGet:
+			job, ok := s.get(pathSegments[1])
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			respondJSON(w, job)
+		case len(pathSegments) == 2 && r.Method == http.MethodPut:
+			if _, ok := s.get(pathSegments[1]); !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var job Job
+			if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			job, err := s.update(pathSegments[1], job)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			respondJSON(w, job)
+		case len(pathSegments) == 2 && r.Method == http.MethodDelete:
+			if err := s.remove(pathSegments[1]); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		case len(pathSegments) == 3 && pathSegments[2] == "run" && r.Method == http.MethodPost:
+			run, err := s.trigger(pathSegments[1])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			respondJSON(w, run)
+		case len(pathSegments) == 3 && pathSegments[2] == "runs" && r.Method == http.MethodGet:
+			if _, ok := s.get(pathSegments[1]); !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil || limit <= 0 {
+				limit = 20
+			}
+			respondJSON(w, s.history(pathSegments[1], limit))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+	http.HandleFunc("/jobs", handler)
+	http.HandleFunc("/jobs/", handler)
+}
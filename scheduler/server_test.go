@@ -0,0 +1,34 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 同一个数据目录只能有一个调度服务, 第一个停止之后才能再启动
+func TestRunLocksDataDir(t *testing.T) {
+	dir := t.TempDir()
+	stop := make(chan struct{})
+	if err := Run(dir, stop); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Run(dir, make(chan struct{})); !errors.Is(err, errLocked) {
+		t.Fatalf("second Run error = %v, want %v", err, errLocked)
+	}
+	close(stop)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		again := make(chan struct{})
+		err := Run(dir, again)
+		if err == nil {
+			close(again)
+			break
+		}
+		if !errors.Is(err, errLocked) || time.Now().After(deadline) {
+			t.Fatalf("Run after stop error = %v", err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -2,79 +2,417 @@ package service
 
 import (
 	"context"
+	"distributed/metrics"
 	"distributed/registry"
+	"distributed/trace"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// 等待依赖服务超时, Start 仍然会返回可用的 ctx, 调用方可以决定是否继续运行
+var ErrRequiredServicesTimeout = errors.New("timed out waiting for required services")
+
+// 用于定制 Start 的行为
+type Option func(*options)
+
+type options struct {
+	// 大于 0 时, Start 会阻塞直到所有依赖服务都有 provider
+	waitTimeout time.Duration
+	// 等待期间报告进度的间隔
+	waitInterval time.Duration
+	onUp         []func(name registry.ServiceName, url string)
+	onDown       []func(name registry.ServiceName)
+	// 为 true 时不使用注册中心, 通过 gossipSeeds 加入 gossip 集群
+	gossip      bool
+	gossipSeeds []string
+	// 大于 0 时设置选择 provider 的外溢阈值
+	spilloverThreshold int
+	// 停止时等待正在处理的请求的最长时间
+	drainTimeout time.Duration
+	// 注销之后按顺序执行
+	shutdownHooks []func(ctx context.Context) error
+	// 开始等待正在处理的请求时执行
+	drainHooks []func()
+	// 为 true 时在终端按回车也可以停止服务
+	interactive bool
+}
+
+// 收到 SIGINT 或 SIGTERM 后最多等待 d, 让正在处理的请求完成, 超时后直接关闭连接
+func WithDrainTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.drainTimeout = d
+	}
+}
+
+// 服务停止时, 在请求处理完并从注册中心注销之后调用 fn, 多个 fn 按添加的顺序调用
+// ctx 在 drain timeout 之后超时
+func OnShutdown(fn func(ctx context.Context) error) Option {
+	return func(o *options) {
+		o.shutdownHooks = append(o.shutdownHooks, fn)
+	}
+}
+
+// 服务停止时, 在开始等待正在处理的请求时调用 fn, 用来结束 SSE 这类不会自己结束的长连接
+func OnDrain(fn func()) Option {
+	return func(o *options) {
+		o.drainHooks = append(o.drainHooks, fn)
+	}
+}
+
+// 除了信号之外, 在终端按回车也可以停止服务, 适合在终端里手动运行
+func Interactive() Option {
+	return func(o *options) {
+		o.interactive = true
+	}
+}
+
+// 同 zone 的依赖服务实例少于 n 个时, 按比例把请求分给其他 zone 的实例
+func WithSpilloverThreshold(n int) Option {
+	return func(o *options) {
+		o.spilloverThreshold = n
+	}
+}
+
+// 不使用注册中心, 通过 seeds 中的服务地址加入 gossip 集群, seeds 可以为空
+func WithGossipSeeds(seeds ...string) Option {
+	return func(o *options) {
+		o.gossip = true
+		o.gossipSeeds = seeds
+	}
+}
+
+// Start 注册完成后最多等待 timeout, 直到每个硬依赖都至少有一个 provider
+// OptionalServices 中的服务不会等待, 可以通过 OnRequiredServiceUp 在它们上线后再接入
+func WaitForRequiredServices(timeout time.Duration) Option {
+	return func(o *options) {
+		o.waitTimeout = timeout
+	}
+}
+
+// 依赖的服务出现时调用 fn, 包括注册时就已经存在的服务
+func OnRequiredServiceUp(fn func(name registry.ServiceName, url string)) Option {
+	return func(o *options) {
+		o.onUp = append(o.onUp, fn)
+	}
+}
+
+// 依赖的服务全部下线时调用 fn
+func OnRequiredServiceDown(fn func(name registry.ServiceName)) Option {
+	return func(o *options) {
+		o.onDown = append(o.onDown, fn)
+	}
+}
+
 // 用来集中启动所有 service 服务
 func Start(
 	ctx context.Context,
 	host, port string,
 	reg registry.Registration,
 	registerHandlersFunc func(),
+	opts ...Option,
 ) (context.Context, error) {
+	o := options{
+		waitInterval: time.Second * 2,
+		drainTimeout: defaultDrainTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	// 注册 HTTP 服务
 	registerHandlersFunc()
+	metrics.RegisterEndpoint()
+	if err := registerReadinessHandler(reg); err != nil {
+		return ctx, err
+	}
 
-	// 启动服务
-	ctx = startService(ctx, reg.ServiceName, host, port)
+	// 回调要在注册之前设置, 注册时注册中心就会把已有的依赖服务发过来
+	for _, fn := range o.onUp {
+		registry.OnServiceUp(fn)
+	}
+	for _, fn := range o.onDown {
+		registry.OnServiceDown(fn)
+	}
+	if o.spilloverThreshold > 0 {
+		registry.SetSpilloverThreshold(o.spilloverThreshold)
+	}
+	if err := setupTracing(reg); err != nil {
+		return ctx, err
+	}
+
+	// 停止时先标记为 draining, 处理完请求后再从注册中心或者 gossip 集群中移除
+	lc := lifecycle{
+		drain: func() error {
+			if o.gossip {
+				return registry.DrainGossip()
+			}
+			return registry.MarkDraining(reg.ServiceURL)
+		},
+		deregister: func() error {
+			if o.gossip {
+				return registry.LeaveGossip()
+			}
+			return registry.ShutdownService(reg.ServiceURL)
+		},
+	}
+
+	// 启动服务, 端口监听成功之后才注册, 监听失败时不会留下无法访问的注册信息
+	ctx, err := startService(ctx, reg.ServiceName, port, o, lc)
+	if err != nil {
+		return ctx, err
+	}
 
 	// 注册服务到注册中心
-	if err := registry.RegisterService(reg); err != nil {
+	var id string
+	if o.gossip {
+		id, err = registry.JoinGossip(reg, o.gossipSeeds)
+	} else {
+		id, err = registry.RegisterService(reg)
+	}
+	if err != nil {
 		return ctx, err
 	}
+	log.Printf("%v registered with instance ID %s\n", reg.ServiceName, id)
+
+	if o.waitTimeout > 0 && len(reg.HardDependencies()) > 0 {
+		if err := waitForRequiredServices(ctx, reg, o); err != nil {
+			return ctx, err
+		}
+	}
 
 	return ctx, nil
 }
 
+func waitForRequiredServices(ctx context.Context, reg registry.Registration, o options) error {
+	waitCtx, cancel := context.WithTimeout(ctx, o.waitTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := registry.WaitForProviders(
+		waitCtx,
+		reg.HardDependencies(),
+		o.waitInterval,
+		func(missing []registry.ServiceName) {
+			log.Printf("%v waiting for required services %v (%v elapsed)\n",
+				reg.ServiceName, missing, time.Since(start).Round(time.Second))
+		},
+	)
+	if err == nil {
+		return nil
+	}
+	// 服务本身被停止了, 不算超时
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w: %v", ErrRequiredServicesTimeout, err)
+}
+
+// 所有请求都会创建 server span, 依赖了追踪服务时把 span 上报过去
+// 心跳检查和指标采集太频繁, 不记录
+func setupTracing(reg registry.Registration) error {
+	trace.SetServiceName(string(reg.ServiceName))
+
+	heartbeatURL, err := url.Parse(reg.HeartbeatURL)
+	if err != nil {
+		return err
+	}
+	trace.Ignore(heartbeatURL.Path, "/metrics")
+	metrics.Ignore(heartbeatURL.Path)
+
+	for _, name := range reg.RequiredServices {
+		if name != registry.TraceService {
+			continue
+		}
+		registry.OnServiceUp(func(name registry.ServiceName, url string) {
+			if name == registry.TraceService {
+				trace.SetReporter(url)
+			}
+		})
+		registry.OnServiceDown(func(name registry.ServiceName) {
+			if name == registry.TraceService {
+				trace.UnsetReporter()
+			}
+		})
+	}
+	return nil
+}
+
+// 服务的就绪状态, 所有硬依赖都有 provider 时才是就绪的
+type readiness struct {
+	Ready bool
+	// 缺少 provider 的硬依赖
+	Missing []registry.ServiceName `json:",omitempty"`
+	// 缺少 provider 的可选依赖, 服务处于降级状态
+	Degraded []registry.ServiceName `json:",omitempty"`
+}
+
+// 在 ServiceURL 下注册 /ready, 就绪时返回 200, 否则返回 503
+func registerReadinessHandler(reg registry.Registration) error {
+	serviceURL, err := url.Parse(reg.ServiceURL)
+	if err != nil {
+		return err
+	}
+
+	http.HandleFunc(strings.TrimSuffix(serviceURL.Path, "/")+"/ready", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var rd readiness
+		hard := reg.HardDependencies()
+		for _, name := range registry.MissingProviders(reg.RequiredServices) {
+			isHard := false
+			for _, h := range hard {
+				if h == name {
+					isHard = true
+					break
+				}
+			}
+			if isHard {
+				rd.Missing = append(rd.Missing, name)
+			} else {
+				rd.Degraded = append(rd.Degraded, name)
+			}
+		}
+		rd.Ready = len(rd.Missing) == 0
+
+		w.Header().Set("Content-Type", "application/json")
+		if !rd.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(rd); err != nil {
+			log.Println(err)
+		}
+	})
+	return nil
+}
+
+// 停止服务时依次执行的阶段
+type lifecycle struct {
+	// 标记为 draining, 依赖方不再选择本实例
+	drain func() error
+	// 从注册中心或者 gossip 集群中移除
+	deregister func() error
+}
+
+const (
+	defaultDrainTimeout = time.Second * 10
+	// 标记为 draining 之后等待 patch 传到依赖方, 期间仍然正常接收请求
+	drainPropagation = time.Second
+)
+
+// 启动 HTTP 服务, 收到 SIGINT 或 SIGTERM (交互模式下也可以按回车) 后按顺序停止:
+// 标记 draining, 等待正在处理的请求, 注销, 执行 shutdown hooks, 最后取消返回的 ctx
+// 停止过程中再次收到信号时直接退出
+// 端口监听失败时返回错误, 这时还没有注册, 不需要注销
 func startService(
 	ctx context.Context,
 	serviceName registry.ServiceName,
-	host, port string,
-) context.Context {
+	port string,
+	o options,
+	lc lifecycle,
+) (context.Context, error) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return ctx, err
+	}
 	ctx, cancel := context.WithCancel(ctx)
 
 	var srv http.Server
-	srv.Addr = ":" + port
+	srv.Handler = trace.Middleware(metrics.Middleware(http.DefaultServeMux))
+	for _, fn := range o.drainHooks {
+		srv.RegisterOnShutdown(fn)
+	}
 
-	// 启动服务
+	// srv.Serve() 是阻塞的, 返回错误
+	serveErr := make(chan error, 1)
 	go func() {
-		// srv.ListenAndServe() 是阻塞的, 返回错误
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
-		}
+		serveErr <- srv.Serve(listener)
+	}()
 
-		// 退出后移除服务
-		if err := registry.ShutdownService(fmt.Sprintf("http://%s:%s", host, port)); err != nil {
-			log.Println(err)
-		}
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	var enter chan struct{}
+	if o.interactive {
+		enter = make(chan struct{})
+		go func() {
+			fmt.Printf("%v started. Press any key to stop.\n", serviceName)
 
-		// 如果是正常退出则直接退出, 如果是异常的话就执行 cancel()
+			var s string
+			fmt.Scanln(&s)
+			close(enter)
+		}()
+	} else {
+		fmt.Printf("%v started. Press Ctrl+C to stop.\n", serviceName)
+	}
+
+	go func() {
+		defer cancel()
+		defer signal.Stop(sigs)
+
+		serving := true
 		select {
+		case sig := <-sigs:
+			log.Printf("Received %v, shutting down %v\n", sig, serviceName)
+		case <-enter:
+		case err := <-serveErr:
+			// 服务出错停止, 没有请求需要等待
+			log.Println(err)
+			serving = false
 		case <-ctx.Done():
-			break
-		default:
-			cancel()
 		}
-	}()
 
-	// 等待手动停止
-	go func() {
-		fmt.Printf("%v started. Press any key to stop.\n", serviceName)
+		go func() {
+			if sig, ok := <-sigs; ok {
+				log.Printf("Received %v again, exiting immediately\n", sig)
+				os.Exit(1)
+			}
+		}()
 
-		var s string
-		fmt.Scanln(&s)
+		if serving {
+			if err := lc.drain(); err != nil {
+				log.Println(err)
+			} else {
+				propagation := drainPropagation
+				if propagation > o.drainTimeout {
+					propagation = o.drainTimeout
+				}
+				time.Sleep(propagation)
+			}
 
-		// if err := registry.ShutdownService(fmt.Sprintf("http://%s:%s", host, port)); err != nil {
-		// log.Println(err)
-		// }
+			// Shutdown 不再接收新的连接, 并等待正在处理的请求完成
+			drainCtx, cancelDrain := context.WithTimeout(context.Background(), o.drainTimeout)
+			if err := srv.Shutdown(drainCtx); err != nil {
+				log.Printf("Requests still in flight after %v, closing connections\n", o.drainTimeout)
+				srv.Close()
+			}
+			cancelDrain()
+		}
 
-		srv.Shutdown(ctx)
+		if err := lc.deregister(); err != nil {
+			log.Println(err)
+		}
 
-		cancel()
+		for _, fn := range o.shutdownHooks {
+			hookCtx, cancelHook := context.WithTimeout(context.Background(), o.drainTimeout)
+			if err := fn(hookCtx); err != nil {
+				log.Println(err)
+			}
+			cancelHook()
+		}
 	}()
 
-	return ctx
+	return ctx, nil
 }
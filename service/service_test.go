@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录停止时执行了哪些阶段
+type stages struct {
+	lock  sync.Mutex
+	order []string
+}
+
+func (s *stages) add(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.order = append(s.order, name)
+}
+
+func (s *stages) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return fmt.Sprint(s.order)
+}
+
+func (s *stages) lifecycle() lifecycle {
+	return lifecycle{
+		drain:      func() error { s.add("drain"); return nil },
+		deregister: func() error { s.add("deregister"); return nil },
+	}
+}
+
+func TestStartService(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busyPort := strconv.Itoa(busy.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		name string
+		port string
+		err  bool
+		// 停止时按顺序执行的阶段
+		stages string
+	}{
+		// 监听失败时直接返回错误, 不会注销还没有完成的注册
+		{"port in use", busyPort, true, "[]"},
+		{"stopped", "0", false, "[drain deregister shutdown]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &stages{}
+			done := make(chan struct{})
+			o := options{
+				drainTimeout: 100 * time.Millisecond,
+				shutdownHooks: []func(ctx context.Context) error{func(ctx context.Context) error {
+					s.add("shutdown")
+					close(done)
+					return nil
+				}},
+			}
+			parent, stop := context.WithCancel(context.Background())
+			defer stop()
+
+			_, err := startService(parent, "TestService", tt.port, o, s.lifecycle())
+			if (err != nil) != tt.err {
+				t.Fatalf("startService error = %v, want error = %v", err, tt.err)
+			}
+			if err == nil {
+				stop()
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("service did not stop")
+				}
+			}
+			if got := s.String(); got != tt.stages {
+				t.Errorf("stages = %s, want %s", got, tt.stages)
+			}
+		})
+	}
+}
+
+// startService 返回时已经在监听, 注册之后马上到达的请求不会被拒绝
+func TestStartServiceListening(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	s := &stages{}
+	done := make(chan struct{})
+	o := options{
+		drainTimeout: 100 * time.Millisecond,
+		shutdownHooks: []func(ctx context.Context) error{func(ctx context.Context) error {
+			close(done)
+			return nil
+		}},
+	}
+	parent, stop := context.WithCancel(context.Background())
+	if _, err := startService(parent, "TestService", port, o, s.lifecycle()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	res, err := http.Get("http://localhost:" + port + "/no-such-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,125 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// 等待上报的 span 数量上限, 超过时直接丢弃, 不能影响业务请求
+	reportQueueSize = 1000
+	// 每批最多上报的 span 数量, 以及最长等待时间
+	reportBatchSize     = 100
+	reportFlushInterval = time.Second
+)
+
+type reporter struct {
+	lock    sync.RWMutex
+	url     string
+	service string
+	queue   chan SpanData
+	once    sync.Once
+	// 上报本身不能再产生 span, 所以使用普通的 client
+	client *http.Client
+}
+
+var rep = &reporter{
+	queue:  make(chan SpanData, reportQueueSize),
+	client: &http.Client{Timeout: time.Second * 5},
+}
+
+// 设置本服务的名称, 会记录在每个 span 中
+func SetServiceName(name string) {
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+
+	rep.service = name
+}
+
+func serviceName() string {
+	rep.lock.RLock()
+	defer rep.lock.RUnlock()
+
+	return rep.service
+}
+
+// 把 span 上报到 serviceURL 对应的追踪服务
+func SetReporter(serviceURL string) {
+	rep.lock.Lock()
+	rep.url = serviceURL
+	rep.lock.Unlock()
+
+	rep.once.Do(func() {
+		go rep.run()
+	})
+}
+
+// 追踪服务不可用时停止上报, 之后产生的 span 会被丢弃
+func UnsetReporter() {
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+
+	rep.url = ""
+}
+
+func report(span SpanData) {
+	rep.lock.RLock()
+	enabled := rep.url != ""
+	rep.lock.RUnlock()
+	if !enabled {
+		return
+	}
+
+	select {
+	case rep.queue <- span:
+	default:
+	}
+}
+
+// 攒够一批或者等待超时后上报
+func (r *reporter) run() {
+	ticker := time.NewTicker(reportFlushInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	for {
+		select {
+		case span := <-r.queue:
+			batch = append(batch, span)
+			if len(batch) < reportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		r.send(batch)
+		batch = nil
+	}
+}
+
+func (r *reporter) send(batch []SpanData) {
+	r.lock.RLock()
+	url := r.url
+	r.lock.RUnlock()
+	if url == "" {
+		return
+	}
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	res, err := r.client.Post(url+"/traces", "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+}
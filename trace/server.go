@@ -0,0 +1,172 @@
+// 追踪服务, 接收各个服务上报的 span, 按 trace id 查询完整的调用树
+
+package trace
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 最多保存的 trace 数量, 超过时丢弃最早的
+const maxTraces = 10000
+
+type store struct {
+	lock   sync.RWMutex
+	traces map[string][]SpanData
+	// trace id 按第一次收到的顺序排列, 用于淘汰
+	order []string
+}
+
+var traces = &store{
+	traces: make(map[string][]SpanData),
+}
+
+func (s *store) add(spans []SpanData) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, span := range spans {
+		if span.TraceID == "" || span.SpanID == "" {
+			continue
+		}
+		if _, ok := s.traces[span.TraceID]; !ok {
+			s.order = append(s.order, span.TraceID)
+		}
+		s.traces[span.TraceID] = append(s.traces[span.TraceID], span)
+	}
+
+	for len(s.order) > maxTraces {
+		delete(s.traces, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *store) get(traceID string) []SpanData {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	spans := make([]SpanData, len(s.traces[traceID]))
+	copy(spans, s.traces[traceID])
+	return spans
+}
+
+// trace 的摘要, 用于列出最近的 trace
+type Summary struct {
+	TraceID  string
+	Root     string
+	Service  string
+	Start    time.Time
+	Duration time.Duration
+	Spans    int
+	Errors   int
+}
+
+// 最近的 limit 个 trace, 新的在前
+func (s *store) recent(limit int) []Summary {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var summaries []Summary
+	for i := len(s.order) - 1; i >= 0 && len(summaries) < limit; i-- {
+		spans := s.traces[s.order[i]]
+		sum := Summary{TraceID: s.order[i], Spans: len(spans)}
+		for _, span := range spans {
+			if span.Error != "" {
+				sum.Errors++
+			}
+			if sum.Root == "" || span.Start.Before(sum.Start) {
+				sum.Root, sum.Service, sum.Start, sum.Duration = span.Name, span.Service, span.Start, span.Duration
+			}
+		}
+		summaries = append(summaries, sum)
+	}
+	return summaries
+}
+
+// 调用树的节点
+type Node struct {
+	SpanData
+	Children []*Node `json:",omitempty"`
+}
+
+// 按 ParentID 把 span 组织成树, 找不到父 span 的作为根节点
+func buildTree(spans []SpanData) []*Node {
+	nodes := make(map[string]*Node, len(spans))
+	for _, span := range spans {
+		nodes[span.SpanID] = &Node{SpanData: span}
+	}
+
+	var roots []*Node
+	for _, span := range spans {
+		node := nodes[span.SpanID]
+		if parent, ok := nodes[span.ParentID]; ok && span.ParentID != span.SpanID {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	var sortNodes func(nodes []*Node)
+	sortNodes = func(nodes []*Node) {
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[i].Start.Before(nodes[j].Start)
+		})
+		for _, node := range nodes {
+			sortNodes(node.Children)
+		}
+	}
+	sortNodes(roots)
+	return roots
+}
+
+// POST /traces 上报一批 span
+// GET /traces?limit=20 最近的 trace
+// GET /traces/{id} 一个 trace 的调用树
+func RegisterHandlers() {
+	// 上报和查询本身不产生 span
+	Ignore("/traces")
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(pathSegments) == 1 && r.Method == http.MethodPost:
+			var spans []SpanData
+			if err := json.NewDecoder(r.Body).Decode(&spans); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			traces.add(spans)
+		case len(pathSegments) == 1 && r.Method == http.MethodGet:
+			limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil || limit <= 0 {
+				limit = 20
+			}
+			writeJSON(w, traces.recent(limit))
+		case len(pathSegments) == 2 && r.Method == http.MethodGet:
+			spans := traces.get(pathSegments[1])
+			if len(spans) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeJSON(w, buildTree(spans))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+	http.HandleFunc("/traces", handler)
+	http.HandleFunc("/traces/", handler)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,270 @@
+// 分布式追踪, 使用 W3C traceparent 请求头在服务之间传递追踪上下文
+// traceparent 的格式为 00-<32 位 trace id>-<16 位 parent span id>-<2 位 flags>
+
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TraceparentHeader = "traceparent"
+
+const (
+	KindServer   = "server"
+	KindClient   = "client"
+	KindInternal = "internal"
+)
+
+// 一次操作的记录, 同一个请求链路上的 span 有相同的 TraceID, 也是上报给追踪服务的格式
+type SpanData struct {
+	TraceID  string
+	SpanID   string
+	ParentID string `json:",omitempty"`
+	Name     string
+	Service  string
+	Kind     string
+	Start    time.Time
+	Duration time.Duration
+	// 附加信息, 例如 HTTP 方法和状态码
+	Attributes map[string]string `json:",omitempty"`
+	Error      string            `json:",omitempty"`
+}
+
+// 正在进行中的 span
+type Span struct {
+	SpanData
+
+	lock  sync.Mutex
+	ended bool
+}
+
+type spanKey struct{}
+
+// 返回 ctx 中当前的 span, 没有时返回 nil
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// 返回只带有 ctx 中 span 的新 context, 用于在请求结束后继续运行的 goroutine,
+// 这样不会因为请求的 ctx 被取消而失败
+func Detach(ctx context.Context) context.Context {
+	if span := FromContext(ctx); span != nil {
+		return ContextWithSpan(context.Background(), span)
+	}
+	return context.Background()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return strings.Repeat("0", n*2-1) + "1"
+	}
+	return hex.EncodeToString(b)
+}
+
+// 以 ctx 中的 span 为父 span 创建新的 span, 没有父 span 时开始一条新的链路
+func StartSpan(ctx context.Context, name, kind string) (context.Context, *Span) {
+	span := &Span{SpanData: SpanData{
+		SpanID:  randomHex(8),
+		Name:    name,
+		Service: serviceName(),
+		Kind:    kind,
+		Start:   time.Now(),
+	}}
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = randomHex(16)
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Error = err.Error()
+}
+
+// 结束 span 并交给上报器, 重复调用只会上报一次
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.Duration = time.Since(s.Start)
+	data := s.SpanData
+	data.Attributes = make(map[string]string, len(s.Attributes))
+	for k, v := range s.Attributes {
+		data.Attributes[k] = v
+	}
+	s.lock.Unlock()
+
+	report(data)
+}
+
+// 生成 traceparent 请求头的值
+func (s *Span) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// 解析 traceparent, 返回 trace id 和 parent span id
+func ParseTraceparent(value string) (traceID, parentID string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false
+	}
+	for _, part := range parts[1:] {
+		if _, err := hex.DecodeString(part); err != nil {
+			return "", "", false
+		}
+	}
+	// 全 0 的 id 是无效的
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// 把 ctx 中的追踪上下文写到请求头中
+func Inject(ctx context.Context, req *http.Request) {
+	if span := FromContext(ctx); span != nil {
+		req.Header.Set(TraceparentHeader, span.Traceparent())
+	}
+}
+
+// 从请求头中读取追踪上下文, 返回的 ctx 中带有一个只用于关联父子关系的远程 span
+func Extract(ctx context.Context, r *http.Request) context.Context {
+	traceID, parentID, ok := ParseTraceparent(r.Header.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return ContextWithSpan(ctx, &Span{
+		SpanData: SpanData{TraceID: traceID, SpanID: parentID},
+		ended:    true,
+	})
+}
+
+// 为发出的请求创建一个 client span, 并把追踪上下文写到请求头中
+// 调用方需要在请求完成后调用 span.End()
+func StartClientSpan(ctx context.Context, req *http.Request) (*http.Request, *Span) {
+	ctx, span := StartSpan(ctx, req.Method+" "+req.URL.Host+req.URL.Path, KindClient)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+	req = req.WithContext(ctx)
+	Inject(ctx, req)
+	return req, span
+}
+
+// 用 client span 包装一次请求
+func Do(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	req, span := StartClientSpan(ctx, req)
+	defer span.End()
+
+	res, err := client.Do(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", fmt.Sprint(res.StatusCode))
+	return res, nil
+}
+
+var (
+	ignoredLock sync.RWMutex
+	ignored     []string
+)
+
+// 这些路径以及它们下面的路径的请求不会创建 span, 例如心跳检查和 span 上报本身
+func Ignore(paths ...string) {
+	ignoredLock.Lock()
+	defer ignoredLock.Unlock()
+
+	ignored = append(ignored, paths...)
+}
+
+func isIgnored(path string) bool {
+	ignoredLock.RLock()
+	defer ignoredLock.RUnlock()
+
+	for _, p := range ignored {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// 实现 http.Flusher, 否则包装之后流式响应无法及时发送
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 为每个收到的请求创建 server span, 父 span 来自请求头中的 traceparent
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isIgnored(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, span := StartSpan(Extract(r.Context(), r), r.Method+" "+r.URL.Path, KindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.path", r.URL.Path)
+		defer span.End()
+
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", fmt.Sprint(sr.status))
+		if sr.status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("responded with code %d", sr.status))
+		}
+	})
+}